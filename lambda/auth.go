@@ -0,0 +1,216 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/eks"
+	"github.com/aws/aws-sdk-go-v2/service/secretsmanager"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
+)
+
+// Supported values for KUBERNETES_AUTH_MODE.
+const (
+	authModeEKS         = "eks"
+	authModeInCluster   = "in-cluster"
+	authModeKubeconfig  = "kubeconfig"
+	authModePodIdentity = "pod-identity"
+)
+
+// authenticator builds the rest.Config used to reach the Kubernetes API, so
+// the same shutdown logic can run from Lambda, a laptop or a pod.
+type authenticator interface {
+	restConfig(ctx context.Context) (*rest.Config, error)
+}
+
+// newAuthenticator returns the authenticator for the cluster's auth mode.
+func newAuthenticator(cluster ClusterConfig) (authenticator, error) {
+	switch cluster.AuthMode {
+	case authModeEKS, "", authModePodIdentity:
+		if cluster.Name == "" {
+			return nil, fmt.Errorf("cluster name is required for %s auth", authModeEKS)
+		}
+		eksAuth := &eksAuthenticator{
+			clusterName: cluster.Name,
+			region:      cluster.region(),
+			host:        cluster.Host,
+			role:        cluster.role(),
+		}
+		if cluster.AuthMode == authModePodIdentity {
+			return &podIdentityAuthenticator{eks: *eksAuth}, nil
+		}
+		return eksAuth, nil
+	case authModeInCluster:
+		return &inClusterAuthenticator{}, nil
+	case authModeKubeconfig:
+		auth := &kubeconfigAuthenticator{
+			path:     cluster.Kubeconfig,
+			secretID: cluster.KubeconfigSecretID,
+			context:  cluster.KubeconfigContext,
+		}
+		if auth.path == "" && auth.secretID == "" {
+			return nil, fmt.Errorf("a kubeconfig path or secret must be set for %s auth", authModeKubeconfig)
+		}
+		return auth, nil
+	default:
+		return nil, fmt.Errorf("unsupported auth mode %q", cluster.AuthMode)
+	}
+}
+
+// usesEKSToken reports whether the auth mode authenticates with an EKS token
+// and therefore needs the cluster name.
+func usesEKSToken(mode string) bool {
+	return mode == authModeEKS || mode == authModePodIdentity || mode == ""
+}
+
+// eksAuthenticator signs STS-based aws-iam-authenticator tokens with the
+// default AWS credential chain, e.g. the Lambda execution role.
+type eksAuthenticator struct {
+	clusterName string
+	region      string
+	// host overrides the API server endpoint returned by DescribeCluster
+	host string
+	// role is assumed for token generation and DescribeCluster when the
+	// cluster lives in another account
+	role assumeRoleConfig
+}
+
+func (a *eksAuthenticator) restConfig(ctx context.Context) (*rest.Config, error) {
+	cfg, err := loadAWSConfig(ctx, a.region, a.role)
+	if err != nil {
+		return nil, err
+	}
+
+	// Forwarding the caller's session name would override the configured
+	// session name of an assumed role
+	gen, err := token.NewGenerator(a.role.RoleARN == "", false)
+	if err != nil {
+		return nil, fmt.Errorf("error creating token generator: %w", err)
+	}
+
+	stsClient := sts.NewFromConfig(cfg)
+	result, err := stsClient.GetCallerIdentity(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return nil, err
+	}
+	accountId := *result.Account
+	fmt.Print(accountId)
+
+	// Tokens expire after 15 minutes, so rather than baking one into the
+	// config we hand out a fresh one per request from a refreshing source
+	tokenSource := newEKSTokenSource(gen, &token.GetTokenOptions{
+		ClusterID:            a.clusterName,
+		Region:               a.region,
+		AssumeRoleARN:        a.role.RoleARN,
+		AssumeRoleExternalID: a.role.ExternalID,
+		SessionName:          a.role.SessionName,
+	})
+	if _, err := tokenSource.Token(); err != nil {
+		return nil, err
+	}
+
+	eksClient := eks.NewFromConfig(cfg)
+	out, err := eksClient.DescribeCluster(ctx, &eks.DescribeClusterInput{
+		Name: &a.clusterName,
+	})
+	if err != nil {
+		return nil, err
+	}
+	caBase64 := *out.Cluster.CertificateAuthority.Data
+	ca, err := base64.StdEncoding.DecodeString(caBase64)
+	if err != nil {
+		return nil, err
+	}
+
+	host := a.host
+	if host == "" && out.Cluster.Endpoint != nil {
+		host = *out.Cluster.Endpoint
+	}
+
+	return &rest.Config{
+		Host:          host,
+		WrapTransport: tokenSource.wrapTransport,
+		TLSClientConfig: rest.TLSClientConfig{
+			CAData: ca,
+		},
+	}, nil
+}
+
+// podIdentityAuthenticator is the EKS token flow using credentials vended by
+// the EKS Pod Identity agent, which both AWS SDKs pick up from the container
+// credentials environment variables.
+type podIdentityAuthenticator struct {
+	eks eksAuthenticator
+}
+
+func (a *podIdentityAuthenticator) restConfig(ctx context.Context) (*rest.Config, error) {
+	if os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI") == "" {
+		return nil, fmt.Errorf("AWS_CONTAINER_CREDENTIALS_FULL_URI not set - is the pod associated with an EKS Pod Identity?")
+	}
+	return a.eks.restConfig(ctx)
+}
+
+// inClusterAuthenticator uses the pod's service account.
+type inClusterAuthenticator struct{}
+
+func (a *inClusterAuthenticator) restConfig(ctx context.Context) (*rest.Config, error) {
+	config, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error loading in-cluster config: %w", err)
+	}
+	return config, nil
+}
+
+// kubeconfigAuthenticator loads a kubeconfig from a file or from an AWS
+// Secrets Manager secret.
+type kubeconfigAuthenticator struct {
+	path     string
+	secretID string
+	// context selects a kubeconfig context other than current-context
+	context string
+}
+
+func (a *kubeconfigAuthenticator) restConfig(ctx context.Context) (*rest.Config, error) {
+	var data []byte
+	if a.secretID != "" {
+		cfg, err := config.LoadDefaultConfig(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error creating AWS session: %w", err)
+		}
+		out, err := secretsmanager.NewFromConfig(cfg).GetSecretValue(ctx, &secretsmanager.GetSecretValueInput{
+			SecretId: &a.secretID,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error reading kubeconfig secret %s: %w", a.secretID, err)
+		}
+		if out.SecretString != nil {
+			data = []byte(*out.SecretString)
+		} else {
+			data = out.SecretBinary
+		}
+	} else {
+		var err error
+		data, err = os.ReadFile(a.path)
+		if err != nil {
+			return nil, fmt.Errorf("error reading kubeconfig %s: %w", a.path, err)
+		}
+	}
+
+	raw, err := clientcmd.Load(data)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing kubeconfig: %w", err)
+	}
+	config, err := clientcmd.NewDefaultClientConfig(*raw, &clientcmd.ConfigOverrides{
+		CurrentContext: a.context,
+	}).ClientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("error building config from kubeconfig: %w", err)
+	}
+	return config, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testKubeconfig = `apiVersion: v1
+kind: Config
+clusters:
+- name: laptop
+  cluster:
+    server: https://laptop.example.com
+- name: staging
+  cluster:
+    server: https://staging.example.com
+users:
+- name: me
+  user:
+    token: not-a-real-token
+contexts:
+- name: laptop
+  context:
+    cluster: laptop
+    user: me
+- name: staging
+  context:
+    cluster: staging
+    user: me
+current-context: laptop
+`
+
+func TestNewAuthenticatorModes(t *testing.T) {
+	tests := []struct {
+		mode     string
+		expected authenticator
+	}{
+		{"", &eksAuthenticator{}},
+		{authModeEKS, &eksAuthenticator{}},
+		{authModePodIdentity, &podIdentityAuthenticator{}},
+		{authModeInCluster, &inClusterAuthenticator{}},
+		{authModeKubeconfig, &kubeconfigAuthenticator{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.mode, func(t *testing.T) {
+			auth, err := newAuthenticator(ClusterConfig{
+				Name:       "test-cluster",
+				AuthMode:   tt.mode,
+				Kubeconfig: "/tmp/kubeconfig",
+			})
+			require.NoError(t, err)
+			assert.IsType(t, tt.expected, auth)
+		})
+	}
+}
+
+func TestNewAuthenticatorValidation(t *testing.T) {
+	_, err := newAuthenticator(ClusterConfig{AuthMode: authModeEKS})
+	assert.ErrorContains(t, err, "cluster name is required")
+
+	_, err = newAuthenticator(ClusterConfig{AuthMode: authModePodIdentity})
+	assert.ErrorContains(t, err, "cluster name is required")
+
+	_, err = newAuthenticator(ClusterConfig{Name: "test-cluster", AuthMode: authModeKubeconfig})
+	assert.ErrorContains(t, err, "a kubeconfig path or secret must be set")
+
+	_, err = newAuthenticator(ClusterConfig{Name: "test-cluster", AuthMode: "token"})
+	assert.ErrorContains(t, err, `unsupported auth mode "token"`)
+}
+
+func TestNewAuthenticatorRegion(t *testing.T) {
+	t.Setenv("AWS_REGION", "us-east-1")
+
+	auth, err := newAuthenticator(ClusterConfig{Name: "test-cluster", Region: "eu-west-1"})
+	require.NoError(t, err)
+	assert.Equal(t, "eu-west-1", auth.(*eksAuthenticator).region)
+
+	auth, err = newAuthenticator(ClusterConfig{Name: "test-cluster"})
+	require.NoError(t, err)
+	assert.Equal(t, "us-east-1", auth.(*eksAuthenticator).region)
+}
+
+func TestKubeconfigAuthenticatorFromFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	require.NoError(t, os.WriteFile(path, []byte(testKubeconfig), 0o600))
+
+	config, err := (&kubeconfigAuthenticator{path: path}).restConfig(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "https://laptop.example.com", config.Host)
+	assert.Equal(t, "not-a-real-token", config.BearerToken)
+
+	config, err = (&kubeconfigAuthenticator{path: path, context: "staging"}).restConfig(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "https://staging.example.com", config.Host)
+}
+
+func TestPodIdentityAuthenticatorRequiresAssociation(t *testing.T) {
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+
+	auth := &podIdentityAuthenticator{eks: eksAuthenticator{clusterName: "test-cluster"}}
+	_, err := auth.restConfig(context.Background())
+	assert.ErrorContains(t, err, "AWS_CONTAINER_CREDENTIALS_FULL_URI not set")
+}
+
+func TestInClusterAuthenticatorOutsideCluster(t *testing.T) {
+	t.Setenv("KUBERNETES_SERVICE_HOST", "")
+	t.Setenv("KUBERNETES_SERVICE_PORT", "")
+
+	_, err := (&inClusterAuthenticator{}).restConfig(context.Background())
+	assert.ErrorContains(t, err, "error loading in-cluster config")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// minReplicasAnnotation holds an HPA's spec.minReplicas from before shutdown
+	minReplicasAnnotation = "shutdown-schedule/min-replicas"
+	// pausedAnnotation marks ScaledObjects paused by shutdown, so those
+	// paused by someone else are left paused on startup
+	pausedAnnotation = "shutdown-schedule/paused"
+	// kedaPausedAnnotation pauses a KEDA ScaledObject
+	kedaPausedAnnotation = "autoscaling.keda.sh/paused"
+)
+
+var (
+	hpaGVR          = schema.GroupVersionResource{Group: "autoscaling", Version: "v2", Resource: "horizontalpodautoscalers"}
+	scaledObjectGVR = schema.GroupVersionResource{Group: "keda.sh", Version: "v1alpha1", Resource: "scaledobjects"}
+)
+
+// autoscalerStep keeps autoscalers from scaling workloads back up overnight:
+// on shutdown it pauses KEDA ScaledObjects and lowers the minReplicas of
+// HorizontalPodAutoscalers to 1, the lowest the API accepts, and on startup
+// it reverts exactly those changes.
+type autoscalerStep struct {
+	scope WorkloadConfig
+}
+
+func (s autoscalerStep) shutdown(ctx context.Context, dynamicClient dynamic.Interface) ([]WorkloadResult, error) {
+	results, err := applyToWorkloads(ctx, dynamicClient, s.scope, pauseScaledObject, scaledObjectGVR)
+	hpaResults, hpaErr := applyToWorkloads(ctx, dynamicClient, s.scope, lowerMinReplicas, hpaGVR)
+	return append(results, hpaResults...), errors.Join(err, hpaErr)
+}
+
+func (s autoscalerStep) startup(ctx context.Context, dynamicClient dynamic.Interface) ([]WorkloadResult, error) {
+	results, err := applyToWorkloads(ctx, dynamicClient, s.scope, restoreMinReplicas, hpaGVR)
+	scaledObjectResults, scaledObjectErr := applyToWorkloads(ctx, dynamicClient, s.scope, resumeScaledObject, scaledObjectGVR)
+	return append(results, scaledObjectResults...), errors.Join(err, scaledObjectErr)
+}
+
+func pauseScaledObject(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error) {
+	annotations := item.GetAnnotations()
+	if _, paused := annotations[kedaPausedAnnotation]; paused {
+		return nodePoolStatusSkipped, nil
+	}
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[kedaPausedAnnotation] = "true"
+	annotations[pausedAnnotation] = "true"
+	item.SetAnnotations(annotations)
+	if _, err := resource.Update(ctx, &item, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update: %v", err)
+	}
+	fmt.Printf("Paused ScaledObject %s/%s\n", item.GetNamespace(), item.GetName())
+	return nodePoolStatusUpdated, nil
+}
+
+func resumeScaledObject(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error) {
+	annotations := item.GetAnnotations()
+	if _, recorded := annotations[pausedAnnotation]; !recorded {
+		return nodePoolStatusSkipped, nil
+	}
+	delete(annotations, kedaPausedAnnotation)
+	delete(annotations, pausedAnnotation)
+	item.SetAnnotations(annotations)
+	if _, err := resource.Update(ctx, &item, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update: %v", err)
+	}
+	fmt.Printf("Resumed ScaledObject %s/%s\n", item.GetNamespace(), item.GetName())
+	return nodePoolStatusUpdated, nil
+}
+
+// lowerMinReplicas records the HPA's minReplicas and lowers it to 1. HPAs
+// created by KEDA are left to their ScaledObject.
+func lowerMinReplicas(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error) {
+	if item.GetLabels()["app.kubernetes.io/managed-by"] == "keda-operator" {
+		return nodePoolStatusSkipped, nil
+	}
+	minReplicas, found, err := unstructured.NestedInt64(item.Object, "spec", "minReplicas")
+	if err != nil {
+		return "", fmt.Errorf("failed to read minReplicas: %v", err)
+	}
+	if !found || minReplicas <= 1 {
+		return nodePoolStatusSkipped, nil
+	}
+
+	annotations := item.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	if _, recorded := annotations[minReplicasAnnotation]; !recorded {
+		annotations[minReplicasAnnotation] = strconv.FormatInt(minReplicas, 10)
+		item.SetAnnotations(annotations)
+	}
+	if err := unstructured.SetNestedField(item.Object, int64(1), "spec", "minReplicas"); err != nil {
+		return "", fmt.Errorf("failed to set minReplicas: %v", err)
+	}
+	if _, err := resource.Update(ctx, &item, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update: %v", err)
+	}
+	fmt.Printf("Lowered minReplicas of HorizontalPodAutoscaler %s/%s from %d to 1\n", item.GetNamespace(), item.GetName(), minReplicas)
+	return nodePoolStatusUpdated, nil
+}
+
+func restoreMinReplicas(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error) {
+	annotations := item.GetAnnotations()
+	value, recorded := annotations[minReplicasAnnotation]
+	if !recorded {
+		return nodePoolStatusSkipped, nil
+	}
+	minReplicas, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || minReplicas < 1 {
+		return "", fmt.Errorf("invalid %s annotation %q", minReplicasAnnotation, value)
+	}
+
+	if err := unstructured.SetNestedField(item.Object, minReplicas, "spec", "minReplicas"); err != nil {
+		return "", fmt.Errorf("failed to set minReplicas: %v", err)
+	}
+	delete(annotations, minReplicasAnnotation)
+	item.SetAnnotations(annotations)
+	if _, err := resource.Update(ctx, &item, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update: %v", err)
+	}
+	fmt.Printf("Restored minReplicas of HorizontalPodAutoscaler %s/%s to %d\n", item.GetNamespace(), item.GetName(), minReplicas)
+	return nodePoolStatusUpdated, nil
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestHPA(namespace, name string, minReplicas int64, labels map[string]string) *unstructured.Unstructured {
+	hpa := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "autoscaling/v2",
+			"kind":       "HorizontalPodAutoscaler",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"minReplicas": minReplicas,
+				"maxReplicas": int64(10),
+			},
+		},
+	}
+	hpa.SetLabels(labels)
+	return hpa
+}
+
+func newTestScaledObject(namespace, name string, annotations map[string]string) *unstructured.Unstructured {
+	scaledObject := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "keda.sh/v1alpha1",
+			"kind":       "ScaledObject",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+		},
+	}
+	scaledObject.SetAnnotations(annotations)
+	return scaledObject
+}
+
+func TestAutoscalerStep(t *testing.T) {
+	client := newFakeClient(
+		newTestHPA("preview", "web", 3, nil),
+		newTestHPA("preview", "single", 1, nil),
+		newTestHPA("preview", "keda-hpa-worker", 2, map[string]string{"app.kubernetes.io/managed-by": "keda-operator"}),
+		newTestScaledObject("preview", "worker", nil),
+		newTestScaledObject("preview", "paused", map[string]string{kedaPausedAnnotation: "true"}),
+	)
+	step := autoscalerStep{scope: WorkloadConfig{Namespaces: []string{"preview"}}}
+
+	minReplicas := func(name string) int64 {
+		value, _, err := unstructured.NestedInt64(getWorkload(t, client, hpaGVR, "preview", name).Object, "spec", "minReplicas")
+		require.NoError(t, err)
+		return value
+	}
+
+	results, err := step.shutdown(context.Background(), client)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []WorkloadResult{
+		{Kind: "ScaledObject", Namespace: "preview", Name: "worker", Status: nodePoolStatusUpdated},
+		{Kind: "ScaledObject", Namespace: "preview", Name: "paused", Status: nodePoolStatusSkipped},
+		{Kind: "HorizontalPodAutoscaler", Namespace: "preview", Name: "web", Status: nodePoolStatusUpdated},
+		{Kind: "HorizontalPodAutoscaler", Namespace: "preview", Name: "single", Status: nodePoolStatusSkipped},
+		{Kind: "HorizontalPodAutoscaler", Namespace: "preview", Name: "keda-hpa-worker", Status: nodePoolStatusSkipped},
+	}, results)
+	assert.Equal(t, int64(1), minReplicas("web"))
+	assert.Equal(t, int64(2), minReplicas("keda-hpa-worker"))
+	assert.Equal(t, "true", getWorkload(t, client, scaledObjectGVR, "preview", "worker").GetAnnotations()[kedaPausedAnnotation])
+
+	// A second shutdown keeps the recorded minReplicas
+	_, err = step.shutdown(context.Background(), client)
+	require.NoError(t, err)
+
+	_, err = step.startup(context.Background(), client)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), minReplicas("web"))
+	assert.Empty(t, getWorkload(t, client, hpaGVR, "preview", "web").GetAnnotations())
+	assert.Empty(t, getWorkload(t, client, scaledObjectGVR, "preview", "worker").GetAnnotations())
+	assert.Equal(t, map[string]string{kedaPausedAnnotation: "true"}, getWorkload(t, client, scaledObjectGVR, "preview", "paused").GetAnnotations())
+}
+
+func TestAutoscalerStepWithoutKEDA(t *testing.T) {
+	client := newFakeClient(newTestHPA("preview", "web", 3, nil))
+	client.PrependReactor("list", "scaledobjects", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewNotFound(scaledObjectGVR.GroupResource(), "")
+	})
+	step := autoscalerStep{scope: WorkloadConfig{Namespaces: []string{"preview"}}}
+
+	results, err := step.shutdown(context.Background(), client)
+	require.NoError(t, err)
+	assert.Equal(t, []WorkloadResult{{Kind: "HorizontalPodAutoscaler", Namespace: "preview", Name: "web", Status: nodePoolStatusUpdated}}, results)
+}
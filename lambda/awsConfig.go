@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/aws/aws-sdk-go-v2/service/sts"
+)
+
+const defaultRoleSessionName = "karpenter-aws-shutdown-schedule"
+
+// assumeRoleConfig is an optional IAM role to assume before calling AWS APIs
+// for a cluster that lives in another account.
+type assumeRoleConfig struct {
+	RoleARN     string
+	ExternalID  string
+	SessionName string
+}
+
+// loadAWSConfig loads the default AWS configuration for the region, with
+// credentials for the assumed role when one is configured.
+func loadAWSConfig(ctx context.Context, region string, role assumeRoleConfig) (aws.Config, error) {
+	var opts []func(*config.LoadOptions) error
+	if region != "" {
+		opts = append(opts, config.WithRegion(region))
+	}
+
+	cfg, err := config.LoadDefaultConfig(ctx, opts...)
+	if err != nil {
+		return aws.Config{}, fmt.Errorf("failed to load AWS configuration: %w", err)
+	}
+
+	if role.RoleARN == "" {
+		return cfg, nil
+	}
+
+	fmt.Printf("Assuming role %s (session %s)\n", role.RoleARN, role.SessionName)
+	provider := stscreds.NewAssumeRoleProvider(sts.NewFromConfig(cfg), role.RoleARN, func(o *stscreds.AssumeRoleOptions) {
+		o.RoleSessionName = role.SessionName
+		if role.ExternalID != "" {
+			o.ExternalID = aws.String(role.ExternalID)
+		}
+	})
+	cfg.Credentials = aws.NewCredentialsCache(provider)
+
+	return cfg, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/credentials/stscreds"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadAWSConfigWithoutRole(t *testing.T) {
+	cfg, err := loadAWSConfig(context.Background(), "eu-west-1", assumeRoleConfig{})
+
+	require.NoError(t, err)
+	assert.Equal(t, "eu-west-1", cfg.Region)
+	assert.False(t, aws.IsCredentialsProvider(cfg.Credentials, &stscreds.AssumeRoleProvider{}))
+}
+
+func TestLoadAWSConfigWithRole(t *testing.T) {
+	cfg, err := loadAWSConfig(context.Background(), "eu-west-1", assumeRoleConfig{
+		RoleARN:     "arn:aws:iam::111111111111:role/shutdown-schedule",
+		ExternalID:  "tooling",
+		SessionName: "test",
+	})
+
+	require.NoError(t, err)
+	assert.Equal(t, "eu-west-1", cfg.Region)
+	assert.True(t, aws.IsCredentialsProvider(cfg.Credentials, &stscreds.AssumeRoleProvider{}))
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+)
+
+var jobGVR = schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "jobs"}
+
+// defaultBlockCutOff bounds the retries of a blocked shutdown that sets no
+// cut-off.
+const defaultBlockCutOff = 30 * time.Minute
+
+// blockPollInterval is how often a blocked shutdown checks its workloads.
+var blockPollInterval = 30 * time.Second
+
+// blockedError holds back the shutdown of a nodepool while blocking
+// workloads run. Until the cut-off it is retried by a continuation.
+type blockedError struct {
+	reason string
+	retry  bool
+}
+
+func (e *blockedError) Error() string {
+	return e.reason
+}
+
+// blockingWorkloads lists the running pods selected by the scope on the
+// nodepool's nodes, and the active Jobs selected by the scope with a pod
+// running there, as "Kind namespace/name".
+func blockingWorkloads(ctx context.Context, dynamicClient dynamic.Interface, nodePoolName string, scope WorkloadConfig) ([]string, error) {
+	labelSelector := fmt.Sprintf("karpenter.sh/nodepool=%s", nodePoolName)
+	nodeList, err := dynamicClient.Resource(nodeGVR).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes with label selector %s: %v", labelSelector, err)
+	}
+	nodeNames := map[string]bool{}
+	for _, node := range nodeList.Items {
+		nodeNames[node.GetName()] = true
+	}
+	if len(nodeNames) == 0 {
+		return nil, nil
+	}
+	running := func(pod unstructured.Unstructured) bool {
+		nodeName, _, _ := unstructured.NestedString(pod.Object, "spec", "nodeName")
+		phase, _, _ := unstructured.NestedString(pod.Object, "status", "phase")
+		return nodeNames[nodeName] && phase != "Succeeded" && phase != "Failed"
+	}
+
+	var blocking []string
+	pods, err := listWorkloads(ctx, dynamicClient, podGVR, scope)
+	if err != nil {
+		return nil, err
+	}
+	for _, pod := range pods {
+		if running(pod) {
+			blocking = append(blocking, fmt.Sprintf("Pod %s/%s", pod.GetNamespace(), pod.GetName()))
+		}
+	}
+
+	jobs, err := listWorkloads(ctx, dynamicClient, jobGVR, scope)
+	if err != nil {
+		return nil, err
+	}
+	activeJobs := map[string]bool{}
+	for _, job := range jobs {
+		if !jobFinished(job) {
+			activeJobs[job.GetNamespace()+"/"+job.GetName()] = true
+		}
+	}
+	if len(activeJobs) == 0 {
+		return blocking, nil
+	}
+	nodePods, err := podsOnNodes(ctx, dynamicClient, nodeNames)
+	if err != nil {
+		return nil, err
+	}
+	seen := map[string]bool{}
+	for _, pod := range nodePods {
+		if !running(pod) {
+			continue
+		}
+		for _, owner := range pod.GetOwnerReferences() {
+			job := pod.GetNamespace() + "/" + owner.Name
+			if owner.Kind == "Job" && activeJobs[job] && !seen[job] {
+				seen[job] = true
+				blocking = append(blocking, "Job "+job)
+			}
+		}
+	}
+	return blocking, nil
+}
+
+func jobFinished(job unstructured.Unstructured) bool {
+	conditions, _, _ := unstructured.NestedSlice(job.Object, "status", "conditions")
+	for _, c := range conditions {
+		condition, ok := c.(map[string]interface{})
+		if ok && (condition["type"] == "Complete" || condition["type"] == "Failed") && condition["status"] == "True" {
+			return true
+		}
+	}
+	return false
+}
+
+// waitForBlockingWorkloads holds the shutdown of the nodepool until its
+// blocking workloads are gone. It returns a retryable blockedError when the
+// invocation runs out of time first, and a final one once the cut-off,
+// counted from the start of the run, has passed.
+func waitForBlockingWorkloads(ctx context.Context, dynamicClient dynamic.Interface, np managedNodePool, progress *clusterProgress) error {
+	if np.Block == nil {
+		return nil
+	}
+
+	blocking, err := blockingWorkloads(ctx, dynamicClient, np.Name, np.Block.WorkloadConfig)
+	if err != nil || len(blocking) == 0 {
+		return err
+	}
+
+	cutOff := progress.startedAt().Add(np.Block.cutOff())
+	fmt.Printf("Postponing shutdown of nodepool %s until %s at the latest, blocked by %s\n", np.Name, cutOff.Format(time.RFC3339), strings.Join(blocking, ", "))
+	waitCtx, cancel := progress.withStopBy(ctx)
+	defer cancel()
+	waitCtx, cancelCutOff := context.WithDeadline(waitCtx, cutOff)
+	defer cancelCutOff()
+
+	err = wait.PollUntilContextCancel(waitCtx, blockPollInterval, true, func(ctx context.Context) (bool, error) {
+		blocking, err = blockingWorkloads(ctx, dynamicClient, np.Name, np.Block.WorkloadConfig)
+		return len(blocking) == 0, err
+	})
+	switch {
+	case err == nil:
+		fmt.Printf("Blocking workloads of nodepool %s finished\n", np.Name)
+		return nil
+	case !wait.Interrupted(err):
+		return err
+	case !time.Now().Before(cutOff):
+		fmt.Printf("Cut-off passed - skipping shutdown of nodepool %s\n", np.Name)
+		return &blockedError{reason: "blocked by " + strings.Join(blocking, ", ")}
+	case progress.outOfTime():
+		return &blockedError{reason: "waiting for " + strings.Join(blocking, ", "), retry: true}
+	}
+	return ctx.Err()
+}
+
+func (c BlockConfig) cutOff() time.Duration {
+	if d, err := time.ParseDuration(c.CutOff); err == nil && c.CutOff != "" {
+		return d
+	}
+	return defaultBlockCutOff
+}
+
+// validateBlock checks a blocking workload selection.
+func validateBlock(config *BlockConfig) error {
+	if config == nil {
+		return nil
+	}
+	if err := validateWorkloads("block", &config.WorkloadConfig); err != nil {
+		return err
+	}
+	if config.CutOff != "" {
+		if d, err := time.ParseDuration(config.CutOff); err != nil || d <= 0 {
+			return fmt.Errorf("block: invalid cutOff %q", config.CutOff)
+		}
+	}
+	return nil
+}
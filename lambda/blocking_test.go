@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+var testBlock = &BlockConfig{WorkloadConfig: WorkloadConfig{Selector: "shutdown-schedule/block=true"}}
+
+func newTestJob(namespace, name string, complete bool) *unstructured.Unstructured {
+	job := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "batch/v1",
+			"kind":       "Job",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+				"labels":    map[string]interface{}{"shutdown-schedule/block": "true"},
+			},
+		},
+	}
+	if complete {
+		job.Object["status"] = map[string]interface{}{
+			"conditions": []interface{}{map[string]interface{}{"type": "Complete", "status": "True"}},
+		}
+	}
+	return job
+}
+
+func newTestBlockingPod(namespace, name, nodeName, phase string) *unstructured.Unstructured {
+	pod := newTestPod(namespace, name, nodeName)
+	pod.SetLabels(map[string]string{"shutdown-schedule/block": "true"})
+	pod.Object["status"] = map[string]interface{}{"phase": phase}
+	return pod
+}
+
+func newTestJobPod(namespace, name, nodeName, jobName string) *unstructured.Unstructured {
+	pod := newTestPod(namespace, name, nodeName)
+	pod.SetOwnerReferences([]metav1.OwnerReference{{Kind: "Job", Name: jobName}})
+	return pod
+}
+
+func TestBlockingWorkloads(t *testing.T) {
+	client := newFakeClient(
+		newTestNode("node-1", "default"),
+		newTestNode("node-2", "other"),
+		newTestBlockingPod("data", "migrate-abc", "node-1", "Running"),
+		newTestBlockingPod("data", "migrate-old", "node-1", "Succeeded"),
+		newTestBlockingPod("data", "migrate-other", "node-2", "Running"),
+		newTestPod("data", "web-1", "node-1"),
+		newTestJob("data", "migrate", false),
+		newTestJobPod("data", "migrate-xyz", "node-1", "migrate"),
+		newTestJob("data", "backfill", true),
+		newTestJobPod("data", "backfill-xyz", "node-1", "backfill"),
+		newTestJob("data", "elsewhere", false),
+		newTestJobPod("data", "elsewhere-xyz", "node-2", "elsewhere"),
+	)
+
+	blocking, err := blockingWorkloads(context.Background(), client, "default", testBlock.WorkloadConfig)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Pod data/migrate-abc", "Job data/migrate"}, blocking)
+
+	// A nodepool without nodes has nothing to block it
+	blocking, err = blockingWorkloads(context.Background(), client, "empty", testBlock.WorkloadConfig)
+	require.NoError(t, err)
+	assert.Empty(t, blocking)
+}
+
+// newBlockedTestCluster returns a cluster whose "default" nodepool runs the
+// active Job data/migrate, next to the "other" nodepool and a Deployment
+// scaled down on shutdown.
+func newBlockedTestCluster(t *testing.T, block *BlockConfig) (*fake.FakeDynamicClient, ClusterConfig) {
+	client := newFakeClient(
+		newTestNodePool("default", map[string]interface{}{"cpu": "100"}),
+		newTestNodePool("other", map[string]interface{}{"cpu": "100"}),
+		newTestNode("node-1", "default"),
+		newTestJob("data", "migrate", false),
+		newTestJobPod("data", "migrate-xyz", "node-1", "migrate"),
+		newTestWorkload("Deployment", "preview", "web", 3, nil),
+	)
+	originalFactory := newClusterClient
+	newClusterClient = func(ctx context.Context, cluster ClusterConfig) (dynamic.Interface, error) {
+		return client, nil
+	}
+	t.Cleanup(func() { newClusterClient = originalFactory })
+
+	keep := false
+	return client, ClusterConfig{
+		Name: "test-cluster",
+		NodePools: []NodePoolConfig{
+			{Name: "default", NodePoolProfile: NodePoolProfile{TerminateInstances: &keep, Block: block}},
+			{Name: "other", NodePoolProfile: NodePoolProfile{TerminateInstances: &keep}},
+		},
+		Workloads: &WorkloadConfig{Namespaces: []string{"preview"}},
+	}
+}
+
+func TestShutdownWaitsForBlockingWorkloads(t *testing.T) {
+	originalInterval := blockPollInterval
+	blockPollInterval = time.Millisecond
+	defer func() { blockPollInterval = originalInterval }()
+
+	client, cluster := newBlockedTestCluster(t, testBlock)
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		_ = client.Resource(jobGVR).Namespace("data").Delete(context.Background(), "migrate", metav1.DeleteOptions{})
+	}()
+
+	result, err := processCluster(context.Background(), "shutdown", cluster, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{
+		{Name: "default", Status: nodePoolStatusUpdated},
+		{Name: "other", Status: nodePoolStatusUpdated},
+	}, result.NodePools)
+	assert.Equal(t, "0", getNodePoolLimits(t, client, "default")["cpu"])
+	assert.Equal(t, int64(0), getReplicas(t, client, deploymentGVR, "preview", "web"))
+}
+
+func TestShutdownBlockedPastCutOff(t *testing.T) {
+	originalInterval := blockPollInterval
+	blockPollInterval = time.Millisecond
+	defer func() { blockPollInterval = originalInterval }()
+
+	client, cluster := newBlockedTestCluster(t, &BlockConfig{WorkloadConfig: testBlock.WorkloadConfig, CutOff: "10ms"})
+
+	result, err := processCluster(context.Background(), "shutdown", cluster, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{
+		{Name: "default", Status: nodePoolStatusBlocked, Reason: "blocked by Job data/migrate"},
+		{Name: "other", Status: nodePoolStatusUpdated},
+	}, result.NodePools)
+	assert.Equal(t, "100", getNodePoolLimits(t, client, "default")["cpu"])
+	assert.Equal(t, "0", getNodePoolLimits(t, client, "other")["cpu"])
+
+	// The blocked nodepool's workloads keep running
+	assert.Empty(t, result.Workloads)
+	assert.Equal(t, int64(3), getReplicas(t, client, deploymentGVR, "preview", "web"))
+
+	nodePools := []managedNodePool{{Name: "default"}, {Name: "other"}}
+	assert.Equal(t, []managedNodePool{{Name: "other"}}, withoutKeptRunning(nodePools, result.NodePools, nil))
+}
+
+func TestDefaultBlockCutOffFitsRun(t *testing.T) {
+	cfg := &Config{Clusters: []ClusterConfig{{Name: "dev", Block: testBlock}}}
+
+	// The stack's five minute timeout with the default threshold
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	progress, err := newRunProgress(ctx, nil)
+	require.NoError(t, err)
+	assert.NoError(t, progress.checkWaits(cfg))
+}
+
+func TestShutdownBlockedDeferredToContinuation(t *testing.T) {
+	client, cluster := newBlockedTestCluster(t, testBlock)
+	progress, err := newRunProgress(context.Background(), nil)
+	require.NoError(t, err)
+	progress.stopBy = time.Now()
+	clusterProgress := progress.cluster("ap-southeast-2/test-cluster")
+
+	result, err := processCluster(context.Background(), "shutdown", cluster, clusterProgress)
+	assert.ErrorIs(t, err, errDeadline)
+	assert.Equal(t, []NodePoolResult{
+		{Name: "default", Status: nodePoolStatusDeferred, Reason: "waiting for Job data/migrate"},
+	}, result.NodePools)
+	assert.False(t, clusterProgress.done("default"))
+	assert.Equal(t, "100", getNodePoolLimits(t, client, "default")["cpu"])
+	assert.Equal(t, "100", getNodePoolLimits(t, client, "other")["cpu"])
+	assert.Equal(t, int64(3), getReplicas(t, client, deploymentGVR, "preview", "web"))
+}
@@ -7,8 +7,19 @@ import (
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/dynamic"
 )
 
+// newDynamicClientFromEnv builds a client from the single-cluster
+// environment variables, as the handler does without KARPENTER_CLUSTERS.
+func newDynamicClientFromEnv(ctx context.Context) (dynamic.Interface, error) {
+	cluster, err := clusterConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return newDynamicClient(ctx, cluster)
+}
+
 func TestNewDynamicClientMissingClusterName(t *testing.T) {
 	ctx := context.Background()
 
@@ -21,7 +32,7 @@ func TestNewDynamicClientMissingClusterName(t *testing.T) {
 		}
 	}()
 
-	client, err := newDynamicClient(ctx)
+	client, err := newDynamicClientFromEnv(ctx)
 
 	assert.Nil(t, client)
 	assert.Error(t, err)
@@ -41,7 +52,7 @@ func TestNewDynamicClientWithEnvironment(t *testing.T) {
 		os.Unsetenv("AWS_REGION")
 	}()
 
-	client, err := newDynamicClient(ctx)
+	client, err := newDynamicClientFromEnv(ctx)
 
 	// In a test environment without proper AWS credentials, this should fail
 	// but not due to missing environment variables
@@ -63,7 +74,7 @@ func TestNewDynamicClientWithDefaultRegion(t *testing.T) {
 		os.Unsetenv("KUBERNETES_SERVICE_HOST")
 	}()
 
-	client, err := newDynamicClient(ctx)
+	client, err := newDynamicClientFromEnv(ctx)
 
 	// Should attempt to use default region (ap-southeast-2)
 	assert.Nil(t, client)
@@ -87,7 +98,7 @@ func TestNewDynamicClientWithCustomRegion(t *testing.T) {
 		os.Unsetenv("AWS_REGION")
 	}()
 
-	client, err := newDynamicClient(ctx)
+	client, err := newDynamicClientFromEnv(ctx)
 
 	// Should attempt to use custom region
 	assert.Nil(t, client)
@@ -153,7 +164,7 @@ func TestNewDynamicClientEnvironmentValidation(t *testing.T) {
 				os.Unsetenv("AWS_REGION")
 			}()
 
-			client, err := newDynamicClient(ctx)
+			client, err := newDynamicClientFromEnv(ctx)
 
 			// Should fail due to AWS/EKS issues, not environment validation
 			assert.Nil(t, client)
@@ -203,7 +214,7 @@ func TestNewDynamicClientClusterNameValidation(t *testing.T) {
 				os.Unsetenv("AWS_REGION")
 			}()
 
-			client, err := newDynamicClient(ctx)
+			client, err := newDynamicClientFromEnv(ctx)
 
 			assert.Nil(t, client) // Always nil in test environment
 			require.Error(t, err) // Always error in test environment
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+)
+
+// newClusterClient is swapped out in tests to avoid talking to AWS.
+var newClusterClient = newDynamicClient
+
+// processCluster runs the action against every configured nodepool of one
+// cluster, with the workload steps before the night actions and after
+// startup. It returns errDeadline when work was deferred to a continuation.
+func processCluster(ctx context.Context, action string, cluster ClusterConfig, progress *clusterProgress) (ClusterResult, error) {
+	result := ClusterResult{Name: cluster.Name, Region: cluster.region()}
+
+	dynamicClient, err := newClusterClient(ctx, cluster)
+	if err != nil {
+		return result, fmt.Errorf("failed to create dynamic client: %v", err)
+	}
+
+	overrides, err := loadOverrides(ctx, dynamicClient, cluster.overridesRef())
+	if err != nil {
+		return result, err
+	}
+
+	nodePools, err := resolveClusterNodePools(ctx, dynamicClient, cluster)
+	if err != nil {
+		return result, err
+	}
+	for _, np := range nodePools {
+		result.ResolvedNodePools = append(result.ResolvedNodePools, np.Name)
+	}
+	fmt.Printf("Processing %d nodepool(s) in %s: %s\n", len(nodePools), result.Region, strings.Join(result.ResolvedNodePools, ", "))
+
+	held, err := holdBackNodePools(ctx, dynamicClient, action, nodePools, overrides, progress)
+	if err != nil {
+		for _, np := range nodePools {
+			if r, ok := held[np.Name]; ok {
+				result.NodePools = append(result.NodePools, r)
+			}
+		}
+		return result, err
+	}
+
+	// The workload steps act on the whole cluster, so a nodepool held back
+	// keeps its workloads running, and overrides for the whole cluster hold
+	// them back even when it has no nodepools
+	steps := cluster.workloadSteps()
+	if len(held) > 0 {
+		fmt.Printf("Leaving the workloads of cluster %s alone while %d nodepool(s) are held back\n", cluster.Name, len(held))
+		steps = nil
+	} else if reason := overrides.match(action, "", progress.startedAt()); reason != "" {
+		fmt.Printf("Leaving the workloads of cluster %s alone, %s\n", cluster.Name, reason)
+		steps = nil
+	}
+
+	// Workload failures are reported but do not keep the nodepools running
+	var workloadErr error
+	if isNightAction(action) {
+		result.Workloads, workloadErr = runWorkloadSteps(ctx, dynamicClient, action, steps)
+	}
+
+	err = processClusterNodePools(ctx, dynamicClient, action, cluster, nodePools, held, progress, &result)
+
+	// A nodepool that failed to start must not keep the workloads scaled
+	// down, but a deferred run restores them in its continuation
+	if action == "startup" && !errors.Is(err, errDeadline) {
+		result.Workloads, workloadErr = runWorkloadSteps(ctx, dynamicClient, action, steps)
+	}
+	return result, errors.Join(workloadErr, err)
+}
+
+// processClusterNodePools runs the action against the cluster's nodepools
+// stage by stage, reporting those held back, then terminates the remaining
+// EC2 instances on shutdown.
+func processClusterNodePools(ctx context.Context, dynamicClient dynamic.Interface, action string, cluster ClusterConfig, nodePools []managedNodePool, held map[string]NodePoolResult, progress *clusterProgress, result *ClusterResult) error {
+	stages, err := cluster.stages(action, nodePools)
+	if err != nil {
+		return err
+	}
+	for _, stage := range stages {
+		if len(stages) > 1 {
+			fmt.Printf("\n=== Stage %s ===\n", stage.Name)
+		}
+		processed, heldResults := splitHeld(stage.NodePools, held)
+		results, err := processNodePools(ctx, dynamicClient, action, processed, cluster.Parallelism, progress)
+		results = append(heldResults, results...)
+		result.NodePools = append(result.NodePools, results...)
+		if err != nil {
+			return err
+		}
+		if stage.Wait {
+			stage.NodePools = withoutKeptRunning(stage.NodePools, results, progress)
+			waitCtx, cancel := progress.withStopBy(ctx)
+			err := waitForStage(waitCtx, dynamicClient, action, stage)
+			cancel()
+			if err != nil && progress.outOfTime() {
+				return errDeadline
+			}
+			if err != nil {
+				return fmt.Errorf("stage %s: %v", stage.Name, err)
+			}
+		}
+	}
+
+	if action != "shutdown" {
+		return nil
+	}
+
+	// EC2 interaction - pass the names of all nodepools whose instances are terminated
+	var nodePoolNames, keep []string
+	for _, np := range withoutKeptRunning(nodePools, result.NodePools, progress) {
+		if !np.TerminateInstances {
+			continue
+		}
+		nodePoolNames = append(nodePoolNames, np.Name)
+		if np.DoNotDisrupt.Policy != doNotDisruptSkip {
+			continue
+		}
+		protected, err := protectedNodes(ctx, dynamicClient, np.Name)
+		if err != nil {
+			return err
+		}
+		for _, instanceID := range protected {
+			if instanceID != "" {
+				keep = append(keep, instanceID)
+			}
+		}
+	}
+	if len(nodePoolNames) == 0 {
+		fmt.Printf("No nodepools configured to terminate EC2 instances\n")
+		return nil
+	}
+	if progress.outOfTime() {
+		return errDeadline
+	}
+
+	cfg, err := loadAWSConfig(ctx, cluster.region(), cluster.role())
+	if err != nil {
+		return err
+	}
+	if err := ShutdownEC2Instances(ctx, cfg, cluster.Name, nodePoolNames, keep); err != nil {
+		return err
+	}
+
+	return nil
+}
+
+// withoutKeptRunning drops the nodepools the action left alone, for their
+// blocking workloads, a keep-awake annotation or the overrides, including
+// those an earlier invocation of the run kept awake.
+func withoutKeptRunning(nodePools []managedNodePool, results []NodePoolResult, progress *clusterProgress) []managedNodePool {
+	running := map[string]bool{}
+	for _, result := range results {
+		switch result.Status {
+		case nodePoolStatusBlocked, nodePoolStatusKeptAwake, nodePoolStatusOverridden:
+			running[result.Name] = true
+		}
+	}
+
+	var kept []managedNodePool
+	for _, np := range nodePools {
+		if !running[np.Name] && !progress.keptAwake(np.Name) {
+			kept = append(kept, np)
+		}
+	}
+	return kept
+}
+
+// holdBackNodePools decides, before anything in the cluster changes, which
+// nodepools the action leaves alone: those the overrides hold back, for the
+// night actions those a keep-awake annotation keeps running, now or in an
+// earlier invocation of the run, and on shutdown those whose blocking
+// workloads still run at the cut-off. It returns their results by name, and
+// errDeadline with the waiting nodepool deferred while blocking workloads
+// are still waited for.
+func holdBackNodePools(ctx context.Context, dynamicClient dynamic.Interface, action string, nodePools []managedNodePool, overrides *scheduleOverrides, progress *clusterProgress) (map[string]NodePoolResult, error) {
+	held := map[string]NodePoolResult{}
+	for _, np := range nodePools {
+		if progress.keptAwake(np.Name) {
+			held[np.Name] = NodePoolResult{Name: np.Name, Status: nodePoolStatusKeptAwake}
+			continue
+		}
+		if progress.done(np.Name) {
+			continue
+		}
+		if reason := overrides.match(action, np.Name, progress.startedAt()); reason != "" {
+			fmt.Printf("Leaving nodepool %s alone, %s\n", np.Name, reason)
+			held[np.Name] = NodePoolResult{Name: np.Name, Status: nodePoolStatusOverridden, Reason: reason}
+			continue
+		}
+		if !isNightAction(action) {
+			continue
+		}
+
+		nodePool, err := dynamicClient.Resource(nodePoolGVR).Get(ctx, np.Name, metav1.GetOptions{})
+		if err != nil && !apierrors.IsNotFound(err) {
+			return held, fmt.Errorf("failed to get nodepool %s: %v", np.Name, err)
+		}
+		if err == nil {
+			awake, err := keepAwake(ctx, dynamicClient, nodePool)
+			if err != nil {
+				return held, err
+			}
+			if awake {
+				progress.keepAwake(np.Name)
+				held[np.Name] = NodePoolResult{Name: np.Name, Status: nodePoolStatusKeptAwake}
+				continue
+			}
+		}
+
+		if action != "shutdown" {
+			continue
+		}
+		err = waitForBlockingWorkloads(ctx, dynamicClient, np, progress)
+		var blocked *blockedError
+		switch {
+		case errors.As(err, &blocked) && blocked.retry:
+			held[np.Name] = NodePoolResult{Name: np.Name, Status: nodePoolStatusDeferred, Reason: blocked.reason}
+			return held, errDeadline
+		case errors.As(err, &blocked):
+			held[np.Name] = NodePoolResult{Name: np.Name, Status: nodePoolStatusBlocked, Reason: blocked.reason}
+		case err != nil:
+			return held, fmt.Errorf("failed to check blocking workloads of nodepool %s: %v", np.Name, err)
+		}
+	}
+	return held, nil
+}
+
+// splitHeld separates the nodepools held back, returning their results, from
+// those the action processes.
+func splitHeld(nodePools []managedNodePool, held map[string]NodePoolResult) ([]managedNodePool, []NodePoolResult) {
+	var processed []managedNodePool
+	var results []NodePoolResult
+	for _, np := range nodePools {
+		if result, ok := held[np.Name]; ok {
+			results = append(results, result)
+			continue
+		}
+		processed = append(processed, np)
+	}
+	return processed, results
+}
@@ -0,0 +1,676 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lendi-au/karpenter-aws-shutdown-schedule/pkg/utils"
+	"sigs.k8s.io/yaml"
+)
+
+// configVersion is the schema version of the configuration document
+// understood by this build.
+const configVersion = 1
+
+// Config lists the clusters managed by a single deployment.
+type Config struct {
+	// Version of the document schema, defaults to configVersion
+	Version  int             `json:"version,omitempty"`
+	Clusters []ClusterConfig `json:"clusters"`
+}
+
+// ClusterConfig describes one cluster, how to reach it and which nodepools to manage.
+type ClusterConfig struct {
+	Name   string `json:"name"`
+	Region string `json:"region,omitempty"`
+	// Host overrides the API server endpoint
+	Host string `json:"host,omitempty"`
+
+	AuthMode           string `json:"authMode,omitempty"`
+	Kubeconfig         string `json:"kubeconfig,omitempty"`
+	KubeconfigSecretID string `json:"kubeconfigSecretId,omitempty"`
+	KubeconfigContext  string `json:"kubeconfigContext,omitempty"`
+
+	RoleARN     string `json:"roleArn,omitempty"`
+	ExternalID  string `json:"externalId,omitempty"`
+	SessionName string `json:"sessionName,omitempty"`
+
+	NodePools []NodePoolConfig `json:"nodePools"`
+	// Limits are restored on startup for nodepools without their own, e.g. {"cpu": "1000"}
+	Limits map[string]string `json:"limits,omitempty"`
+	// Profiles are named nodepool settings shared by several nodepools
+	Profiles map[string]NodePoolProfile `json:"profiles,omitempty"`
+	// Stages group nodepools that are started in order and shut down in reverse
+	Stages []StageConfig `json:"stages,omitempty"`
+	// Parallelism is the number of nodepools of a stage processed at once, default 1
+	Parallelism int `json:"parallelism,omitempty"`
+	// Scale is the night-time capacity of the "scale" action for nodepools
+	// without their own
+	Scale *ScaleConfig `json:"scale,omitempty"`
+	// OffPeak is the off-peak profile of the "offpeak" action for nodepools
+	// without their own
+	OffPeak *OffPeakConfig `json:"offPeak,omitempty"`
+	// DoNotDisrupt is the do-not-disrupt policy for nodepools without their own
+	DoNotDisrupt *DoNotDisruptConfig `json:"doNotDisrupt,omitempty"`
+	// Block selects the workloads postponing the shutdown of nodepools
+	// without their own
+	Block *BlockConfig `json:"block,omitempty"`
+	// Workloads are the Deployments and StatefulSets scaled to zero on
+	// shutdown and restored on startup
+	Workloads *WorkloadConfig `json:"workloads,omitempty"`
+	// CronJobs are the CronJobs suspended on shutdown and resumed on startup
+	CronJobs *WorkloadConfig `json:"cronJobs,omitempty"`
+	// Autoscalers are the HPAs and KEDA ScaledObjects paused on shutdown and
+	// resumed on startup
+	Autoscalers *WorkloadConfig `json:"autoscalers,omitempty"`
+	// GitOps names the Argo CD and Flux resources suspended on shutdown and
+	// resumed on startup
+	GitOps *GitOpsConfig `json:"gitOps,omitempty"`
+	// SleepPage is the backend annotated Ingresses and HTTPRoutes point at
+	// overnight
+	SleepPage *SleepPageConfig `json:"sleepPage,omitempty"`
+	// Overrides is the ConfigMap, as namespace/name, holding skip dates and
+	// forced-awake and forced-asleep ranges, default
+	// kube-system/shutdown-schedule-overrides
+	Overrides string `json:"overrides,omitempty"`
+}
+
+// SleepPageConfig is the Service serving a static "environment is asleep"
+// page. It must exist in the namespace of every annotated route, for
+// example as an ExternalName Service, and run on capacity that is not shut
+// down.
+type SleepPageConfig struct {
+	Service string `json:"service"`
+	Port    int    `json:"port"`
+}
+
+// GitOpsConfig names the GitOps resources that would revert the changes
+// made overnight. Names are "namespace/name", or a plain name in the tool's
+// default namespace, argocd or flux-system.
+type GitOpsConfig struct {
+	// ArgoCDApplications have their automated sync policy removed
+	ArgoCDApplications []string `json:"argoCDApplications,omitempty"`
+	// FluxKustomizations are suspended
+	FluxKustomizations []string `json:"fluxKustomizations,omitempty"`
+	// FluxHelmReleases are suspended
+	FluxHelmReleases []string `json:"fluxHelmReleases,omitempty"`
+}
+
+// WorkloadConfig selects resources of a cluster by namespace and label.
+type WorkloadConfig struct {
+	// Namespaces whose resources are selected
+	Namespaces []string `json:"namespaces,omitempty"`
+	// Selector is a label selector narrowing the namespaces' resources, or
+	// selecting resources in every namespace when no namespaces are set,
+	// e.g. "shutdown-schedule/scale-to-zero=true"
+	Selector string `json:"selector,omitempty"`
+}
+
+// StageConfig is a group of nodepools processed together. On startup stages
+// run in the listed order, for the night actions in reverse. Nodepools not selected by
+// any stage form a final "default" stage.
+type StageConfig struct {
+	Name string `json:"name"`
+	// NodePools are names or patterns, see nodePoolPattern
+	NodePools []string `json:"nodePools"`
+	// Wait blocks before the next stage until the stage's nodepools have a
+	// Ready node on startup, or no NodeClaims left on shutdown
+	Wait bool `json:"wait,omitempty"`
+	// Timeout bounds the wait, e.g. "5m", default defaultStageTimeout
+	Timeout string `json:"timeout,omitempty"`
+}
+
+// ScaleConfig is the reduced capacity the "scale" action leaves a nodepool
+// with overnight, instead of shutting it down.
+type ScaleConfig struct {
+	// Fraction of the daytime limits to keep, e.g. "10%" or "0.1"
+	Fraction string `json:"fraction,omitempty"`
+	// Limits are absolute night-time limits, e.g. {"cpu": "16"}, and take
+	// precedence over the fraction
+	Limits map[string]string `json:"limits,omitempty"`
+	// Remove picks the NodeClaims removed first, "newest" or "expensive",
+	// default "newest"
+	Remove string `json:"remove,omitempty"`
+}
+
+// OffPeakConfig narrows the instances the "offpeak" action allows a nodepool
+// overnight. Each list replaces the nodepool's requirement on that label.
+type OffPeakConfig struct {
+	// InstanceTypes are node.kubernetes.io/instance-type values, e.g. ["t3.medium"]
+	InstanceTypes []string `json:"instanceTypes,omitempty"`
+	// InstanceSizes are karpenter.k8s.aws/instance-size values, e.g. ["medium", "large"]
+	InstanceSizes []string `json:"instanceSizes,omitempty"`
+}
+
+// DoNotDisruptConfig decides what shutdown does with nodes hosting pods
+// annotated karpenter.sh/do-not-disrupt=true.
+type DoNotDisruptConfig struct {
+	// Policy is "override" to shut the nodes down anyway, "skip" to leave
+	// them running until the next shutdown, or "delay" to wait for the pods
+	// to finish until the deadline, default "override"
+	Policy string `json:"policy,omitempty"`
+	// Deadline bounds a delay from the start of the run, e.g. "20m", default
+	// defaultDoNotDisruptDeadline
+	Deadline string `json:"deadline,omitempty"`
+}
+
+// BlockConfig selects pods and Jobs, such as a long data migration, whose
+// running postpones the shutdown of a nodepool.
+type BlockConfig struct {
+	WorkloadConfig
+	// CutOff bounds the retries from the start of the run, e.g. "20m",
+	// default defaultBlockCutOff. The shutdown of the nodepool is skipped
+	// when the workloads still run by then.
+	CutOff string `json:"cutOff,omitempty"`
+}
+
+// NodePoolProfile is the per-nodepool behaviour. Unset fields fall back to
+// the named profile, then to the cluster defaults.
+type NodePoolProfile struct {
+	// Limits are restored on startup, e.g. {"cpu": "100", "memory": "400Gi"}
+	Limits map[string]string `json:"limits,omitempty"`
+	// DeleteNodeClaims deletes the nodepool's NodeClaims on shutdown, default true
+	DeleteNodeClaims *bool `json:"deleteNodeClaims,omitempty"`
+	// TerminateInstances terminates the nodepool's EC2 instances on shutdown, default true
+	TerminateInstances *bool `json:"terminateInstances,omitempty"`
+	// Drain cordons the nodepool's nodes and evicts their pods on shutdown, default false
+	Drain *bool `json:"drain,omitempty"`
+	// Order sorts nodepools, lowest first, default 0
+	Order *int `json:"order,omitempty"`
+	// Recreate recreates the nodepool on startup from its latest snapshot
+	// when it was deleted overnight, default false
+	Recreate *bool `json:"recreate,omitempty"`
+	// Scale is the night-time capacity of the "scale" action
+	Scale *ScaleConfig `json:"scale,omitempty"`
+	// OffPeak is the off-peak profile of the "offpeak" action
+	OffPeak *OffPeakConfig `json:"offPeak,omitempty"`
+	// DoNotDisrupt is the policy for nodes hosting do-not-disrupt pods
+	DoNotDisrupt *DoNotDisruptConfig `json:"doNotDisrupt,omitempty"`
+	// Block selects the workloads postponing the shutdown
+	Block *BlockConfig `json:"block,omitempty"`
+}
+
+func (p NodePoolProfile) isZero() bool {
+	return p.Limits == nil && p.DeleteNodeClaims == nil && p.TerminateInstances == nil && p.Drain == nil && p.Order == nil && p.Recreate == nil && p.Scale == nil && p.OffPeak == nil && p.DoNotDisrupt == nil && p.Block == nil
+}
+
+// NodePoolConfig is an entry in a cluster's nodepool list. It can be written
+// as a plain name or as an object with a profile and overrides. The name may
+// also be a pattern, see nodePoolPattern.
+type NodePoolConfig struct {
+	Name    string `json:"name"`
+	Profile string `json:"profile,omitempty"`
+	NodePoolProfile
+}
+
+func (n *NodePoolConfig) UnmarshalJSON(data []byte) error {
+	var name string
+	if err := json.Unmarshal(data, &name); err == nil {
+		*n = NodePoolConfig{Name: name}
+		return nil
+	}
+
+	// Decode through an alias so this method is not called recursively
+	type nodePoolConfig NodePoolConfig
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	var cfg nodePoolConfig
+	if err := decoder.Decode(&cfg); err != nil {
+		return err
+	}
+	*n = NodePoolConfig(cfg)
+	return nil
+}
+
+// managedNodePool is a nodepool with its profile resolved.
+type managedNodePool struct {
+	Name               string
+	Limits             map[string]string
+	DeleteNodeClaims   bool
+	TerminateInstances bool
+	Drain              bool
+	Order              int
+	Recreate           bool
+	Scale              *ScaleConfig
+	OffPeak            *OffPeakConfig
+	DoNotDisrupt       DoNotDisruptConfig
+	Block              *BlockConfig
+}
+
+// managedNodePool resolves the settings of the nodepool called name, selected
+// by the entry np, from the entry, its profile and the cluster defaults.
+func (c ClusterConfig) managedNodePool(name string, np NodePoolConfig) managedNodePool {
+	profile := c.Profiles[np.Profile]
+
+	managed := managedNodePool{
+		Name:               name,
+		Limits:             firstLimits(np.Limits, profile.Limits, c.Limits),
+		DeleteNodeClaims:   firstBool(true, np.DeleteNodeClaims, profile.DeleteNodeClaims),
+		TerminateInstances: firstBool(true, np.TerminateInstances, profile.TerminateInstances),
+		Drain:              firstBool(false, np.Drain, profile.Drain),
+		Recreate:           firstBool(false, np.Recreate, profile.Recreate),
+		Scale:              firstScale(np.Scale, profile.Scale, c.Scale),
+		OffPeak:            firstOffPeak(np.OffPeak, profile.OffPeak, c.OffPeak),
+		DoNotDisrupt:       firstDoNotDisrupt(np.DoNotDisrupt, profile.DoNotDisrupt, c.DoNotDisrupt),
+		Block:              firstBlock(np.Block, profile.Block, c.Block),
+	}
+	if np.Order != nil {
+		managed.Order = *np.Order
+	} else if profile.Order != nil {
+		managed.Order = *profile.Order
+	}
+	return managed
+}
+
+func firstLimits(limits ...map[string]string) map[string]string {
+	for _, l := range limits {
+		if len(l) > 0 {
+			return l
+		}
+	}
+	return nil
+}
+
+func firstScale(scales ...*ScaleConfig) *ScaleConfig {
+	for _, s := range scales {
+		if s != nil {
+			return s
+		}
+	}
+	return nil
+}
+
+func firstOffPeak(offPeaks ...*OffPeakConfig) *OffPeakConfig {
+	for _, o := range offPeaks {
+		if o != nil {
+			return o
+		}
+	}
+	return nil
+}
+
+func firstDoNotDisrupt(policies ...*DoNotDisruptConfig) DoNotDisruptConfig {
+	for _, p := range policies {
+		if p != nil {
+			return *p
+		}
+	}
+	return DoNotDisruptConfig{}
+}
+
+func firstBlock(blocks ...*BlockConfig) *BlockConfig {
+	for _, b := range blocks {
+		if b != nil {
+			return b
+		}
+	}
+	return nil
+}
+
+func firstBool(defaultValue bool, values ...*bool) bool {
+	for _, v := range values {
+		if v != nil {
+			return *v
+		}
+	}
+	return defaultValue
+}
+
+// defaultRegion is used when neither the cluster nor AWS_REGION set a region.
+const defaultRegion = "ap-southeast-2"
+
+var regionPattern = regexp.MustCompile(`^[a-z]{2}(-[a-z]+)+-\d+$`)
+
+// region is the AWS region of the cluster, used consistently for the EKS
+// token, DescribeCluster and the EC2 calls.
+func (c ClusterConfig) region() string {
+	if c.Region != "" {
+		return c.Region
+	}
+	return utils.GetenvDefault("AWS_REGION", defaultRegion)
+}
+
+// key identifies the cluster across regions and invocations.
+func (c ClusterConfig) key() string {
+	return c.region() + "/" + c.Name
+}
+
+func (c ClusterConfig) role() assumeRoleConfig {
+	sessionName := c.SessionName
+	if sessionName == "" {
+		sessionName = defaultRoleSessionName
+	}
+	return assumeRoleConfig{
+		RoleARN:     c.RoleARN,
+		ExternalID:  c.ExternalID,
+		SessionName: sessionName,
+	}
+}
+
+// loadConfig reads the configuration document from SSM Parameter Store or S3
+// when configured, otherwise from KARPENTER_CLUSTERS, falling back to the
+// single-cluster environment variables.
+func loadConfig(ctx context.Context) (*Config, error) {
+	source, err := newConfigSource(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if source != nil {
+		data, err := source.fetch(ctx)
+		if err != nil {
+			return nil, err
+		}
+		cfg, err := parseConfig(data)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", source, err)
+		}
+		return cfg, nil
+	}
+
+	if doc := os.Getenv("KARPENTER_CLUSTERS"); doc != "" {
+		return parseConfig([]byte(doc))
+	}
+
+	nodePoolsStr := os.Getenv("KARPENTER_NODEPOOLS")
+	if nodePoolsStr == "" {
+		return nil, fmt.Errorf("KARPENTER_NODEPOOLS environment variable not set")
+	}
+
+	cluster, err := clusterConfigFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	cluster.NodePools = splitNodePools(nodePoolsStr)
+
+	return &Config{Clusters: []ClusterConfig{cluster}}, nil
+}
+
+// clusterConfigFromEnv builds the cluster configuration from the
+// single-cluster environment variables.
+func clusterConfigFromEnv() (ClusterConfig, error) {
+	cluster := ClusterConfig{
+		Name:               os.Getenv("KUBERNETES_CLUSTER_NAME"),
+		Region:             os.Getenv("AWS_REGION"),
+		Host:               os.Getenv("KUBERNETES_SERVICE_HOST"),
+		AuthMode:           utils.GetenvDefault("KUBERNETES_AUTH_MODE", authModeEKS),
+		Kubeconfig:         os.Getenv("KUBECONFIG"),
+		KubeconfigSecretID: os.Getenv("KUBECONFIG_SECRET_ID"),
+		KubeconfigContext:  os.Getenv("KUBECONFIG_CONTEXT"),
+		RoleARN:            os.Getenv("KUBERNETES_CLUSTER_ROLE_ARN"),
+		ExternalID:         os.Getenv("KUBERNETES_CLUSTER_ROLE_EXTERNAL_ID"),
+		SessionName:        os.Getenv("KUBERNETES_CLUSTER_ROLE_SESSION_NAME"),
+	}
+	if cluster.AuthMode == authModePodIdentity {
+		// Inside a pod KUBERNETES_SERVICE_HOST is the in-cluster service IP,
+		// so only honour an explicit override
+		cluster.Host = os.Getenv("KUBERNETES_API_ENDPOINT")
+	}
+	if cpuLimit := os.Getenv("KARPENTER_NODEPOOL_LIMITS_CPU"); cpuLimit != "" {
+		cluster.Limits = map[string]string{"cpu": cpuLimit}
+	}
+	if parallelism := os.Getenv("KARPENTER_PARALLELISM"); parallelism != "" {
+		n, err := strconv.Atoi(parallelism)
+		if err != nil || n < 1 {
+			return ClusterConfig{}, fmt.Errorf("invalid KARPENTER_PARALLELISM %q, expected a positive number", parallelism)
+		}
+		cluster.Parallelism = n
+	}
+	if fraction := os.Getenv("KARPENTER_NODEPOOL_SCALE"); fraction != "" {
+		cluster.Scale = &ScaleConfig{Fraction: fraction}
+		if err := validateScale(cluster.Scale); err != nil {
+			return ClusterConfig{}, fmt.Errorf("invalid KARPENTER_NODEPOOL_SCALE %q: %v", fraction, err)
+		}
+	}
+	if sizes := os.Getenv("KARPENTER_OFFPEAK_INSTANCE_SIZES"); sizes != "" {
+		cluster.OffPeak = &OffPeakConfig{InstanceSizes: splitList(sizes)}
+	}
+	if policy := os.Getenv("KARPENTER_DO_NOT_DISRUPT_POLICY"); policy != "" {
+		cluster.DoNotDisrupt = &DoNotDisruptConfig{Policy: policy, Deadline: os.Getenv("KARPENTER_DO_NOT_DISRUPT_DEADLINE")}
+		if err := validateDoNotDisrupt(cluster.DoNotDisrupt); err != nil {
+			return ClusterConfig{}, fmt.Errorf("invalid KARPENTER_DO_NOT_DISRUPT_POLICY: %v", err)
+		}
+	}
+	if namespaces, selector := os.Getenv("KARPENTER_BLOCK_NAMESPACES"), os.Getenv("KARPENTER_BLOCK_SELECTOR"); namespaces != "" || selector != "" {
+		cluster.Block = &BlockConfig{
+			WorkloadConfig: WorkloadConfig{Namespaces: splitList(namespaces), Selector: selector},
+			CutOff:         os.Getenv("KARPENTER_BLOCK_CUTOFF"),
+		}
+		if err := validateBlock(cluster.Block); err != nil {
+			return ClusterConfig{}, err
+		}
+	}
+	namespaces, selector := os.Getenv("KARPENTER_WORKLOAD_NAMESPACES"), os.Getenv("KARPENTER_WORKLOAD_SELECTOR")
+	if namespaces != "" || selector != "" {
+		cluster.Workloads = &WorkloadConfig{Namespaces: splitList(namespaces), Selector: selector}
+		if err := validateWorkloads("workloads", cluster.Workloads); err != nil {
+			return ClusterConfig{}, err
+		}
+	}
+	if namespaces := os.Getenv("KARPENTER_CRONJOB_NAMESPACES"); namespaces != "" {
+		cluster.CronJobs = &WorkloadConfig{Namespaces: splitList(namespaces)}
+	}
+	if namespaces := os.Getenv("KARPENTER_AUTOSCALER_NAMESPACES"); namespaces != "" {
+		cluster.Autoscalers = &WorkloadConfig{Namespaces: splitList(namespaces)}
+	}
+	gitOps := GitOpsConfig{
+		ArgoCDApplications: splitList(os.Getenv("KARPENTER_ARGOCD_APPLICATIONS")),
+		FluxKustomizations: splitList(os.Getenv("KARPENTER_FLUX_KUSTOMIZATIONS")),
+		FluxHelmReleases:   splitList(os.Getenv("KARPENTER_FLUX_HELMRELEASES")),
+	}
+	if len(gitOps.ArgoCDApplications)+len(gitOps.FluxKustomizations)+len(gitOps.FluxHelmReleases) > 0 {
+		cluster.GitOps = &gitOps
+	}
+	cluster.Overrides = os.Getenv("KARPENTER_OVERRIDES_CONFIGMAP")
+	if err := validateOverridesRef(cluster.Overrides); err != nil {
+		return ClusterConfig{}, err
+	}
+	if service := os.Getenv("KARPENTER_SLEEP_PAGE_SERVICE"); service != "" {
+		name, port, _ := strings.Cut(service, ":")
+		cluster.SleepPage = &SleepPageConfig{Service: name, Port: 80}
+		if port != "" {
+			cluster.SleepPage.Port, _ = strconv.Atoi(port)
+		}
+		if err := validateSleepPage(cluster.SleepPage); err != nil {
+			return ClusterConfig{}, fmt.Errorf("invalid KARPENTER_SLEEP_PAGE_SERVICE %q: %v", service, err)
+		}
+	}
+
+	if cluster.Name == "" && usesEKSToken(cluster.AuthMode) {
+		return ClusterConfig{}, fmt.Errorf("KUBERNETES_CLUSTER_NAME environment variable not set")
+	}
+
+	return cluster, nil
+}
+
+// parseConfig decodes and validates a JSON or YAML configuration document.
+// Unknown fields are rejected so typos do not silently fall back to defaults.
+func parseConfig(data []byte) (*Config, error) {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse clusters config: %v", err)
+	}
+
+	decoder := json.NewDecoder(bytes.NewReader(jsonData))
+	decoder.DisallowUnknownFields()
+
+	var cfg Config
+	if err := decoder.Decode(&cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse clusters config: %v", err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid clusters config: %v", err)
+	}
+
+	return &cfg, nil
+}
+
+func (c *Config) validate() error {
+	if c.Version == 0 {
+		c.Version = configVersion
+	}
+	if c.Version != configVersion {
+		return fmt.Errorf("unsupported config version %d, expected %d", c.Version, configVersion)
+	}
+	if len(c.Clusters) == 0 {
+		return fmt.Errorf("no clusters configured")
+	}
+
+	seen := map[string]bool{}
+	for i, cluster := range c.Clusters {
+		if cluster.Name == "" {
+			return fmt.Errorf("clusters[%d]: name is required", i)
+		}
+		if cluster.Region != "" && !regionPattern.MatchString(cluster.Region) {
+			return fmt.Errorf("clusters[%d] (%s): invalid region %q", i, cluster.Name, cluster.Region)
+		}
+		key := cluster.key()
+		if seen[key] {
+			return fmt.Errorf("clusters[%d]: duplicate cluster %s", i, cluster.Name)
+		}
+		seen[key] = true
+
+		if len(cluster.NodePools) == 0 {
+			return fmt.Errorf("clusters[%d] (%s): at least one nodepool is required", i, cluster.Name)
+		}
+		if cluster.Parallelism < 0 {
+			return fmt.Errorf("clusters[%d] (%s): parallelism must not be negative", i, cluster.Name)
+		}
+		for j, np := range cluster.NodePools {
+			if np.Name == "" {
+				return fmt.Errorf("clusters[%d] (%s): nodePools[%d]: name is required", i, cluster.Name, j)
+			}
+			pattern, err := parseNodePoolPattern(np.Name)
+			if err != nil {
+				return fmt.Errorf("clusters[%d] (%s): nodePools[%d]: %v", i, cluster.Name, j, err)
+			}
+			if pattern.exclude && (np.Profile != "" || !np.NodePoolProfile.isZero()) {
+				return fmt.Errorf("clusters[%d] (%s): nodepool %s: exclusions cannot set a profile or overrides", i, cluster.Name, np.Name)
+			}
+			if _, ok := cluster.Profiles[np.Profile]; np.Profile != "" && !ok {
+				return fmt.Errorf("clusters[%d] (%s): nodepool %s: unknown profile %q", i, cluster.Name, np.Name, np.Profile)
+			}
+			// Patterns only match NodePools that exist, so one deleted
+			// during the night would never be selected for recreation
+			if !pattern.literal() && firstBool(false, np.Recreate, cluster.Profiles[np.Profile].Recreate) {
+				return fmt.Errorf("clusters[%d] (%s): nodepool %s: recreate needs an exact nodepool name, not a pattern", i, cluster.Name, np.Name)
+			}
+			if err := validateScale(np.Scale); err != nil {
+				return fmt.Errorf("clusters[%d] (%s): nodepool %s: %v", i, cluster.Name, np.Name, err)
+			}
+			if err := validateOffPeak(np.OffPeak); err != nil {
+				return fmt.Errorf("clusters[%d] (%s): nodepool %s: %v", i, cluster.Name, np.Name, err)
+			}
+			if err := validateDoNotDisrupt(np.DoNotDisrupt); err != nil {
+				return fmt.Errorf("clusters[%d] (%s): nodepool %s: %v", i, cluster.Name, np.Name, err)
+			}
+			if err := validateBlock(np.Block); err != nil {
+				return fmt.Errorf("clusters[%d] (%s): nodepool %s: %v", i, cluster.Name, np.Name, err)
+			}
+		}
+		for name, profile := range cluster.Profiles {
+			if err := validateScale(profile.Scale); err != nil {
+				return fmt.Errorf("clusters[%d] (%s): profile %s: %v", i, cluster.Name, name, err)
+			}
+			if err := validateOffPeak(profile.OffPeak); err != nil {
+				return fmt.Errorf("clusters[%d] (%s): profile %s: %v", i, cluster.Name, name, err)
+			}
+			if err := validateDoNotDisrupt(profile.DoNotDisrupt); err != nil {
+				return fmt.Errorf("clusters[%d] (%s): profile %s: %v", i, cluster.Name, name, err)
+			}
+			if err := validateBlock(profile.Block); err != nil {
+				return fmt.Errorf("clusters[%d] (%s): profile %s: %v", i, cluster.Name, name, err)
+			}
+		}
+		if err := validateScale(cluster.Scale); err != nil {
+			return fmt.Errorf("clusters[%d] (%s): %v", i, cluster.Name, err)
+		}
+		if err := validateOffPeak(cluster.OffPeak); err != nil {
+			return fmt.Errorf("clusters[%d] (%s): %v", i, cluster.Name, err)
+		}
+		if err := validateDoNotDisrupt(cluster.DoNotDisrupt); err != nil {
+			return fmt.Errorf("clusters[%d] (%s): %v", i, cluster.Name, err)
+		}
+		if err := validateBlock(cluster.Block); err != nil {
+			return fmt.Errorf("clusters[%d] (%s): %v", i, cluster.Name, err)
+		}
+		if err := validateOverridesRef(cluster.Overrides); err != nil {
+			return fmt.Errorf("clusters[%d] (%s): %v", i, cluster.Name, err)
+		}
+		if err := validateWorkloads("workloads", cluster.Workloads); err != nil {
+			return fmt.Errorf("clusters[%d] (%s): %v", i, cluster.Name, err)
+		}
+		if err := validateWorkloads("cronJobs", cluster.CronJobs); err != nil {
+			return fmt.Errorf("clusters[%d] (%s): %v", i, cluster.Name, err)
+		}
+		if err := validateWorkloads("autoscalers", cluster.Autoscalers); err != nil {
+			return fmt.Errorf("clusters[%d] (%s): %v", i, cluster.Name, err)
+		}
+		if err := validateGitOps(cluster.GitOps); err != nil {
+			return fmt.Errorf("clusters[%d] (%s): %v", i, cluster.Name, err)
+		}
+		if err := validateSleepPage(cluster.SleepPage); err != nil {
+			return fmt.Errorf("clusters[%d] (%s): %v", i, cluster.Name, err)
+		}
+		if err := validateStages(cluster.Stages); err != nil {
+			return fmt.Errorf("clusters[%d] (%s): %v", i, cluster.Name, err)
+		}
+		if _, err := newAuthenticator(cluster); err != nil {
+			return fmt.Errorf("clusters[%d] (%s): %v", i, cluster.Name, err)
+		}
+	}
+
+	return nil
+}
+
+// longestWait returns the longest wait a run may make, counted from its
+// start - a blocking workload cut-off or a do-not-disrupt delay deadline -
+// and the setting it comes from.
+func (c *Config) longestWait() (time.Duration, string) {
+	var longest time.Duration
+	var setting string
+	consider := func(where string, block *BlockConfig, doNotDisrupt *DoNotDisruptConfig) {
+		if block != nil && block.cutOff() > longest {
+			longest, setting = block.cutOff(), where+" block cutOff"
+		}
+		if doNotDisrupt != nil && doNotDisrupt.Policy == doNotDisruptDelay && doNotDisrupt.deadline() > longest {
+			longest, setting = doNotDisrupt.deadline(), where+" doNotDisrupt deadline"
+		}
+	}
+	for _, cluster := range c.Clusters {
+		consider("cluster "+cluster.Name, cluster.Block, cluster.DoNotDisrupt)
+		for name, profile := range cluster.Profiles {
+			consider(fmt.Sprintf("cluster %s profile %s", cluster.Name, name), profile.Block, profile.DoNotDisrupt)
+		}
+		for _, np := range cluster.NodePools {
+			consider(fmt.Sprintf("cluster %s nodepool %s", cluster.Name, np.Name), np.Block, np.DoNotDisrupt)
+		}
+	}
+	return longest, setting
+}
+
+// splitNodePools parses a comma-separated list of nodepool names or patterns.
+func splitNodePools(nodePoolsStr string) []NodePoolConfig {
+	var nodePools []NodePoolConfig
+	for _, name := range splitList(nodePoolsStr) {
+		nodePools = append(nodePools, NodePoolConfig{Name: name})
+	}
+	return nodePools
+}
+
+// splitList parses a comma-separated list, dropping empty entries.
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+)
+
+// configSource fetches the configuration document at invocation time, so
+// behaviour can change without redeploying the stack.
+type configSource interface {
+	fetch(ctx context.Context) ([]byte, error)
+	String() string
+}
+
+type ssmAPI interface {
+	GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error)
+}
+
+type s3API interface {
+	GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error)
+}
+
+// newConfigSource returns the remote source configured through
+// KARPENTER_CONFIG_SSM_PARAMETER or KARPENTER_CONFIG_S3_URI, or nil when
+// neither is set.
+func newConfigSource(ctx context.Context) (configSource, error) {
+	parameter := os.Getenv("KARPENTER_CONFIG_SSM_PARAMETER")
+	uri := os.Getenv("KARPENTER_CONFIG_S3_URI")
+	if parameter == "" && uri == "" {
+		return nil, nil
+	}
+	if parameter != "" && uri != "" {
+		return nil, fmt.Errorf("only one of KARPENTER_CONFIG_SSM_PARAMETER and KARPENTER_CONFIG_S3_URI may be set")
+	}
+
+	cfg, err := loadAWSConfig(ctx, "", assumeRoleConfig{})
+	if err != nil {
+		return nil, err
+	}
+
+	if parameter != "" {
+		return &ssmConfigSource{client: ssm.NewFromConfig(cfg), parameter: parameter}, nil
+	}
+	return newS3ConfigSource(s3.NewFromConfig(cfg), uri)
+}
+
+// ssmConfigSource reads a Parameter Store parameter. A specific version can be
+// pinned with the usual "name:version" selector.
+type ssmConfigSource struct {
+	client    ssmAPI
+	parameter string
+}
+
+func (s *ssmConfigSource) fetch(ctx context.Context) ([]byte, error) {
+	out, err := s.client.GetParameter(ctx, &ssm.GetParameterInput{
+		Name:           aws.String(s.parameter),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to get parameter %s: %v", s.parameter, err)
+	}
+	if out.Parameter == nil || out.Parameter.Value == nil {
+		return nil, fmt.Errorf("parameter %s has no value", s.parameter)
+	}
+
+	fmt.Printf("Loaded config from SSM parameter %s version %d\n", s.parameter, out.Parameter.Version)
+	return []byte(*out.Parameter.Value), nil
+}
+
+func (s *ssmConfigSource) String() string {
+	return "ssm:" + s.parameter
+}
+
+// s3ConfigSource reads an S3 object, optionally pinned to a versionId.
+type s3ConfigSource struct {
+	client    s3API
+	bucket    string
+	key       string
+	versionID string
+}
+
+// newS3ConfigSource parses URIs of the form s3://bucket/key[?versionId=...].
+func newS3ConfigSource(client s3API, uri string) (*s3ConfigSource, error) {
+	u, err := url.Parse(uri)
+	if err != nil || u.Scheme != "s3" || u.Host == "" || strings.TrimPrefix(u.Path, "/") == "" {
+		return nil, fmt.Errorf("invalid KARPENTER_CONFIG_S3_URI %q, expected s3://bucket/key", uri)
+	}
+
+	return &s3ConfigSource{
+		client:    client,
+		bucket:    u.Host,
+		key:       strings.TrimPrefix(u.Path, "/"),
+		versionID: u.Query().Get("versionId"),
+	}, nil
+}
+
+func (s *s3ConfigSource) fetch(ctx context.Context) ([]byte, error) {
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(s.bucket),
+		Key:    aws.String(s.key),
+	}
+	if s.versionID != "" {
+		input.VersionId = aws.String(s.versionID)
+	}
+
+	out, err := s.client.GetObject(ctx, input)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get object %s: %v", s, err)
+	}
+	defer out.Body.Close()
+
+	data, err := io.ReadAll(out.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read object %s: %v", s, err)
+	}
+
+	fmt.Printf("Loaded config from %s version %s\n", s, aws.ToString(out.VersionId))
+	return data, nil
+}
+
+func (s *s3ConfigSource) String() string {
+	return fmt.Sprintf("s3://%s/%s", s.bucket, s.key)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/s3"
+	"github.com/aws/aws-sdk-go-v2/service/ssm"
+	ssmtypes "github.com/aws/aws-sdk-go-v2/service/ssm/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeSSM struct {
+	values map[string]string
+	input  *ssm.GetParameterInput
+}
+
+func (f *fakeSSM) GetParameter(ctx context.Context, params *ssm.GetParameterInput, optFns ...func(*ssm.Options)) (*ssm.GetParameterOutput, error) {
+	f.input = params
+	value, ok := f.values[*params.Name]
+	if !ok {
+		return nil, fmt.Errorf("ParameterNotFound")
+	}
+	return &ssm.GetParameterOutput{
+		Parameter: &ssmtypes.Parameter{Name: params.Name, Value: aws.String(value), Version: 3},
+	}, nil
+}
+
+type fakeS3 struct {
+	body  string
+	input *s3.GetObjectInput
+}
+
+func (f *fakeS3) GetObject(ctx context.Context, params *s3.GetObjectInput, optFns ...func(*s3.Options)) (*s3.GetObjectOutput, error) {
+	f.input = params
+	return &s3.GetObjectOutput{
+		Body:      io.NopCloser(strings.NewReader(f.body)),
+		VersionId: params.VersionId,
+	}, nil
+}
+
+func TestSSMConfigSource(t *testing.T) {
+	client := &fakeSSM{values: map[string]string{
+		"/karpenter/shutdown-schedule:3": `{"clusters": [{"name": "dev", "nodePools": ["default"]}]}`,
+	}}
+	source := &ssmConfigSource{client: client, parameter: "/karpenter/shutdown-schedule:3"}
+
+	data, err := source.fetch(context.Background())
+	require.NoError(t, err)
+	assert.True(t, *client.input.WithDecryption)
+
+	cfg, err := parseConfig(data)
+	require.NoError(t, err)
+	assert.Equal(t, "dev", cfg.Clusters[0].Name)
+
+	source.parameter = "/karpenter/missing"
+	_, err = source.fetch(context.Background())
+	assert.ErrorContains(t, err, "failed to get parameter /karpenter/missing")
+}
+
+func TestS3ConfigSource(t *testing.T) {
+	client := &fakeS3{body: "clusters:\n  - name: dev\n    nodePools: [default]\n"}
+
+	source, err := newS3ConfigSource(client, "s3://config-bucket/karpenter/clusters.yaml?versionId=abc123")
+	require.NoError(t, err)
+	assert.Equal(t, "config-bucket", source.bucket)
+	assert.Equal(t, "karpenter/clusters.yaml", source.key)
+
+	data, err := source.fetch(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "abc123", *client.input.VersionId)
+
+	cfg, err := parseConfig(data)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"default"}, nodePoolNames(cfg.Clusters[0].NodePools))
+}
+
+func TestNewS3ConfigSourceInvalidURI(t *testing.T) {
+	for _, uri := range []string{"https://bucket/key", "s3://bucket", "s3:///key"} {
+		_, err := newS3ConfigSource(&fakeS3{}, uri)
+		assert.ErrorContains(t, err, "invalid KARPENTER_CONFIG_S3_URI", uri)
+	}
+}
+
+func TestNewConfigSourceSelection(t *testing.T) {
+	t.Setenv("KARPENTER_CONFIG_SSM_PARAMETER", "")
+	t.Setenv("KARPENTER_CONFIG_S3_URI", "")
+
+	source, err := newConfigSource(context.Background())
+	require.NoError(t, err)
+	assert.Nil(t, source)
+
+	t.Setenv("KARPENTER_CONFIG_SSM_PARAMETER", "/karpenter/shutdown-schedule")
+	source, err = newConfigSource(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, "ssm:/karpenter/shutdown-schedule", source.String())
+
+	t.Setenv("KARPENTER_CONFIG_S3_URI", "s3://config-bucket/clusters.json")
+	_, err = newConfigSource(context.Background())
+	assert.ErrorContains(t, err, "only one of")
+}
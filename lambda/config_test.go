@@ -0,0 +1,272 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoadConfigFromClustersDocument(t *testing.T) {
+	t.Setenv("KARPENTER_CLUSTERS", `{
+		"clusters": [
+			{"name": "dev", "region": "ap-southeast-2", "nodePools": ["default", "spot"]},
+			{
+				"name": "staging",
+				"region": "us-east-1",
+				"roleArn": "arn:aws:iam::111111111111:role/shutdown-schedule",
+				"nodePools": ["default"],
+				"limits": {"cpu": "200", "memory": "800Gi"}
+			}
+		]
+	}`)
+
+	cfg, err := loadConfig(context.Background())
+	require.NoError(t, err)
+	require.Len(t, cfg.Clusters, 2)
+
+	assert.Equal(t, "dev", cfg.Clusters[0].Name)
+	assert.Equal(t, []string{"default", "spot"}, nodePoolNames(cfg.Clusters[0].NodePools))
+	assert.Equal(t, "staging", cfg.Clusters[1].Name)
+	assert.Equal(t, map[string]string{"cpu": "200", "memory": "800Gi"}, cfg.Clusters[1].Limits)
+	assert.Equal(t, defaultRoleSessionName, cfg.Clusters[1].role().SessionName)
+}
+
+func TestLoadConfigFromEnvironment(t *testing.T) {
+	t.Setenv("KARPENTER_CLUSTERS", "")
+	t.Setenv("KARPENTER_NODEPOOLS", "default, spot ,")
+	t.Setenv("KUBERNETES_CLUSTER_NAME", "test-cluster")
+	t.Setenv("KARPENTER_NODEPOOL_LIMITS_CPU", "500")
+	t.Setenv("KARPENTER_PARALLELISM", "4")
+	t.Setenv("KARPENTER_NODEPOOL_SCALE", "10%")
+	t.Setenv("KARPENTER_OFFPEAK_INSTANCE_SIZES", "medium, large")
+	t.Setenv("KARPENTER_WORKLOAD_NAMESPACES", "preview,staging")
+	t.Setenv("KARPENTER_CRONJOB_NAMESPACES", "batch")
+	t.Setenv("KARPENTER_AUTOSCALER_NAMESPACES", "preview")
+	t.Setenv("KARPENTER_ARGOCD_APPLICATIONS", "karpenter")
+	t.Setenv("KARPENTER_SLEEP_PAGE_SERVICE", "sleep-page:8080")
+	t.Setenv("KARPENTER_DO_NOT_DISRUPT_POLICY", "delay")
+	t.Setenv("KARPENTER_DO_NOT_DISRUPT_DEADLINE", "2h")
+	t.Setenv("KARPENTER_BLOCK_SELECTOR", "shutdown-schedule/block=true")
+	t.Setenv("KARPENTER_BLOCK_CUTOFF", "3h")
+	t.Setenv("KARPENTER_OVERRIDES_CONFIGMAP", "platform/overrides")
+
+	cfg, err := loadConfig(context.Background())
+	require.NoError(t, err)
+	require.Len(t, cfg.Clusters, 1)
+
+	assert.Equal(t, "test-cluster", cfg.Clusters[0].Name)
+	assert.Equal(t, []string{"default", "spot"}, nodePoolNames(cfg.Clusters[0].NodePools))
+	assert.Equal(t, map[string]string{"cpu": "500"}, cfg.Clusters[0].Limits)
+	assert.Equal(t, 4, cfg.Clusters[0].Parallelism)
+	assert.Equal(t, &ScaleConfig{Fraction: "10%"}, cfg.Clusters[0].Scale)
+	assert.Equal(t, &OffPeakConfig{InstanceSizes: []string{"medium", "large"}}, cfg.Clusters[0].OffPeak)
+	assert.Equal(t, &WorkloadConfig{Namespaces: []string{"preview", "staging"}}, cfg.Clusters[0].Workloads)
+	assert.Equal(t, &WorkloadConfig{Namespaces: []string{"batch"}}, cfg.Clusters[0].CronJobs)
+	assert.Equal(t, &WorkloadConfig{Namespaces: []string{"preview"}}, cfg.Clusters[0].Autoscalers)
+	assert.Equal(t, &GitOpsConfig{ArgoCDApplications: []string{"karpenter"}}, cfg.Clusters[0].GitOps)
+	assert.Equal(t, &SleepPageConfig{Service: "sleep-page", Port: 8080}, cfg.Clusters[0].SleepPage)
+	assert.Equal(t, &DoNotDisruptConfig{Policy: "delay", Deadline: "2h"}, cfg.Clusters[0].DoNotDisrupt)
+	assert.Equal(t, "platform/overrides", cfg.Clusters[0].Overrides)
+	assert.Equal(t, &BlockConfig{WorkloadConfig: WorkloadConfig{Selector: "shutdown-schedule/block=true"}, CutOff: "3h"}, cfg.Clusters[0].Block)
+
+	t.Setenv("KARPENTER_PARALLELISM", "many")
+	_, err = loadConfig(context.Background())
+	assert.ErrorContains(t, err, `invalid KARPENTER_PARALLELISM "many"`)
+}
+
+func TestParseConfigValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		doc         string
+		expectError string
+	}{
+		{"malformed", `{"clusters": [`, "failed to parse clusters config"},
+		{"wrong type", `clusters: dev`, "failed to parse clusters config"},
+		{"future version", `{"version": 2, "clusters": [{"name": "dev", "nodePools": ["a"]}]}`, "unsupported config version 2"},
+		{"unknown field", `{"clusters": [{"name": "dev", "nodePools": ["a"], "nodepool": "a"}]}`, `unknown field "nodepool"`},
+		{"no clusters", `{"clusters": []}`, "no clusters configured"},
+		{"missing name", `{"clusters": [{"nodePools": ["a"]}]}`, "clusters[0]: name is required"},
+		{"missing nodepools", `{"clusters": [{"name": "dev"}]}`, "at least one nodepool is required"},
+		{"duplicate cluster", `{"clusters": [{"name": "dev", "nodePools": ["a"]}, {"name": "dev", "nodePools": ["b"]}]}`, "duplicate cluster dev"},
+		{"bad nodepool scale", `{"clusters": [{"name": "dev", "nodePools": [{"name": "a", "scale": {"fraction": "200%"}}]}]}`, `nodepool a: scale: invalid fraction "200%"`},
+		{"bad profile scale", `{"clusters": [{"name": "dev", "nodePools": ["a"], "profiles": {"small": {"scale": {}}}}]}`, "profile small: scale needs a fraction or limits"},
+		{"empty off-peak profile", `{"clusters": [{"name": "dev", "nodePools": ["a"], "offPeak": {}}]}`, "offPeak needs instanceTypes or instanceSizes"},
+		{"empty workloads", `{"clusters": [{"name": "dev", "nodePools": ["a"], "workloads": {}}]}`, "workloads needs namespaces or a selector"},
+		{"bad workload selector", `{"clusters": [{"name": "dev", "nodePools": ["a"], "workloads": {"selector": "a in (b"}}]}`, "workloads: invalid selector"},
+		{"empty cronjobs", `{"clusters": [{"name": "dev", "nodePools": ["a"], "cronJobs": {}}]}`, "cronJobs needs namespaces or a selector"},
+		{"empty gitops", `{"clusters": [{"name": "dev", "nodePools": ["a"], "gitOps": {}}]}`, "gitOps needs argoCDApplications"},
+		{"bad gitops name", `{"clusters": [{"name": "dev", "nodePools": ["a"], "gitOps": {"fluxKustomizations": ["a/b/c"]}}]}`, `gitOps: invalid name "a/b/c"`},
+		{"sleep page without service", `{"clusters": [{"name": "dev", "nodePools": ["a"], "sleepPage": {"port": 80}}]}`, "sleepPage: service is required"},
+		{"bad do-not-disrupt policy", `{"clusters": [{"name": "dev", "nodePools": [{"name": "a", "doNotDisrupt": {"policy": "wait"}}]}]}`, `nodepool a: doNotDisrupt: invalid policy "wait"`},
+		{"bad do-not-disrupt deadline", `{"clusters": [{"name": "dev", "nodePools": ["a"], "doNotDisrupt": {"policy": "delay", "deadline": "soon"}}]}`, `doNotDisrupt: invalid deadline "soon"`},
+		{"empty block", `{"clusters": [{"name": "dev", "nodePools": [{"name": "a", "block": {"cutOff": "3h"}}]}]}`, "nodepool a: block needs namespaces or a selector"},
+		{"bad block cut-off", `{"clusters": [{"name": "dev", "nodePools": ["a"], "block": {"selector": "app=migrate", "cutOff": "3"}}]}`, `block: invalid cutOff "3"`},
+		{"bad overrides ConfigMap", `{"clusters": [{"name": "dev", "nodePools": ["a"], "overrides": "a/b/c"}]}`, `overrides: invalid ConfigMap "a/b/c"`},
+		{"bad auth mode", `{"clusters": [{"name": "dev", "authMode": "token", "nodePools": ["a"]}]}`, `unsupported auth mode "token"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := parseConfig([]byte(tt.doc))
+			assert.Nil(t, cfg)
+			assert.ErrorContains(t, err, tt.expectError)
+		})
+	}
+}
+
+func TestClusterConfigRegion(t *testing.T) {
+	t.Setenv("AWS_REGION", "")
+	assert.Equal(t, defaultRegion, ClusterConfig{Name: "dev"}.region())
+
+	t.Setenv("AWS_REGION", "us-east-1")
+	assert.Equal(t, "us-east-1", ClusterConfig{Name: "dev"}.region())
+	assert.Equal(t, "eu-west-1", ClusterConfig{Name: "dev", Region: "eu-west-1"}.region())
+}
+
+func TestParseConfigRegions(t *testing.T) {
+	t.Setenv("AWS_REGION", "ap-southeast-2")
+
+	// The same cluster name may be used in different regions
+	cfg, err := parseConfig([]byte(`{"clusters": [
+		{"name": "dev", "nodePools": ["default"]},
+		{"name": "dev", "region": "us-east-1", "nodePools": ["default"]}
+	]}`))
+	require.NoError(t, err)
+	assert.Len(t, cfg.Clusters, 2)
+
+	// ...but not twice in the same one, even if only one spells it out
+	_, err = parseConfig([]byte(`{"clusters": [
+		{"name": "dev", "nodePools": ["default"]},
+		{"name": "dev", "region": "ap-southeast-2", "nodePools": ["default"]}
+	]}`))
+	assert.ErrorContains(t, err, "duplicate cluster dev")
+
+	_, err = parseConfig([]byte(`{"clusters": [{"name": "dev", "region": "Sydney", "nodePools": ["default"]}]}`))
+	assert.ErrorContains(t, err, `invalid region "Sydney"`)
+}
+
+func TestParseConfigYAML(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+version: 1
+clusters:
+  - name: dev
+    nodePools: [default, spot]
+    limits:
+      cpu: "500"
+`))
+
+	require.NoError(t, err)
+	assert.Equal(t, configVersion, cfg.Version)
+	assert.Equal(t, []string{"default", "spot"}, nodePoolNames(cfg.Clusters[0].NodePools))
+	assert.Equal(t, map[string]string{"cpu": "500"}, cfg.Clusters[0].Limits)
+}
+
+func nodePoolNames(nodePools []NodePoolConfig) []string {
+	var names []string
+	for _, np := range nodePools {
+		names = append(names, np.Name)
+	}
+	return names
+}
+
+func TestManagedNodePoolProfiles(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+clusters:
+  - name: dev
+    limits: {cpu: "1000"}
+    profiles:
+      batch:
+        limits: {cpu: "64", nvidia.com/gpu: "4"}
+        terminateInstances: false
+        order: 2
+    nodePools:
+      - default
+      - name: gpu
+        profile: batch
+        drain: true
+      - name: ingress
+        deleteNodeClaims: false
+        order: 1
+`))
+	require.NoError(t, err)
+
+	nodePools, err := cfg.Clusters[0].resolveNodePools(nil)
+	require.NoError(t, err)
+	assert.Equal(t, []managedNodePool{
+		{Name: "default", Limits: map[string]string{"cpu": "1000"}, DeleteNodeClaims: true, TerminateInstances: true},
+		{Name: "ingress", Limits: map[string]string{"cpu": "1000"}, TerminateInstances: true, Order: 1},
+		{Name: "gpu", Limits: map[string]string{"cpu": "64", "nvidia.com/gpu": "4"}, DeleteNodeClaims: true, Drain: true, Order: 2},
+	}, nodePools)
+}
+
+func TestParseConfigNodePoolValidation(t *testing.T) {
+	_, err := parseConfig([]byte(`{"clusters": [{"name": "dev", "nodePools": [{"name": "gpu", "profile": "batch"}]}]}`))
+	assert.ErrorContains(t, err, `nodepool gpu: unknown profile "batch"`)
+
+	_, err = parseConfig([]byte(`{"clusters": [{"name": "dev", "nodePools": [{"profile": "batch"}]}]}`))
+	assert.ErrorContains(t, err, "nodePools[0]: name is required")
+
+	_, err = parseConfig([]byte(`{"clusters": [{"name": "dev", "nodePools": [{"name": "gpu", "drian": true}]}]}`))
+	assert.ErrorContains(t, err, `unknown field "drian"`)
+
+	_, err = parseConfig([]byte(`{"clusters": [{"name": "dev", "nodePools": ["/ci-(/"]}]}`))
+	assert.ErrorContains(t, err, "nodePools[0]: invalid nodepool regular expression")
+
+	_, err = parseConfig([]byte(`{"clusters": [{"name": "dev", "nodePools": [{"name": "!system", "drain": true}]}]}`))
+	assert.ErrorContains(t, err, "nodepool !system: exclusions cannot set a profile or overrides")
+
+	_, err = parseConfig([]byte(`{"clusters": [{"name": "dev", "nodePools": [{"name": "team-*", "profile": "team"}], "profiles": {"team": {"recreate": true}}}]}`))
+	assert.ErrorContains(t, err, "nodepool team-*: recreate needs an exact nodepool name, not a pattern")
+}
+
+func TestParseConfigStageValidation(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+clusters:
+  - name: dev
+    nodePools: ["*"]
+    stages:
+      - name: system
+        nodePools: [system]
+        wait: true
+        timeout: 3m
+`))
+	require.NoError(t, err)
+	assert.Equal(t, "3m", cfg.Clusters[0].Stages[0].Timeout)
+
+	_, err = parseConfig([]byte(`{"clusters": [{"name": "dev", "nodePools": ["*"], "stages": [{"nodePools": ["system"]}]}]}`))
+	assert.ErrorContains(t, err, "stages[0]: name is required")
+
+	_, err = parseConfig([]byte(`{"clusters": [{"name": "dev", "nodePools": ["*"], "stages": [{"name": "a", "nodePools": ["x"]}, {"name": "a", "nodePools": ["y"]}]}]}`))
+	assert.ErrorContains(t, err, "stages[1]: duplicate stage a")
+
+	_, err = parseConfig([]byte(`{"clusters": [{"name": "dev", "nodePools": ["*"], "stages": [{"name": "system"}]}]}`))
+	assert.ErrorContains(t, err, "stage system: at least one nodepool is required")
+
+	_, err = parseConfig([]byte(`{"clusters": [{"name": "dev", "nodePools": ["*"], "stages": [{"name": "system", "nodePools": ["system"], "timeout": "soon"}]}]}`))
+	assert.ErrorContains(t, err, `stage system: invalid timeout "soon"`)
+}
+
+func TestConfigLongestWait(t *testing.T) {
+	cfg, err := parseConfig([]byte(`
+clusters:
+  - name: dev
+    nodePools: [default, {name: batch, block: {selector: team=data, cutOff: 20m}}]
+    doNotDisrupt: {policy: override, deadline: 3h}
+    profiles:
+      slow:
+        doNotDisrupt: {policy: delay, deadline: 25m}
+`))
+	require.NoError(t, err)
+
+	// Overriding do-not-disrupt pods does not wait for them
+	wait, setting := cfg.longestWait()
+	assert.Equal(t, 25*time.Minute, wait)
+	assert.Equal(t, "cluster dev profile slow doNotDisrupt deadline", setting)
+
+	wait, setting = (&Config{Clusters: []ClusterConfig{{Name: "dev"}}}).longestWait()
+	assert.Zero(t, wait)
+	assert.Empty(t, setting)
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	lambdatypes "github.com/aws/aws-sdk-go-v2/service/lambda/types"
+)
+
+// defaultDeadlineThreshold is the time left before the Lambda deadline at
+// which no new work is started, leaving room for running work to finish.
+const defaultDeadlineThreshold = 45 * time.Second
+
+// defaultMaxInvocations bounds how often a run continues itself unless
+// KARPENTER_MAX_INVOCATIONS sets another limit.
+const defaultMaxInvocations = 10
+
+// errDeadline is returned when work was deferred because the invocation is
+// about to run out of time.
+var errDeadline = errors.New("deferred to a continuation, the invocation is running out of time")
+
+// Continuation is the checkpoint of a run that ran out of time. It is passed
+// to the invocation that resumes the run.
+type Continuation struct {
+	// StartedAt is when the first invocation of the run started
+	StartedAt time.Time `json:"startedAt"`
+	// Invocation numbers the invocations of the run, starting at 1
+	Invocation int `json:"invocation"`
+	// Clusters are the clusters fully processed, as region/name
+	Clusters []string `json:"clusters,omitempty"`
+	// NodePools are the nodepools processed per region/name of a cluster
+	NodePools map[string][]string `json:"nodePools,omitempty"`
+	// KeptAwake are the processed nodepools a keep-awake annotation left
+	// running, per region/name of a cluster
+	KeptAwake map[string][]string `json:"keptAwake,omitempty"`
+}
+
+// runProgress tracks what a run has done so far and when to stop starting
+// new work.
+type runProgress struct {
+	mu         sync.Mutex
+	startedAt  time.Time
+	invocation int
+	stopBy     time.Time
+	clusters   map[string]bool
+	nodePools  map[string]map[string]bool
+	keptAwake  map[string]map[string]bool
+	now        func() time.Time
+	// maxInvocations is the most invocations a run may take
+	maxInvocations int
+	// invocationTime is how long an invocation may start new work, zero
+	// without a deadline
+	invocationTime time.Duration
+	// store keeps nodepool snapshots across runs, nil when disabled
+	store stateStore
+}
+
+// newRunProgress resumes the continuation, if any, and stops new work
+// KARPENTER_DEADLINE_THRESHOLD before the context deadline.
+func newRunProgress(ctx context.Context, continuation *Continuation) (*runProgress, error) {
+	p := &runProgress{
+		startedAt:  time.Now(),
+		invocation: 1,
+		clusters:   map[string]bool{},
+		nodePools:  map[string]map[string]bool{},
+		keptAwake:  map[string]map[string]bool{},
+		now:        time.Now,
+
+		maxInvocations: defaultMaxInvocations,
+	}
+
+	if value := os.Getenv("KARPENTER_MAX_INVOCATIONS"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("invalid KARPENTER_MAX_INVOCATIONS %q", value)
+		}
+		p.maxInvocations = n
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		threshold := defaultDeadlineThreshold
+		if value := os.Getenv("KARPENTER_DEADLINE_THRESHOLD"); value != "" {
+			var err error
+			if threshold, err = time.ParseDuration(value); err != nil || threshold < 0 {
+				return nil, fmt.Errorf("invalid KARPENTER_DEADLINE_THRESHOLD %q", value)
+			}
+		}
+		p.stopBy = deadline.Add(-threshold)
+		p.invocationTime = p.stopBy.Sub(p.now()).Round(time.Second)
+	}
+
+	if continuation != nil {
+		p.startedAt = continuation.StartedAt
+		p.invocation = continuation.Invocation + 1
+		for _, cluster := range continuation.Clusters {
+			p.clusters[cluster] = true
+		}
+		for cluster, names := range continuation.NodePools {
+			p.nodePools[cluster] = map[string]bool{}
+			for _, name := range names {
+				p.nodePools[cluster][name] = true
+			}
+		}
+		for cluster, names := range continuation.KeptAwake {
+			p.keptAwake[cluster] = map[string]bool{}
+			for _, name := range names {
+				p.keptAwake[cluster][name] = true
+			}
+		}
+		fmt.Printf("Resuming run started at %s, invocation %d\n", p.startedAt.Format(time.RFC3339), p.invocation)
+	}
+
+	return p, nil
+}
+
+// outOfTime reports whether new work should no longer be started.
+func (p *runProgress) outOfTime() bool {
+	return !p.stopBy.IsZero() && !p.now().Before(p.stopBy)
+}
+
+// checkWaits rejects a configuration whose longest wait, counted from the
+// start of the run, outlasts the invocations the run may take. Only the first
+// invocation checks, so a run that started is not abandoned half-way.
+func (p *runProgress) checkWaits(cfg *Config) error {
+	if p.invocation > 1 || p.invocationTime <= 0 {
+		return nil
+	}
+	wait, setting := cfg.longestWait()
+	budget := time.Duration(p.maxInvocations-1) * p.invocationTime
+	if wait > budget {
+		return fmt.Errorf("%s of %s outlasts the %s a run can wait within %d invocations, shorten it or raise KARPENTER_MAX_INVOCATIONS", setting, wait, budget, p.maxInvocations)
+	}
+	return nil
+}
+
+// finalInvocation reports whether the run may not continue itself again.
+func (p *runProgress) finalInvocation() bool {
+	return p.invocation >= p.maxInvocations
+}
+
+// withStopBy returns a context that is cancelled when new work should no
+// longer be started, to bound waits.
+func (p *runProgress) withStopBy(ctx context.Context) (context.Context, context.CancelFunc) {
+	if p.stopBy.IsZero() {
+		return context.WithCancel(ctx)
+	}
+	return context.WithDeadline(ctx, p.stopBy)
+}
+
+func (p *runProgress) clusterDone(cluster string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.clusters[cluster]
+}
+
+func (p *runProgress) completeCluster(cluster string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clusters[cluster] = true
+	delete(p.nodePools, cluster)
+	delete(p.keptAwake, cluster)
+}
+
+// runID identifies the run across its invocations.
+func (p *runProgress) runID() string {
+	return p.startedAt.UTC().Format("20060102T150405Z")
+}
+
+// cluster returns the progress of one cluster, identified as region/name.
+func (p *runProgress) cluster(key string) *clusterProgress {
+	if p == nil {
+		return nil
+	}
+	return &clusterProgress{run: p, key: key}
+}
+
+// clusterProgress is the progress of one cluster within a run. A nil
+// clusterProgress tracks nothing and never runs out of time.
+type clusterProgress struct {
+	run *runProgress
+	key string
+}
+
+func (c *clusterProgress) outOfTime() bool {
+	return c != nil && c.run.outOfTime()
+}
+
+// startedAt is when the run started, now without a run.
+func (c *clusterProgress) finalInvocation() bool {
+	return c != nil && c.run.finalInvocation()
+}
+
+func (c *clusterProgress) startedAt() time.Time {
+	if c == nil {
+		return time.Now()
+	}
+	return c.run.startedAt
+}
+
+func (c *clusterProgress) withStopBy(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c == nil {
+		return context.WithCancel(ctx)
+	}
+	return c.run.withStopBy(ctx)
+}
+
+// done reports whether an earlier invocation already processed the nodepool.
+func (c *clusterProgress) done(nodePool string) bool {
+	if c == nil {
+		return false
+	}
+	c.run.mu.Lock()
+	defer c.run.mu.Unlock()
+	return c.run.nodePools[c.key][nodePool]
+}
+
+func (c *clusterProgress) complete(nodePool string) {
+	if c == nil {
+		return
+	}
+	c.run.mu.Lock()
+	defer c.run.mu.Unlock()
+	if c.run.nodePools[c.key] == nil {
+		c.run.nodePools[c.key] = map[string]bool{}
+	}
+	c.run.nodePools[c.key][nodePool] = true
+}
+
+// keepAwake records that a keep-awake annotation left the nodepool running,
+// for the invocation terminating the cluster's instances.
+func (c *clusterProgress) keepAwake(nodePool string) {
+	if c == nil {
+		return
+	}
+	c.run.mu.Lock()
+	defer c.run.mu.Unlock()
+	if c.run.keptAwake[c.key] == nil {
+		c.run.keptAwake[c.key] = map[string]bool{}
+	}
+	c.run.keptAwake[c.key][nodePool] = true
+}
+
+// keptAwake reports whether an invocation of the run kept the nodepool awake.
+func (c *clusterProgress) keptAwake(nodePool string) bool {
+	if c == nil {
+		return false
+	}
+	c.run.mu.Lock()
+	defer c.run.mu.Unlock()
+	return c.run.keptAwake[c.key][nodePool]
+}
+
+// keepsState reports whether nodepool snapshots are kept.
+func (c *clusterProgress) keepsState() bool {
+	return c != nil && c.run.store != nil
+}
+
+// saveSnapshot stores the snapshot under the cluster and run.
+func (c *clusterProgress) saveSnapshot(ctx context.Context, snapshot nodePoolSnapshot) error {
+	if !c.keepsState() {
+		return nil
+	}
+	snapshot.Cluster = c.key
+	snapshot.RunID = c.run.runID()
+	return c.run.store.saveSnapshot(ctx, snapshot)
+}
+
+// latestSnapshot returns the newest snapshot of the nodepool, or nil when
+// there is none or no state is kept.
+func (c *clusterProgress) latestSnapshot(ctx context.Context, nodePool string) (*nodePoolSnapshot, error) {
+	if !c.keepsState() {
+		return nil, nil
+	}
+	return c.run.store.latestSnapshot(ctx, c.key, nodePool)
+}
+
+// continuation checkpoints the progress for the next invocation.
+func (p *runProgress) continuation() *Continuation {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	c := &Continuation{StartedAt: p.startedAt, Invocation: p.invocation}
+	for cluster := range p.clusters {
+		c.Clusters = append(c.Clusters, cluster)
+	}
+	sort.Strings(c.Clusters)
+	for cluster, nodePools := range p.nodePools {
+		if c.NodePools == nil {
+			c.NodePools = map[string][]string{}
+		}
+		for name := range nodePools {
+			c.NodePools[cluster] = append(c.NodePools[cluster], name)
+		}
+		sort.Strings(c.NodePools[cluster])
+	}
+	for cluster, nodePools := range p.keptAwake {
+		if c.KeptAwake == nil {
+			c.KeptAwake = map[string][]string{}
+		}
+		for name := range nodePools {
+			c.KeptAwake[cluster] = append(c.KeptAwake[cluster], name)
+		}
+		sort.Strings(c.KeptAwake[cluster])
+	}
+	return c
+}
+
+type lambdaAPI interface {
+	Invoke(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error)
+}
+
+// newLambdaClient is swapped out in tests to avoid talking to AWS.
+var newLambdaClient = func(ctx context.Context) (lambdaAPI, error) {
+	cfg, err := loadAWSConfig(ctx, "", assumeRoleConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return awslambda.NewFromConfig(cfg), nil
+}
+
+// continueRun asynchronously invokes this function again to resume the run.
+// Outside Lambda, or with KARPENTER_SELF_CONTINUE=false, the continuation is
+// only returned in the result for the caller to pass back.
+func continueRun(ctx context.Context, action string, continuation *Continuation, maxInvocations int) (bool, error) {
+	functionName := os.Getenv("AWS_LAMBDA_FUNCTION_NAME")
+	if functionName == "" {
+		return false, nil
+	}
+	if value := os.Getenv("KARPENTER_SELF_CONTINUE"); value != "" {
+		enabled, err := strconv.ParseBool(value)
+		if err != nil {
+			return false, fmt.Errorf("invalid KARPENTER_SELF_CONTINUE %q", value)
+		}
+		if !enabled {
+			return false, nil
+		}
+	}
+	if continuation.Invocation >= maxInvocations {
+		return false, fmt.Errorf("run started at %s did not finish within %d invocations", continuation.StartedAt.Format(time.RFC3339), maxInvocations)
+	}
+
+	payload, err := json.Marshal(ActionEvent{Action: action, Continuation: continuation})
+	if err != nil {
+		return false, fmt.Errorf("failed to encode continuation: %v", err)
+	}
+
+	client, err := newLambdaClient(ctx)
+	if err != nil {
+		return false, err
+	}
+	_, err = client.Invoke(ctx, &awslambda.InvokeInput{
+		FunctionName:   aws.String(functionName),
+		InvocationType: lambdatypes.InvocationTypeEvent,
+		Payload:        payload,
+	})
+	if err != nil {
+		return false, fmt.Errorf("failed to invoke %s to continue the run: %v", functionName, err)
+	}
+
+	fmt.Printf("Continuing the run in invocation %d of %s\n", continuation.Invocation+1, functionName)
+	return true, nil
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	awslambda "github.com/aws/aws-sdk-go-v2/service/lambda"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+type fakeLambda struct {
+	inputs []*awslambda.InvokeInput
+}
+
+func (f *fakeLambda) Invoke(ctx context.Context, params *awslambda.InvokeInput, optFns ...func(*awslambda.Options)) (*awslambda.InvokeOutput, error) {
+	f.inputs = append(f.inputs, params)
+	return &awslambda.InvokeOutput{StatusCode: 202}, nil
+}
+
+func TestRunProgressDeadline(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Setenv("KARPENTER_DEADLINE_THRESHOLD", "30s")
+	progress, err := newRunProgress(ctx, nil)
+	require.NoError(t, err)
+	assert.True(t, progress.outOfTime())
+
+	t.Setenv("KARPENTER_DEADLINE_THRESHOLD", "1s")
+	progress, err = newRunProgress(ctx, nil)
+	require.NoError(t, err)
+	assert.False(t, progress.outOfTime())
+
+	// Without a deadline the run never runs out of time
+	progress, err = newRunProgress(context.Background(), nil)
+	require.NoError(t, err)
+	assert.False(t, progress.outOfTime())
+
+	t.Setenv("KARPENTER_DEADLINE_THRESHOLD", "soon")
+	_, err = newRunProgress(ctx, nil)
+	assert.ErrorContains(t, err, `invalid KARPENTER_DEADLINE_THRESHOLD "soon"`)
+}
+
+func TestRunProgressCheckWaits(t *testing.T) {
+	cfg := &Config{Clusters: []ClusterConfig{{
+		Name:      "dev",
+		NodePools: []NodePoolConfig{{Name: "default", NodePoolProfile: NodePoolProfile{Block: &BlockConfig{CutOff: "40m"}}}},
+	}}}
+
+	// Ten minutes per invocation leave nine invocations, 90m, to wait
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Minute+30*time.Second)
+	defer cancel()
+	t.Setenv("KARPENTER_DEADLINE_THRESHOLD", "30s")
+	progress, err := newRunProgress(ctx, nil)
+	require.NoError(t, err)
+	assert.NoError(t, progress.checkWaits(cfg))
+
+	t.Setenv("KARPENTER_MAX_INVOCATIONS", "4")
+	progress, err = newRunProgress(ctx, nil)
+	require.NoError(t, err)
+	assert.ErrorContains(t, progress.checkWaits(cfg), "cluster dev nodepool default block cutOff of 40m0s outlasts the 30m0s a run can wait within 4 invocations")
+
+	// A run that already started is not abandoned
+	progress, err = newRunProgress(ctx, &Continuation{StartedAt: time.Now(), Invocation: 1})
+	require.NoError(t, err)
+	assert.NoError(t, progress.checkWaits(cfg))
+
+	// Without a deadline there is no limit to check against
+	progress, err = newRunProgress(context.Background(), nil)
+	require.NoError(t, err)
+	assert.NoError(t, progress.checkWaits(cfg))
+
+	t.Setenv("KARPENTER_MAX_INVOCATIONS", "0")
+	_, err = newRunProgress(ctx, nil)
+	assert.ErrorContains(t, err, `invalid KARPENTER_MAX_INVOCATIONS "0"`)
+}
+
+func TestProcessNodePoolsDeferred(t *testing.T) {
+	client := newFakeClient(
+		newTestNodePool("system", map[string]interface{}{"cpu": "0"}),
+		newTestNodePool("app", map[string]interface{}{"cpu": "0"}),
+		newTestNodePool("batch", map[string]interface{}{"cpu": "0"}),
+	)
+	progress, err := newRunProgress(context.Background(), &Continuation{
+		Invocation: 1,
+		NodePools:  map[string][]string{"ap-southeast-2/dev": {"system"}},
+	})
+	require.NoError(t, err)
+
+	// The clock passes the stop time once the first nodepool has started
+	calls := 0
+	progress.stopBy = time.Unix(1, 0)
+	progress.now = func() time.Time {
+		calls++
+		return time.Unix(int64(calls-1), 0)
+	}
+
+	nodePools := []managedNodePool{{Name: "system"}, {Name: "app"}, {Name: "batch"}}
+	results, err := processNodePools(context.Background(), client, "startup", nodePools, 1, progress.cluster("ap-southeast-2/dev"))
+
+	assert.ErrorIs(t, err, errDeadline)
+	assert.Equal(t, []NodePoolResult{
+		{Name: "app", Status: nodePoolStatusUpdated},
+		{Name: "batch", Status: nodePoolStatusDeferred},
+	}, results)
+	assert.Equal(t, "0", getNodePoolLimits(t, client, "system")["cpu"])
+	assert.Equal(t, "0", getNodePoolLimits(t, client, "batch")["cpu"])
+	assert.Equal(t, map[string][]string{"ap-southeast-2/dev": {"app", "system"}}, progress.continuation().NodePools)
+}
+
+func TestHandlerContinuesWhenOutOfTime(t *testing.T) {
+	t.Setenv("AWS_REGION", "ap-southeast-2")
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "karpenter-ec2-instance-stop-start")
+	t.Setenv("KARPENTER_DEADLINE_THRESHOLD", "1m")
+	t.Setenv("KARPENTER_CLUSTERS", `{"clusters": [
+		{"name": "dev", "nodePools": ["default"]},
+		{"name": "test", "nodePools": ["default"]}
+	]}`)
+
+	clients := map[string]dynamic.Interface{
+		"dev":  newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": "0"})),
+		"test": newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": "0"})),
+	}
+	originalFactory := newClusterClient
+	newClusterClient = func(ctx context.Context, cluster ClusterConfig) (dynamic.Interface, error) {
+		return clients[cluster.Name], nil
+	}
+	defer func() { newClusterClient = originalFactory }()
+
+	invoker := &fakeLambda{}
+	originalLambda := newLambdaClient
+	newLambdaClient = func(ctx context.Context) (lambdaAPI, error) { return invoker, nil }
+	defer func() { newLambdaClient = originalLambda }()
+
+	// Less time left than the threshold, so nothing is started
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	result, err := handler(ctx, ActionEvent{Action: "startup", Continuation: &Continuation{
+		StartedAt:  time.Date(2025, 7, 1, 22, 0, 0, 0, time.UTC),
+		Invocation: 1,
+		Clusters:   []string{"ap-southeast-2/dev"},
+	}})
+
+	require.NoError(t, err)
+	assert.Empty(t, result.Clusters)
+	assert.True(t, result.Continued)
+	require.Len(t, invoker.inputs, 1)
+	assert.Equal(t, "karpenter-ec2-instance-stop-start", *invoker.inputs[0].FunctionName)
+
+	var next ActionEvent
+	require.NoError(t, json.Unmarshal(invoker.inputs[0].Payload, &next))
+	assert.Equal(t, "startup", next.Action)
+	assert.Equal(t, 2, next.Continuation.Invocation)
+	assert.Equal(t, []string{"ap-southeast-2/dev"}, next.Continuation.Clusters)
+
+	// The continuation resumes with the clusters not yet processed
+	result, err = handler(context.Background(), next)
+
+	require.NoError(t, err)
+	require.Len(t, result.Clusters, 1)
+	assert.Equal(t, "test", result.Clusters[0].Name)
+	assert.Nil(t, result.Continuation)
+	assert.Equal(t, "0", getNodePoolLimits(t, clients["dev"].(*fake.FakeDynamicClient), "default")["cpu"])
+}
+
+func TestContinueRunLimits(t *testing.T) {
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "")
+	continued, err := continueRun(context.Background(), "shutdown", &Continuation{Invocation: 1}, defaultMaxInvocations)
+	require.NoError(t, err)
+	assert.False(t, continued)
+
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "karpenter-ec2-instance-stop-start")
+	t.Setenv("KARPENTER_SELF_CONTINUE", "false")
+	continued, err = continueRun(context.Background(), "shutdown", &Continuation{Invocation: 1}, defaultMaxInvocations)
+	require.NoError(t, err)
+	assert.False(t, continued)
+
+	t.Setenv("KARPENTER_SELF_CONTINUE", "true")
+	_, err = continueRun(context.Background(), "shutdown", &Continuation{Invocation: defaultMaxInvocations}, defaultMaxInvocations)
+	assert.ErrorContains(t, err, "did not finish within 10 invocations")
+
+	_, err = continueRun(context.Background(), "shutdown", &Continuation{Invocation: 3}, 3)
+	assert.ErrorContains(t, err, "did not finish within 3 invocations")
+}
+
+func TestHandlerContinuedDoesNotFail(t *testing.T) {
+	t.Setenv("AWS_REGION", "ap-southeast-2")
+	t.Setenv("AWS_LAMBDA_FUNCTION_NAME", "karpenter-ec2-instance-stop-start")
+	t.Setenv("KARPENTER_DEADLINE_THRESHOLD", "1m")
+	t.Setenv("KARPENTER_CLUSTERS", `{"clusters": [
+		{"name": "dev", "nodePools": ["default"]},
+		{"name": "test", "nodePools": ["default"]}
+	]}`)
+
+	// The first cluster fails once the invocation has run out of time
+	originalFactory := newClusterClient
+	newClusterClient = func(ctx context.Context, cluster ClusterConfig) (dynamic.Interface, error) {
+		time.Sleep(300 * time.Millisecond)
+		return nil, errors.New("cluster unreachable")
+	}
+	defer func() { newClusterClient = originalFactory }()
+
+	invoker := &fakeLambda{}
+	originalLambda := newLambdaClient
+	newLambdaClient = func(ctx context.Context) (lambdaAPI, error) { return invoker, nil }
+	defer func() { newLambdaClient = originalLambda }()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute+200*time.Millisecond)
+	defer cancel()
+	result, err := handler(ctx, ActionEvent{Action: "shutdown"})
+
+	// A retry of this invocation would start a second chain of continuations
+	require.NoError(t, err)
+	assert.True(t, result.Continued)
+	assert.Len(t, invoker.inputs, 1)
+	require.Len(t, result.Clusters, 1)
+	assert.Contains(t, result.Clusters[0].Error, "cluster unreachable")
+}
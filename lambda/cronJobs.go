@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// suspendAnnotation holds a resource's spec.suspend from before shutdown.
+// Only resources suspended by shutdown carry it, so those suspended already
+// stay suspended on startup.
+const suspendAnnotation = "shutdown-schedule/suspend"
+
+var cronJobGVR = schema.GroupVersionResource{Group: "batch", Version: "v1", Resource: "cronjobs"}
+
+// cronJobStep suspends the CronJobs in scope on shutdown, so they do not
+// create pods that cannot be scheduled overnight, and resumes them on startup.
+type cronJobStep struct {
+	scope WorkloadConfig
+}
+
+func (s cronJobStep) shutdown(ctx context.Context, dynamicClient dynamic.Interface) ([]WorkloadResult, error) {
+	return applyToWorkloads(ctx, dynamicClient, s.scope, suspendResource, cronJobGVR)
+}
+
+func (s cronJobStep) startup(ctx context.Context, dynamicClient dynamic.Interface) ([]WorkloadResult, error) {
+	return applyToWorkloads(ctx, dynamicClient, s.scope, resumeResource, cronJobGVR)
+}
+
+// suspendResource sets spec.suspend, which CronJobs and Flux resources share.
+func suspendResource(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error) {
+	suspended, _, err := unstructured.NestedBool(item.Object, "spec", "suspend")
+	if err != nil {
+		return "", fmt.Errorf("failed to read suspend: %v", err)
+	}
+	if suspended {
+		return nodePoolStatusSkipped, nil
+	}
+
+	annotations := item.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[suspendAnnotation] = strconv.FormatBool(suspended)
+	item.SetAnnotations(annotations)
+	if err := unstructured.SetNestedField(item.Object, true, "spec", "suspend"); err != nil {
+		return "", fmt.Errorf("failed to set suspend: %v", err)
+	}
+	if _, err := resource.Update(ctx, &item, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update: %v", err)
+	}
+	fmt.Printf("Suspended %s %s/%s\n", item.GetKind(), item.GetNamespace(), item.GetName())
+	return nodePoolStatusUpdated, nil
+}
+
+func resumeResource(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error) {
+	annotations := item.GetAnnotations()
+	value, recorded := annotations[suspendAnnotation]
+	if !recorded {
+		return nodePoolStatusSkipped, nil
+	}
+	suspended, err := strconv.ParseBool(value)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s annotation %q", suspendAnnotation, value)
+	}
+
+	if err := unstructured.SetNestedField(item.Object, suspended, "spec", "suspend"); err != nil {
+		return "", fmt.Errorf("failed to set suspend: %v", err)
+	}
+	delete(annotations, suspendAnnotation)
+	item.SetAnnotations(annotations)
+	if _, err := resource.Update(ctx, &item, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update: %v", err)
+	}
+	fmt.Printf("Restored %s %s/%s to suspend %t\n", item.GetKind(), item.GetNamespace(), item.GetName(), suspended)
+	return nodePoolStatusUpdated, nil
+}
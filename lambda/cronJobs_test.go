@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func newTestCronJob(namespace, name string, suspended bool) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "batch/v1",
+			"kind":       "CronJob",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"schedule": "*/5 * * * *",
+				"suspend":  suspended,
+			},
+		},
+	}
+}
+
+func isSuspended(t *testing.T, client *fake.FakeDynamicClient, namespace, name string) bool {
+	suspended, _, err := unstructured.NestedBool(getWorkload(t, client, cronJobGVR, namespace, name).Object, "spec", "suspend")
+	require.NoError(t, err)
+	return suspended
+}
+
+func TestCronJobStep(t *testing.T) {
+	client := newFakeClient(
+		newTestCronJob("batch", "report", false),
+		newTestCronJob("batch", "disabled", true),
+		newTestCronJob("production", "billing", false),
+	)
+	step := cronJobStep{scope: WorkloadConfig{Namespaces: []string{"batch"}}}
+
+	results, err := step.shutdown(context.Background(), client)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []WorkloadResult{
+		{Kind: "CronJob", Namespace: "batch", Name: "report", Status: nodePoolStatusUpdated},
+		{Kind: "CronJob", Namespace: "batch", Name: "disabled", Status: nodePoolStatusSkipped},
+	}, results)
+	assert.True(t, isSuspended(t, client, "batch", "report"))
+	assert.False(t, isSuspended(t, client, "production", "billing"))
+
+	// A second shutdown keeps the recorded state
+	_, err = step.shutdown(context.Background(), client)
+	require.NoError(t, err)
+	assert.Equal(t, "false", getWorkload(t, client, cronJobGVR, "batch", "report").GetAnnotations()[suspendAnnotation])
+
+	_, err = step.startup(context.Background(), client)
+	require.NoError(t, err)
+	assert.False(t, isSuspended(t, client, "batch", "report"))
+	assert.NotContains(t, getWorkload(t, client, cronJobGVR, "batch", "report").GetAnnotations(), suspendAnnotation)
+	assert.True(t, isSuspended(t, client, "batch", "disabled"))
+}
@@ -5,17 +5,20 @@ import (
 	"fmt"
 
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
 	"k8s.io/apimachinery/pkg/runtime/schema"
 	"k8s.io/client-go/dynamic"
 )
 
-func deleteSpotNodeclaims(ctx context.Context, dynamicClient dynamic.Interface, nodePoolName string) error {
-	nodeClaimGVR := schema.GroupVersionResource{
-		Group:    "karpenter.sh",
-		Version:  "v1",
-		Resource: "nodeclaims",
-	}
+var nodeClaimGVR = schema.GroupVersionResource{
+	Group:    "karpenter.sh",
+	Version:  "v1",
+	Resource: "nodeclaims",
+}
 
+// deleteSpotNodeclaims deletes the nodepool's NodeClaims, except those of
+// the nodes in keep.
+func deleteSpotNodeclaims(ctx context.Context, dynamicClient dynamic.Interface, nodePoolName string, keep map[string]string) error {
 	labelSelector := fmt.Sprintf("karpenter.sh/nodepool=%s", nodePoolName)
 	listOptions := metav1.ListOptions{
 		LabelSelector: labelSelector,
@@ -35,6 +38,11 @@ func deleteSpotNodeclaims(ctx context.Context, dynamicClient dynamic.Interface,
 
 	for _, nodeclaim := range nodeClaimList.Items {
 		name := nodeclaim.GetName()
+		nodeName, _, _ := unstructured.NestedString(nodeclaim.Object, "status", "nodeName")
+		if _, ok := keep[nodeName]; ok {
+			fmt.Printf("Keeping nodeclaim %s of node %s\n", name, nodeName)
+			continue
+		}
 		fmt.Printf("Deleting nodeclaim: %s\n", name)
 
 		err := dynamicClient.Resource(nodeClaimGVR).Delete(ctx, name, metav1.DeleteOptions{})
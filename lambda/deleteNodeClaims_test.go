@@ -27,7 +27,7 @@ func TestDeleteSpotNodeclaimsNoItems(t *testing.T) {
 	var dynamicClient dynamic.Interface = fakeDynamicClient
 
 	nodePoolName := "test-pool"
-	err := deleteSpotNodeclaims(ctx, dynamicClient, nodePoolName)
+	err := deleteSpotNodeclaims(ctx, dynamicClient, nodePoolName, nil)
 
 	// Should succeed with no items to delete
 	assert.NoError(t, err)
@@ -68,7 +68,7 @@ func TestDeleteSpotNodeclaimsWithItems(t *testing.T) {
 	var dynamicClient dynamic.Interface = fakeDynamicClient
 
 	nodePoolName := "test-pool"
-	err := deleteSpotNodeclaims(ctx, dynamicClient, nodePoolName)
+	err := deleteSpotNodeclaims(ctx, dynamicClient, nodePoolName, nil)
 
 	// Should succeed
 	assert.NoError(t, err)
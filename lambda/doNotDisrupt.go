@@ -0,0 +1,150 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+)
+
+// doNotDisruptAnnotation marks pods Karpenter must not disrupt voluntarily.
+const doNotDisruptAnnotation = "karpenter.sh/do-not-disrupt"
+
+// Policies for nodes hosting do-not-disrupt pods on shutdown.
+const (
+	doNotDisruptOverride = "override"
+	doNotDisruptSkip     = "skip"
+	doNotDisruptDelay    = "delay"
+)
+
+// defaultDoNotDisruptDeadline bounds a delay that sets no deadline.
+const defaultDoNotDisruptDeadline = 30 * time.Minute
+
+// doNotDisruptPollInterval is how often a delay checks the protected pods.
+var doNotDisruptPollInterval = 30 * time.Second
+
+// protectedNodes maps the nodepool's nodes hosting a running pod annotated
+// karpenter.sh/do-not-disrupt to their EC2 instance IDs.
+func protectedNodes(ctx context.Context, dynamicClient dynamic.Interface, nodePoolName string) (map[string]string, error) {
+	labelSelector := fmt.Sprintf("karpenter.sh/nodepool=%s", nodePoolName)
+	nodeList, err := dynamicClient.Resource(nodeGVR).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list nodes with label selector %s: %v", labelSelector, err)
+	}
+	if len(nodeList.Items) == 0 {
+		return nil, nil
+	}
+
+	nodeNames := map[string]bool{}
+	instances := map[string]string{}
+	for _, node := range nodeList.Items {
+		nodeNames[node.GetName()] = true
+		providerID, _, _ := unstructured.NestedString(node.Object, "spec", "providerID")
+		instances[node.GetName()] = instanceIDFromProviderID(providerID)
+	}
+
+	pods, err := podsOnNodes(ctx, dynamicClient, nodeNames)
+	if err != nil {
+		return nil, err
+	}
+	protected := map[string]string{}
+	for _, pod := range pods {
+		phase, _, _ := unstructured.NestedString(pod.Object, "status", "phase")
+		if phase == "Succeeded" || phase == "Failed" || pod.GetAnnotations()[doNotDisruptAnnotation] != "true" {
+			continue
+		}
+		nodeName, _, _ := unstructured.NestedString(pod.Object, "spec", "nodeName")
+		protected[nodeName] = instances[nodeName]
+	}
+	return protected, nil
+}
+
+// applyDoNotDisruptPolicy returns the nodes the shutdown must leave alone.
+// With the skip policy those are the protected nodes. With the delay policy
+// it waits for the protected pods to finish, overriding them once the
+// deadline, counted from the start of the run, has passed; when the
+// invocation runs out of time first it returns errDeadline so a
+// continuation keeps waiting. The run's last invocation overrides them
+// instead, as no continuation would finish the shutdown.
+func applyDoNotDisruptPolicy(ctx context.Context, dynamicClient dynamic.Interface, np managedNodePool, progress *clusterProgress) (map[string]string, error) {
+	policy := np.DoNotDisrupt
+	if policy.Policy == "" || policy.Policy == doNotDisruptOverride {
+		return nil, nil
+	}
+
+	protected, err := protectedNodes(ctx, dynamicClient, np.Name)
+	if err != nil || len(protected) == 0 {
+		return nil, err
+	}
+	if policy.Policy == doNotDisruptSkip {
+		fmt.Printf("Leaving node(s) %s of nodepool %s running for their do-not-disrupt pods\n", nodeNameList(protected), np.Name)
+		return protected, nil
+	}
+
+	deadline := progress.startedAt().Add(policy.deadline())
+	fmt.Printf("Waiting until %s for do-not-disrupt pods on node(s) %s of nodepool %s\n", deadline.Format(time.RFC3339), nodeNameList(protected), np.Name)
+	waitCtx, cancel := progress.withStopBy(ctx)
+	defer cancel()
+	waitCtx, cancelDeadline := context.WithDeadline(waitCtx, deadline)
+	defer cancelDeadline()
+
+	err = wait.PollUntilContextCancel(waitCtx, doNotDisruptPollInterval, true, func(ctx context.Context) (bool, error) {
+		protected, err = protectedNodes(ctx, dynamicClient, np.Name)
+		return len(protected) == 0, err
+	})
+	switch {
+	case err == nil:
+		return nil, nil
+	case !wait.Interrupted(err):
+		return nil, err
+	case !time.Now().Before(deadline):
+		fmt.Printf("Deadline passed - shutting down node(s) %s of nodepool %s despite do-not-disrupt pods\n", nodeNameList(protected), np.Name)
+		return nil, nil
+	case progress.outOfTime() && progress.finalInvocation():
+		fmt.Printf("Last invocation of the run - shutting down node(s) %s of nodepool %s despite do-not-disrupt pods\n", nodeNameList(protected), np.Name)
+		return nil, nil
+	case progress.outOfTime():
+		return nil, errDeadline
+	}
+	return nil, ctx.Err()
+}
+
+func (c DoNotDisruptConfig) deadline() time.Duration {
+	if d, err := time.ParseDuration(c.Deadline); err == nil && c.Deadline != "" {
+		return d
+	}
+	return defaultDoNotDisruptDeadline
+}
+
+func nodeNameList(nodes map[string]string) string {
+	names := make([]string, 0, len(nodes))
+	for name := range nodes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// validateDoNotDisrupt checks a do-not-disrupt policy.
+func validateDoNotDisrupt(config *DoNotDisruptConfig) error {
+	if config == nil {
+		return nil
+	}
+	switch config.Policy {
+	case "", doNotDisruptOverride, doNotDisruptSkip, doNotDisruptDelay:
+	default:
+		return fmt.Errorf("doNotDisrupt: invalid policy %q, expected %s, %s or %s", config.Policy, doNotDisruptOverride, doNotDisruptSkip, doNotDisruptDelay)
+	}
+	if config.Deadline != "" {
+		if d, err := time.ParseDuration(config.Deadline); err != nil || d <= 0 {
+			return fmt.Errorf("doNotDisrupt: invalid deadline %q", config.Deadline)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,238 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func newTestProtectedNode(name, nodePoolName, instanceID string) *unstructured.Unstructured {
+	node := newTestNode(name, nodePoolName)
+	node.Object["spec"] = map[string]interface{}{"providerID": "aws:///ap-southeast-2a/" + instanceID}
+	return node
+}
+
+func newTestDoNotDisruptPod(namespace, name, nodeName string) *unstructured.Unstructured {
+	pod := newTestPod(namespace, name, nodeName)
+	pod.SetAnnotations(map[string]string{doNotDisruptAnnotation: "true"})
+	return pod
+}
+
+func newTestNodeClaimOnNode(name, nodePoolName, nodeName string) *unstructured.Unstructured {
+	nodeClaim := newTestNodeClaim(name, nodePoolName)
+	nodeClaim.Object["status"] = map[string]interface{}{"nodeName": nodeName}
+	return nodeClaim
+}
+
+func TestProtectedNodes(t *testing.T) {
+	finished := newTestDoNotDisruptPod("batch", "report-0", "node-2")
+	finished.Object["status"] = map[string]interface{}{"phase": "Succeeded"}
+
+	client := newFakeClient(
+		newTestProtectedNode("node-1", "batch", "i-0aaa"),
+		newTestProtectedNode("node-2", "batch", "i-0bbb"),
+		newTestProtectedNode("node-3", "batch", "i-0ccc"),
+		newTestProtectedNode("node-4", "other", "i-0ddd"),
+		newTestDoNotDisruptPod("batch", "report-1", "node-1"),
+		finished,
+		newTestPod("batch", "web-1", "node-3"),
+		newTestDoNotDisruptPod("batch", "report-2", "node-4"),
+	)
+
+	protected, err := protectedNodes(context.Background(), client, "batch")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"node-1": "i-0aaa"}, protected)
+}
+
+func TestShutdownSkipsDoNotDisruptNodes(t *testing.T) {
+	client := newFakeClient(
+		newTestNodePool("batch", map[string]interface{}{"cpu": "100"}),
+		newTestProtectedNode("node-1", "batch", "i-0aaa"),
+		newTestProtectedNode("node-2", "batch", "i-0bbb"),
+		newTestNodeClaimOnNode("batch-1", "batch", "node-1"),
+		newTestNodeClaimOnNode("batch-2", "batch", "node-2"),
+		newTestDoNotDisruptPod("batch", "report-1", "node-1"),
+	)
+
+	np := managedNodePool{Name: "batch", DeleteNodeClaims: true, Drain: true, DoNotDisrupt: DoNotDisruptConfig{Policy: doNotDisruptSkip}}
+	status, err := processNodePool(context.Background(), client, "shutdown", np, nil)
+	require.NoError(t, err)
+	assert.Equal(t, nodePoolStatusUpdated, status)
+
+	list, err := client.Resource(nodeClaimGVR).List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, list.Items, 1)
+	assert.Equal(t, "batch-1", list.Items[0].GetName())
+
+	node, err := client.Resource(nodeGVR).Get(context.Background(), "node-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	unschedulable, _, _ := unstructured.NestedBool(node.Object, "spec", "unschedulable")
+	assert.False(t, unschedulable)
+	assert.Equal(t, "0", getNodePoolLimits(t, client, "batch")["cpu"])
+}
+
+func TestShutdownOverridesDoNotDisruptByDefault(t *testing.T) {
+	client := newFakeClient(
+		newTestNodePool("batch", map[string]interface{}{"cpu": "100"}),
+		newTestProtectedNode("node-1", "batch", "i-0aaa"),
+		newTestNodeClaimOnNode("batch-1", "batch", "node-1"),
+		newTestDoNotDisruptPod("batch", "report-1", "node-1"),
+	)
+
+	_, err := processNodePool(context.Background(), client, "shutdown", managedNodePool{Name: "batch", DeleteNodeClaims: true}, nil)
+	require.NoError(t, err)
+
+	list, err := client.Resource(nodeClaimGVR).List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, list.Items)
+}
+
+func TestDoNotDisruptDelay(t *testing.T) {
+	originalInterval := doNotDisruptPollInterval
+	doNotDisruptPollInterval = time.Millisecond
+	defer func() { doNotDisruptPollInterval = originalInterval }()
+
+	newClient := func() *fake.FakeDynamicClient {
+		return newFakeClient(
+			newTestNodePool("batch", map[string]interface{}{"cpu": "100"}),
+			newTestProtectedNode("node-1", "batch", "i-0aaa"),
+			newTestNodeClaimOnNode("batch-1", "batch", "node-1"),
+			newTestDoNotDisruptPod("batch", "report-1", "node-1"),
+		)
+	}
+
+	t.Run("pods finish", func(t *testing.T) {
+		client := newClient()
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			_ = client.Resource(podGVR).Namespace("batch").Delete(context.Background(), "report-1", metav1.DeleteOptions{})
+		}()
+
+		np := managedNodePool{Name: "batch", DoNotDisrupt: DoNotDisruptConfig{Policy: doNotDisruptDelay}}
+		keep, err := applyDoNotDisruptPolicy(context.Background(), client, np, nil)
+		require.NoError(t, err)
+		assert.Empty(t, keep)
+	})
+
+	t.Run("deadline passes", func(t *testing.T) {
+		np := managedNodePool{Name: "batch", DoNotDisrupt: DoNotDisruptConfig{Policy: doNotDisruptDelay, Deadline: "10ms"}}
+		keep, err := applyDoNotDisruptPolicy(context.Background(), newClient(), np, nil)
+		require.NoError(t, err)
+		assert.Empty(t, keep)
+	})
+
+	t.Run("invocation runs out of time", func(t *testing.T) {
+		progress, err := newRunProgress(context.Background(), nil)
+		require.NoError(t, err)
+		progress.stopBy = time.Now()
+
+		np := managedNodePool{Name: "batch", DeleteNodeClaims: true, DoNotDisrupt: DoNotDisruptConfig{Policy: doNotDisruptDelay}}
+		client := newClient()
+		status, err := processNodePool(context.Background(), client, "shutdown", np, progress.cluster("ap-southeast-2/dev"))
+		assert.ErrorIs(t, err, errDeadline)
+		assert.Empty(t, status)
+
+		list, err := client.Resource(nodeClaimGVR).List(context.Background(), metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Len(t, list.Items, 1)
+	})
+
+	t.Run("last invocation runs out of time", func(t *testing.T) {
+		progress, err := newRunProgress(context.Background(), &Continuation{StartedAt: time.Now(), Invocation: defaultMaxInvocations - 1})
+		require.NoError(t, err)
+		progress.stopBy = time.Now()
+
+		np := managedNodePool{Name: "batch", DeleteNodeClaims: true, DoNotDisrupt: DoNotDisruptConfig{Policy: doNotDisruptDelay}}
+		client := newClient()
+		status, err := processNodePool(context.Background(), client, "shutdown", np, progress.cluster("ap-southeast-2/dev"))
+		require.NoError(t, err)
+		assert.Equal(t, nodePoolStatusUpdated, status)
+
+		list, err := client.Resource(nodeClaimGVR).List(context.Background(), metav1.ListOptions{})
+		require.NoError(t, err)
+		assert.Empty(t, list.Items)
+	})
+
+	t.Run("default deadline fits the run", func(t *testing.T) {
+		cfg := &Config{Clusters: []ClusterConfig{{Name: "dev", DoNotDisrupt: &DoNotDisruptConfig{Policy: doNotDisruptDelay}}}}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+		defer cancel()
+		progress, err := newRunProgress(ctx, nil)
+		require.NoError(t, err)
+		assert.NoError(t, progress.checkWaits(cfg))
+	})
+}
+
+func TestProcessClusterStagesWithSkipPolicy(t *testing.T) {
+	originalInterval := stagePollInterval
+	stagePollInterval = time.Millisecond
+	defer func() { stagePollInterval = originalInterval }()
+
+	client := newFakeClient(
+		newTestNodePool("batch", map[string]interface{}{"cpu": "100"}),
+		newTestNodePool("system", map[string]interface{}{"cpu": "100"}),
+		newTestProtectedNode("node-1", "batch", "i-0aaa"),
+		newTestNodeClaimOnNode("batch-1", "batch", "node-1"),
+		newTestNodeClaimOnNode("batch-2", "batch", "node-2"),
+		newTestDoNotDisruptPod("batch", "report-1", "node-1"),
+	)
+	originalFactory := newClusterClient
+	newClusterClient = func(ctx context.Context, cluster ClusterConfig) (dynamic.Interface, error) {
+		return client, nil
+	}
+	defer func() { newClusterClient = originalFactory }()
+
+	keep := false
+	cluster := ClusterConfig{
+		Name: "test-cluster",
+		NodePools: []NodePoolConfig{
+			{Name: "batch", NodePoolProfile: NodePoolProfile{TerminateInstances: &keep}},
+			{Name: "system", NodePoolProfile: NodePoolProfile{TerminateInstances: &keep}},
+		},
+		Stages:       []StageConfig{{Name: "system", NodePools: []string{"system"}}, {Name: "batch", NodePools: []string{"batch"}, Wait: true, Timeout: "50ms"}},
+		DoNotDisrupt: &DoNotDisruptConfig{Policy: doNotDisruptSkip},
+	}
+
+	// The kept NodeClaim does not hold up the wait for the batch stage
+	result, err := processCluster(context.Background(), "shutdown", cluster, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{
+		{Name: "batch", Status: nodePoolStatusUpdated},
+		{Name: "system", Status: nodePoolStatusUpdated},
+	}, result.NodePools)
+
+	list, err := client.Resource(nodeClaimGVR).List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	require.Len(t, list.Items, 1)
+	assert.Equal(t, "batch-1", list.Items[0].GetName())
+}
+
+func TestScaleKeepsDoNotDisruptNodeClaims(t *testing.T) {
+	now := time.Now()
+	protected := newSizedTestNodeClaim("large", "default", "spot", "16", now.Add(-time.Hour))
+	protected.Object["status"].(map[string]interface{})["nodeName"] = "node-1"
+	client := newFakeClient(
+		newTestNodePool("default", map[string]interface{}{"cpu": "100"}),
+		protected,
+		newSizedTestNodeClaim("small", "default", "spot", "4", now.Add(-2*time.Hour)),
+		newTestProtectedNode("node-1", "default", "i-0aaa"),
+		newTestDoNotDisruptPod("batch", "report-1", "node-1"),
+	)
+	cluster := ClusterConfig{
+		Name:         "test-cluster",
+		NodePools:    splitNodePools("default"),
+		Scale:        &ScaleConfig{Limits: map[string]string{"cpu": "8"}},
+		DoNotDisrupt: &DoNotDisruptConfig{Policy: doNotDisruptSkip},
+	}
+
+	_, err := processConfiguredNodePools(t, client, "scale", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"large"}, remainingNodeClaims(t, client))
+}
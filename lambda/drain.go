@@ -0,0 +1,152 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+var (
+	nodeGVR = schema.GroupVersionResource{Version: "v1", Resource: "nodes"}
+	podGVR  = schema.GroupVersionResource{Version: "v1", Resource: "pods"}
+)
+
+// cordonedAnnotation marks the nodes a drain cordoned, so that startup
+// uncordons them and leaves nodes cordoned by anyone else alone.
+const cordonedAnnotation = "shutdown-schedule/cordoned"
+
+// drainNodePool cordons every node of the nodepool and evicts its pods,
+// leaving DaemonSet and static pods in place. Evictions blocked by a
+// PodDisruptionBudget are logged and skipped rather than failing the run.
+// Nodes in keep are left untouched.
+func drainNodePool(ctx context.Context, dynamicClient dynamic.Interface, nodePoolName string, keep map[string]string) error {
+	labelSelector := fmt.Sprintf("karpenter.sh/nodepool=%s", nodePoolName)
+	nodeList, err := dynamicClient.Resource(nodeGVR).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return fmt.Errorf("failed to list nodes with label selector %s: %v", labelSelector, err)
+	}
+
+	if len(nodeList.Items) == 0 {
+		fmt.Printf("No nodes found with label selector: %s\n", labelSelector)
+		return nil
+	}
+
+	nodeNames := map[string]bool{}
+	for _, node := range nodeList.Items {
+		if _, ok := keep[node.GetName()]; ok {
+			continue
+		}
+		nodeNames[node.GetName()] = true
+
+		if unschedulable, _, _ := unstructured.NestedBool(node.Object, "spec", "unschedulable"); unschedulable {
+			continue
+		}
+		fmt.Printf("Cordoning node: %s\n", node.GetName())
+		if err := unstructured.SetNestedField(node.Object, true, "spec", "unschedulable"); err != nil {
+			return fmt.Errorf("failed to cordon node %s: %v", node.GetName(), err)
+		}
+		annotations := node.GetAnnotations()
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[cordonedAnnotation] = "true"
+		node.SetAnnotations(annotations)
+		if _, err := dynamicClient.Resource(nodeGVR).Update(ctx, &node, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to cordon node %s: %v", node.GetName(), err)
+		}
+	}
+
+	pods, err := podsOnNodes(ctx, dynamicClient, nodeNames)
+	if err != nil {
+		return err
+	}
+
+	for _, pod := range pods {
+		if !evictable(pod) {
+			continue
+		}
+
+		fmt.Printf("Evicting pod: %s/%s\n", pod.GetNamespace(), pod.GetName())
+		eviction := &unstructured.Unstructured{
+			Object: map[string]interface{}{
+				"apiVersion": "policy/v1",
+				"kind":       "Eviction",
+				"metadata": map[string]interface{}{
+					"name":      pod.GetName(),
+					"namespace": pod.GetNamespace(),
+				},
+			},
+		}
+		_, err := dynamicClient.Resource(podGVR).Namespace(pod.GetNamespace()).Create(ctx, eviction, metav1.CreateOptions{}, "eviction")
+		if err != nil {
+			fmt.Printf("Failed to evict pod %s/%s: %v\n", pod.GetNamespace(), pod.GetName(), err)
+		}
+	}
+
+	return nil
+}
+
+// uncordonNodePool uncordons the nodes of the nodepool that a drain
+// cordoned, as nodes kept through the night would otherwise stay
+// unschedulable.
+func uncordonNodePool(ctx context.Context, dynamicClient dynamic.Interface, nodePoolName string) error {
+	labelSelector := fmt.Sprintf("karpenter.sh/nodepool=%s", nodePoolName)
+	nodeList, err := dynamicClient.Resource(nodeGVR).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return fmt.Errorf("failed to list nodes with label selector %s: %v", labelSelector, err)
+	}
+
+	for _, node := range nodeList.Items {
+		annotations := node.GetAnnotations()
+		if _, ok := annotations[cordonedAnnotation]; !ok {
+			continue
+		}
+		fmt.Printf("Uncordoning node: %s\n", node.GetName())
+		unstructured.RemoveNestedField(node.Object, "spec", "unschedulable")
+		delete(annotations, cordonedAnnotation)
+		node.SetAnnotations(annotations)
+		if _, err := dynamicClient.Resource(nodeGVR).Update(ctx, &node, metav1.UpdateOptions{}); err != nil {
+			return fmt.Errorf("failed to uncordon node %s: %v", node.GetName(), err)
+		}
+	}
+	return nil
+}
+
+// podsOnNodes lists the pods scheduled on any of the given nodes.
+func podsOnNodes(ctx context.Context, dynamicClient dynamic.Interface, nodeNames map[string]bool) ([]unstructured.Unstructured, error) {
+	podList, err := dynamicClient.Resource(podGVR).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list pods: %v", err)
+	}
+
+	var pods []unstructured.Unstructured
+	for _, pod := range podList.Items {
+		nodeName, _, _ := unstructured.NestedString(pod.Object, "spec", "nodeName")
+		if nodeNames[nodeName] {
+			pods = append(pods, pod)
+		}
+	}
+	return pods, nil
+}
+
+// evictable skips pods that a drain leaves alone: finished pods, static
+// (mirror) pods and pods owned by a DaemonSet.
+func evictable(pod unstructured.Unstructured) bool {
+	phase, _, _ := unstructured.NestedString(pod.Object, "status", "phase")
+	if phase == "Succeeded" || phase == "Failed" {
+		return false
+	}
+	if _, ok := pod.GetAnnotations()["kubernetes.io/config.mirror"]; ok {
+		return false
+	}
+	for _, owner := range pod.GetOwnerReferences() {
+		if owner.Kind == "DaemonSet" {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestNode(name, nodePoolName string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Node",
+			"metadata": map[string]interface{}{
+				"name": name,
+				"labels": map[string]interface{}{
+					"karpenter.sh/nodepool": nodePoolName,
+				},
+			},
+		},
+	}
+}
+
+func newTestPod(namespace, name, nodeName string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "Pod",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"nodeName": nodeName,
+			},
+			"status": map[string]interface{}{
+				"phase": "Running",
+			},
+		},
+	}
+}
+
+func TestDrainNodePool(t *testing.T) {
+	daemonPod := newTestPod("kube-system", "aws-node-abc", "node-1")
+	daemonPod.SetOwnerReferences([]metav1.OwnerReference{{Kind: "DaemonSet", Name: "aws-node"}})
+
+	client := newFakeClient(
+		newTestNode("node-1", "default"),
+		newTestNode("node-2", "other"),
+		newTestPod("app", "web-1", "node-1"),
+		newTestPod("app", "web-2", "node-2"),
+		daemonPod,
+	)
+
+	var evicted []string
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "eviction" {
+			return false, nil, nil
+		}
+		eviction := action.(k8stesting.CreateAction).GetObject().(*unstructured.Unstructured)
+		evicted = append(evicted, eviction.GetNamespace()+"/"+eviction.GetName())
+		return true, eviction, nil
+	})
+
+	err := drainNodePool(context.Background(), client, "default", nil)
+
+	require.NoError(t, err)
+	assert.Equal(t, []string{"app/web-1"}, evicted)
+
+	node, err := client.Resource(nodeGVR).Get(context.Background(), "node-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	unschedulable, _, _ := unstructured.NestedBool(node.Object, "spec", "unschedulable")
+	assert.True(t, unschedulable)
+	assert.Equal(t, "true", node.GetAnnotations()[cordonedAnnotation])
+
+	node, err = client.Resource(nodeGVR).Get(context.Background(), "node-2", metav1.GetOptions{})
+	require.NoError(t, err)
+	unschedulable, _, _ = unstructured.NestedBool(node.Object, "spec", "unschedulable")
+	assert.False(t, unschedulable)
+}
+
+func TestUncordonNodePool(t *testing.T) {
+	cordonedByOthers := newTestNode("node-2", "default")
+	require.NoError(t, unstructured.SetNestedField(cordonedByOthers.Object, true, "spec", "unschedulable"))
+	client := newFakeClient(
+		newTestNode("node-1", "default"),
+		cordonedByOthers,
+		newTestPod("app", "web-1", "node-1"),
+	)
+	client.PrependReactor("create", "pods", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, nil
+	})
+
+	require.NoError(t, drainNodePool(context.Background(), client, "default", nil))
+	require.NoError(t, uncordonNodePool(context.Background(), client, "default"))
+
+	node, err := client.Resource(nodeGVR).Get(context.Background(), "node-1", metav1.GetOptions{})
+	require.NoError(t, err)
+	unschedulable, _, _ := unstructured.NestedBool(node.Object, "spec", "unschedulable")
+	assert.False(t, unschedulable)
+	assert.NotContains(t, node.GetAnnotations(), cordonedAnnotation)
+
+	// A node cordoned before the drain stays cordoned
+	node, err = client.Resource(nodeGVR).Get(context.Background(), "node-2", metav1.GetOptions{})
+	require.NoError(t, err)
+	unschedulable, _, _ = unstructured.NestedBool(node.Object, "spec", "unschedulable")
+	assert.True(t, unschedulable)
+}
+
+func TestDrainNodePoolNoNodes(t *testing.T) {
+	client := newFakeClient()
+
+	err := drainNodePool(context.Background(), client, "default", nil)
+
+	assert.NoError(t, err)
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
+)
+
+// tokenRefreshWindow is how long before expiry a cached EKS token is regenerated.
+const tokenRefreshWindow = 2 * time.Minute
+
+// eksTokenSource hands out aws-iam-authenticator tokens, regenerating them
+// shortly before they expire so long-running invocations keep working.
+type eksTokenSource struct {
+	gen  token.Generator
+	opts *token.GetTokenOptions
+	now  func() time.Time
+
+	mu  sync.Mutex
+	tok token.Token
+}
+
+func newEKSTokenSource(gen token.Generator, opts *token.GetTokenOptions) *eksTokenSource {
+	return &eksTokenSource{
+		gen:  gen,
+		opts: opts,
+		now:  time.Now,
+	}
+}
+
+// Token returns the cached token, or a new one if the cached token is missing
+// or within tokenRefreshWindow of its expiry.
+func (s *eksTokenSource) Token() (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.tok.Token != "" && s.now().Add(tokenRefreshWindow).Before(s.tok.Expiration) {
+		return s.tok.Token, nil
+	}
+
+	tok, err := s.gen.GetWithOptions(s.opts)
+	if err != nil {
+		return "", fmt.Errorf("error generating token: %w", err)
+	}
+	fmt.Printf("Generated EKS token for cluster %s, expires at %s\n", s.opts.ClusterID, tok.Expiration.Format(time.RFC3339))
+	s.tok = tok
+
+	return s.tok.Token, nil
+}
+
+// invalidate drops the cached token so the next request generates a new one.
+func (s *eksTokenSource) invalidate() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tok = token.Token{}
+}
+
+// wrapTransport is a rest.Config WrapTransport that authenticates every
+// request with a current token from the source.
+func (s *eksTokenSource) wrapTransport(rt http.RoundTripper) http.RoundTripper {
+	return &bearerTokenRoundTripper{source: s, next: rt}
+}
+
+type bearerTokenRoundTripper struct {
+	source *eksTokenSource
+	next   http.RoundTripper
+}
+
+func (rt *bearerTokenRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	tok, err := rt.source.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	// RoundTrippers must not modify the caller's request
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Bearer "+tok)
+
+	resp, err := rt.next.RoundTrip(req)
+	if err == nil && resp.StatusCode == http.StatusUnauthorized {
+		// The API server rejected the token (clock skew, revoked session, ...),
+		// make sure the next request does not reuse it
+		rt.source.invalidate()
+	}
+	return resp, err
+}
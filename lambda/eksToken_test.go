@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sigs.k8s.io/aws-iam-authenticator/pkg/token"
+)
+
+// fakeTokenGenerator issues sequentially numbered tokens valid for 15 minutes.
+type fakeTokenGenerator struct {
+	now   func() time.Time
+	calls int
+}
+
+func (g *fakeTokenGenerator) GetWithOptions(options *token.GetTokenOptions) (token.Token, error) {
+	g.calls++
+	return token.Token{
+		Token:      fmt.Sprintf("token-%d", g.calls),
+		Expiration: g.now().Add(15 * time.Minute),
+	}, nil
+}
+
+func (g *fakeTokenGenerator) GetWithSTS(clusterID string, stsAPI stsiface.STSAPI) (token.Token, error) {
+	return g.GetWithOptions(&token.GetTokenOptions{ClusterID: clusterID})
+}
+
+func (g *fakeTokenGenerator) FormatJSON(token.Token) string {
+	return ""
+}
+
+func TestEKSTokenSourceCachesUntilRefreshWindow(t *testing.T) {
+	now := time.Date(2025, 7, 1, 22, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	gen := &fakeTokenGenerator{now: clock}
+
+	source := newEKSTokenSource(gen, &token.GetTokenOptions{ClusterID: "test-cluster"})
+	source.now = clock
+
+	tok, err := source.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", tok)
+
+	// Well within the token lifetime - reuse the cached token
+	now = now.Add(10 * time.Minute)
+	tok, err = source.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-1", tok)
+
+	// Inside the refresh window - generate a new one
+	now = now.Add(4 * time.Minute)
+	tok, err = source.Token()
+	require.NoError(t, err)
+	assert.Equal(t, "token-2", tok)
+	assert.Equal(t, 2, gen.calls)
+}
+
+func TestBearerTokenRoundTripperSetsAuthorization(t *testing.T) {
+	var seen []string
+	status := http.StatusOK
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, r.Header.Get("Authorization"))
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	gen := &fakeTokenGenerator{now: time.Now}
+	source := newEKSTokenSource(gen, &token.GetTokenOptions{ClusterID: "test-cluster"})
+	client := &http.Client{Transport: source.wrapTransport(http.DefaultTransport)}
+
+	resp, err := client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	// An unauthorized response drops the cached token
+	status = http.StatusUnauthorized
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	status = http.StatusOK
+	resp, err = client.Get(server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{"Bearer token-1", "Bearer token-1", "Bearer token-2"}, seen)
+}
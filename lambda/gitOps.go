@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/dynamic"
+)
+
+// automatedAnnotation holds an Argo CD Application's
+// spec.syncPolicy.automated from before shutdown, as JSON.
+const automatedAnnotation = "shutdown-schedule/automated"
+
+// Default namespaces of GitOps resources named without one.
+const (
+	defaultArgoCDNamespace = "argocd"
+	defaultFluxNamespace   = "flux-system"
+)
+
+var (
+	argoApplicationGVR   = schema.GroupVersionResource{Group: "argoproj.io", Version: "v1alpha1", Resource: "applications"}
+	fluxKustomizationGVR = schema.GroupVersionResource{Group: "kustomize.toolkit.fluxcd.io", Version: "v1", Resource: "kustomizations"}
+	fluxHelmReleaseGVR   = schema.GroupVersionResource{Group: "helm.toolkit.fluxcd.io", Version: "v2", Resource: "helmreleases"}
+)
+
+// gitOpsStep stops Argo CD and Flux from reverting the night's changes from
+// Git. It runs first on shutdown and last on startup, once the nodepools and
+// workloads are restored.
+type gitOpsStep struct {
+	config GitOpsConfig
+}
+
+func (s gitOpsStep) shutdown(ctx context.Context, dynamicClient dynamic.Interface) ([]WorkloadResult, error) {
+	return s.apply(ctx, dynamicClient, disableAutoSync, suspendResource)
+}
+
+func (s gitOpsStep) startup(ctx context.Context, dynamicClient dynamic.Interface) ([]WorkloadResult, error) {
+	return s.apply(ctx, dynamicClient, restoreAutoSync, resumeResource)
+}
+
+func (s gitOpsStep) apply(ctx context.Context, dynamicClient dynamic.Interface, argo, flux func(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error)) ([]WorkloadResult, error) {
+	var results []WorkloadResult
+	var errs []error
+	for _, target := range []struct {
+		gvr       schema.GroupVersionResource
+		kind      string
+		names     []string
+		namespace string
+		apply     func(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error)
+	}{
+		{argoApplicationGVR, "Application", s.config.ArgoCDApplications, defaultArgoCDNamespace, argo},
+		{fluxKustomizationGVR, "Kustomization", s.config.FluxKustomizations, defaultFluxNamespace, flux},
+		{fluxHelmReleaseGVR, "HelmRelease", s.config.FluxHelmReleases, defaultFluxNamespace, flux},
+	} {
+		for _, ref := range target.names {
+			namespace, name := splitResourceRef(ref, target.namespace)
+			resource := dynamicClient.Resource(target.gvr).Namespace(namespace)
+			item, err := resource.Get(ctx, name, metav1.GetOptions{})
+			if err != nil {
+				err = fmt.Errorf("failed to get: %v", err)
+				results = append(results, WorkloadResult{Kind: target.kind, Namespace: namespace, Name: name, Status: nodePoolStatusFailed, Error: err.Error()})
+				errs = append(errs, fmt.Errorf("%s %s/%s: %v", target.kind, namespace, name, err))
+				continue
+			}
+			status, err := target.apply(ctx, resource, *item)
+			results = append(results, workloadResult(*item, status, err))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %s/%s: %v", target.kind, namespace, name, err))
+			}
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// splitResourceRef splits "namespace/name", using defaultNamespace for a plain name.
+func splitResourceRef(ref, defaultNamespace string) (string, string) {
+	if namespace, name, ok := strings.Cut(ref, "/"); ok {
+		return namespace, name
+	}
+	return defaultNamespace, ref
+}
+
+// disableAutoSync removes the Application's automated sync policy, keeping
+// it in the automatedAnnotation.
+func disableAutoSync(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error) {
+	automated, found, err := unstructured.NestedMap(item.Object, "spec", "syncPolicy", "automated")
+	if err != nil {
+		return "", fmt.Errorf("failed to read syncPolicy: %v", err)
+	}
+	if !found {
+		return nodePoolStatusSkipped, nil
+	}
+
+	data, err := json.Marshal(automated)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode syncPolicy: %v", err)
+	}
+	annotations := item.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[automatedAnnotation] = string(data)
+	item.SetAnnotations(annotations)
+	unstructured.RemoveNestedField(item.Object, "spec", "syncPolicy", "automated")
+	if _, err := resource.Update(ctx, &item, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update: %v", err)
+	}
+	fmt.Printf("Disabled auto-sync of Application %s/%s\n", item.GetNamespace(), item.GetName())
+	return nodePoolStatusUpdated, nil
+}
+
+func restoreAutoSync(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error) {
+	annotations := item.GetAnnotations()
+	value, recorded := annotations[automatedAnnotation]
+	if !recorded {
+		return nodePoolStatusSkipped, nil
+	}
+	var automated map[string]interface{}
+	if err := utiljson.Unmarshal([]byte(value), &automated); err != nil {
+		return "", fmt.Errorf("invalid %s annotation: %v", automatedAnnotation, err)
+	}
+
+	if err := unstructured.SetNestedMap(item.Object, automated, "spec", "syncPolicy", "automated"); err != nil {
+		return "", fmt.Errorf("failed to set syncPolicy: %v", err)
+	}
+	delete(annotations, automatedAnnotation)
+	item.SetAnnotations(annotations)
+	if _, err := resource.Update(ctx, &item, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update: %v", err)
+	}
+	fmt.Printf("Re-enabled auto-sync of Application %s/%s\n", item.GetNamespace(), item.GetName())
+	return nodePoolStatusUpdated, nil
+}
+
+// validateGitOps checks that a GitOps setting names at least one resource
+// and that the names are well formed.
+func validateGitOps(gitOps *GitOpsConfig) error {
+	if gitOps == nil {
+		return nil
+	}
+	refs := append(append(append([]string(nil), gitOps.ArgoCDApplications...), gitOps.FluxKustomizations...), gitOps.FluxHelmReleases...)
+	if len(refs) == 0 {
+		return fmt.Errorf("gitOps needs argoCDApplications, fluxKustomizations or fluxHelmReleases")
+	}
+	for _, ref := range refs {
+		namespace, name := splitResourceRef(ref, "default")
+		if namespace == "" || name == "" || strings.Contains(name, "/") {
+			return fmt.Errorf("gitOps: invalid name %q, expected name or namespace/name", ref)
+		}
+	}
+	return nil
+}
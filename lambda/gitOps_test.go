@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+func newTestGitOpsResource(apiVersion, kind, namespace, name string, spec map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": apiVersion,
+			"kind":       kind,
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": spec,
+		},
+	}
+}
+
+func TestGitOpsStep(t *testing.T) {
+	automated := map[string]interface{}{"prune": true, "selfHeal": true}
+	client := newFakeClient(
+		newTestGitOpsResource("argoproj.io/v1alpha1", "Application", "argocd", "karpenter", map[string]interface{}{
+			"syncPolicy": map[string]interface{}{"automated": automated},
+		}),
+		newTestGitOpsResource("argoproj.io/v1alpha1", "Application", "argocd", "manual", map[string]interface{}{}),
+		newTestGitOpsResource("kustomize.toolkit.fluxcd.io/v1", "Kustomization", "flux-system", "nodepools", map[string]interface{}{"suspend": false}),
+		newTestGitOpsResource("helm.toolkit.fluxcd.io/v2", "HelmRelease", "platform", "karpenter", map[string]interface{}{}),
+	)
+	step := gitOpsStep{config: GitOpsConfig{
+		ArgoCDApplications: []string{"karpenter", "manual"},
+		FluxKustomizations: []string{"nodepools"},
+		FluxHelmReleases:   []string{"platform/karpenter"},
+	}}
+
+	results, err := step.shutdown(context.Background(), client)
+	require.NoError(t, err)
+	assert.Equal(t, []WorkloadResult{
+		{Kind: "Application", Namespace: "argocd", Name: "karpenter", Status: nodePoolStatusUpdated},
+		{Kind: "Application", Namespace: "argocd", Name: "manual", Status: nodePoolStatusSkipped},
+		{Kind: "Kustomization", Namespace: "flux-system", Name: "nodepools", Status: nodePoolStatusUpdated},
+		{Kind: "HelmRelease", Namespace: "platform", Name: "karpenter", Status: nodePoolStatusUpdated},
+	}, results)
+
+	application := getWorkload(t, client, argoApplicationGVR, "argocd", "karpenter")
+	_, found, _ := unstructured.NestedMap(application.Object, "spec", "syncPolicy", "automated")
+	assert.False(t, found)
+	suspended, _, _ := unstructured.NestedBool(getWorkload(t, client, fluxHelmReleaseGVR, "platform", "karpenter").Object, "spec", "suspend")
+	assert.True(t, suspended)
+
+	_, err = step.startup(context.Background(), client)
+	require.NoError(t, err)
+	application = getWorkload(t, client, argoApplicationGVR, "argocd", "karpenter")
+	restored, _, _ := unstructured.NestedMap(application.Object, "spec", "syncPolicy", "automated")
+	assert.Equal(t, automated, restored)
+	assert.NotContains(t, application.GetAnnotations(), automatedAnnotation)
+	suspended, _, _ = unstructured.NestedBool(getWorkload(t, client, fluxKustomizationGVR, "flux-system", "nodepools").Object, "spec", "suspend")
+	assert.False(t, suspended)
+}
+
+func TestGitOpsStepMissingResource(t *testing.T) {
+	client := newFakeClient()
+	step := gitOpsStep{config: GitOpsConfig{ArgoCDApplications: []string{"missing"}}}
+
+	results, err := step.shutdown(context.Background(), client)
+	assert.ErrorContains(t, err, "Application argocd/missing: failed to get")
+	require.Len(t, results, 1)
+	assert.Equal(t, nodePoolStatusFailed, results[0].Status)
+}
+
+func TestProcessClusterScaleSuspendsGitOps(t *testing.T) {
+	automated := map[string]interface{}{"selfHeal": true}
+	client := newFakeClient(
+		newTestNodePool("default", map[string]interface{}{"cpu": "40"}),
+		newTestGitOpsResource("argoproj.io/v1alpha1", "Application", "argocd", "karpenter", map[string]interface{}{
+			"syncPolicy": map[string]interface{}{"automated": automated},
+		}),
+		newTestGitOpsResource("kustomize.toolkit.fluxcd.io/v1", "Kustomization", "flux-system", "nodepools", map[string]interface{}{"suspend": true}),
+		newTestWorkload("Deployment", "preview", "web", 3, nil),
+	)
+	originalFactory := newClusterClient
+	newClusterClient = func(ctx context.Context, cluster ClusterConfig) (dynamic.Interface, error) {
+		return client, nil
+	}
+	defer func() { newClusterClient = originalFactory }()
+
+	cluster := ClusterConfig{
+		Name:      "test-cluster",
+		NodePools: splitNodePools("default"),
+		Scale:     &ScaleConfig{Fraction: "10%"},
+		GitOps:    &GitOpsConfig{ArgoCDApplications: []string{"karpenter"}, FluxKustomizations: []string{"nodepools"}},
+		Workloads: &WorkloadConfig{Namespaces: []string{"preview"}},
+	}
+
+	result, err := processCluster(context.Background(), "scale", cluster, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []WorkloadResult{
+		{Kind: "Application", Namespace: "argocd", Name: "karpenter", Status: nodePoolStatusUpdated},
+		{Kind: "Kustomization", Namespace: "flux-system", Name: "nodepools", Status: nodePoolStatusSkipped},
+	}, result.Workloads)
+	_, found, _ := unstructured.NestedMap(getWorkload(t, client, argoApplicationGVR, "argocd", "karpenter").Object, "spec", "syncPolicy", "automated")
+	assert.False(t, found)
+	// Only the GitOps step runs, the workloads keep their nodes
+	assert.Equal(t, int64(3), getReplicas(t, client, deploymentGVR, "preview", "web"))
+
+	_, err = processCluster(context.Background(), "startup", cluster, nil)
+	require.NoError(t, err)
+	restored, _, _ := unstructured.NestedMap(getWorkload(t, client, argoApplicationGVR, "argocd", "karpenter").Object, "spec", "syncPolicy", "automated")
+	assert.Equal(t, automated, restored)
+	// The Kustomization suspended before the night stays suspended
+	suspended, _, _ := unstructured.NestedBool(getWorkload(t, client, fluxKustomizationGVR, "flux-system", "nodepools").Object, "spec", "suspend")
+	assert.True(t, suspended)
+	assert.Equal(t, int64(3), getReplicas(t, client, deploymentGVR, "preview", "web"))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// Annotations teams set on a NodePool to keep it running overnight.
+const (
+	// skipUntilAnnotation holds an RFC3339 time until which the night
+	// actions leave the nodepool alone
+	skipUntilAnnotation = "shutdown-schedule/skip-until"
+	// skipNextAnnotation set to "true" skips the next night action only
+	skipNextAnnotation = "shutdown-schedule/skip-next"
+)
+
+// keepAwake reports whether the nodepool's annotations keep it running
+// through the night action. A skip-next override is consumed by removing
+// it from the nodepool, an invalid skip-until is logged and ignored.
+func keepAwake(ctx context.Context, dynamicClient dynamic.Interface, nodePool *unstructured.Unstructured) (bool, error) {
+	annotations := nodePool.GetAnnotations()
+	name := nodePool.GetName()
+
+	if value, ok := annotations[skipUntilAnnotation]; ok {
+		until, err := time.Parse(time.RFC3339, value)
+		switch {
+		case err != nil:
+			fmt.Printf("Ignoring invalid %s annotation %q on nodepool %s: %v\n", skipUntilAnnotation, value, name, err)
+		case time.Now().Before(until):
+			fmt.Printf("Keeping nodepool %s awake until %s as annotated\n", name, until.Format(time.RFC3339))
+			return true, nil
+		}
+	}
+
+	if annotations[skipNextAnnotation] != "true" {
+		return false, nil
+	}
+	fmt.Printf("Keeping nodepool %s awake tonight as annotated, clearing %s\n", name, skipNextAnnotation)
+	delete(annotations, skipNextAnnotation)
+	nodePool.SetAnnotations(annotations)
+	if _, err := dynamicClient.Resource(nodePoolGVR).Update(ctx, nodePool, metav1.UpdateOptions{}); err != nil {
+		return false, fmt.Errorf("failed to clear %s of nodepool %s: %v", skipNextAnnotation, name, err)
+	}
+	return true, nil
+}
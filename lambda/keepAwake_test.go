@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+// newKeepAwakeTestCluster returns a cluster with nodepools default, carrying
+// the given annotations, and other, plus a Deployment preview/web with 3
+// replicas managed by the workload steps.
+func newKeepAwakeTestCluster(t *testing.T, annotations map[string]string) (*fake.FakeDynamicClient, ClusterConfig) {
+	nodePool := newTestNodePool("default", map[string]interface{}{"cpu": "100"})
+	nodePool.SetAnnotations(annotations)
+	client := newFakeClient(
+		nodePool,
+		newTestNodePool("other", map[string]interface{}{"cpu": "100"}),
+		newTestWorkload("Deployment", "preview", "web", 3, nil),
+	)
+	originalFactory := newClusterClient
+	newClusterClient = func(ctx context.Context, cluster ClusterConfig) (dynamic.Interface, error) {
+		return client, nil
+	}
+	t.Cleanup(func() { newClusterClient = originalFactory })
+
+	keep := false
+	return client, ClusterConfig{
+		Name: "test-cluster",
+		NodePools: []NodePoolConfig{
+			{Name: "default", NodePoolProfile: NodePoolProfile{TerminateInstances: &keep}},
+			{Name: "other", NodePoolProfile: NodePoolProfile{TerminateInstances: &keep}},
+		},
+		Workloads: &WorkloadConfig{Namespaces: []string{"preview"}},
+	}
+}
+
+func TestKeepAwakeSkipUntil(t *testing.T) {
+	tests := []struct {
+		name             string
+		skipUntil        string
+		expectedStatus   string
+		expectedCPU      string
+		expectedReplicas int64
+	}{
+		{"future", time.Now().Add(time.Hour).Format(time.RFC3339), nodePoolStatusKeptAwake, "100", 3},
+		{"past", time.Now().Add(-time.Hour).Format(time.RFC3339), nodePoolStatusUpdated, "0", 0},
+		{"invalid", "tomorrow", nodePoolStatusUpdated, "0", 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, cluster := newKeepAwakeTestCluster(t, map[string]string{skipUntilAnnotation: tt.skipUntil})
+
+			result, err := processCluster(context.Background(), "shutdown", cluster, nil)
+			require.NoError(t, err)
+			assert.Equal(t, []NodePoolResult{
+				{Name: "default", Status: tt.expectedStatus},
+				{Name: "other", Status: nodePoolStatusUpdated},
+			}, result.NodePools)
+			assert.Equal(t, tt.expectedCPU, getNodePoolLimits(t, client, "default")["cpu"])
+			assert.Equal(t, "0", getNodePoolLimits(t, client, "other")["cpu"])
+			assert.Equal(t, tt.expectedReplicas, getReplicas(t, client, deploymentGVR, "preview", "web"))
+		})
+	}
+}
+
+func TestKeepAwakeSkipNext(t *testing.T) {
+	client, cluster := newKeepAwakeTestCluster(t, map[string]string{skipNextAnnotation: "true"})
+
+	// Startup leaves the override for the night
+	_, err := processCluster(context.Background(), "startup", cluster, nil)
+	require.NoError(t, err)
+
+	result, err := processCluster(context.Background(), "scale", cluster, nil)
+	require.NoError(t, err)
+	assert.Equal(t, nodePoolStatusKeptAwake, result.NodePools[0].Status)
+
+	updated, err := client.Resource(nodePoolGVR).Get(context.Background(), "default", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, updated.GetAnnotations(), skipNextAnnotation)
+
+	result, err = processCluster(context.Background(), "shutdown", cluster, nil)
+	require.NoError(t, err)
+	assert.Equal(t, NodePoolResult{Name: "default", Status: nodePoolStatusUpdated}, result.NodePools[0])
+	assert.Equal(t, "0", getNodePoolLimits(t, client, "default")["cpu"])
+	assert.Equal(t, int64(0), getReplicas(t, client, deploymentGVR, "preview", "web"))
+}
+
+func TestKeptAwakeCarriedByContinuation(t *testing.T) {
+	client, cluster := newKeepAwakeTestCluster(t, map[string]string{skipNextAnnotation: "true"})
+
+	progress, err := newRunProgress(context.Background(), nil)
+	require.NoError(t, err)
+	_, err = processCluster(context.Background(), "shutdown", cluster, progress.cluster("ap-southeast-2/test-cluster"))
+	require.NoError(t, err)
+
+	continuation := progress.continuation()
+	assert.Equal(t, map[string][]string{"ap-southeast-2/test-cluster": {"default"}}, continuation.KeptAwake)
+
+	// The skip-next annotation is consumed, so only the continuation keeps
+	// the nodepool and the workloads running in the next invocation
+	resumed, err := newRunProgress(context.Background(), continuation)
+	require.NoError(t, err)
+	result, err := processCluster(context.Background(), "shutdown", cluster, resumed.cluster("ap-southeast-2/test-cluster"))
+	require.NoError(t, err)
+	assert.Equal(t, nodePoolStatusKeptAwake, result.NodePools[0].Status)
+	assert.Equal(t, "100", getNodePoolLimits(t, client, "default")["cpu"])
+	assert.Equal(t, int64(3), getReplicas(t, client, deploymentGVR, "preview", "web"))
+
+	nodePools := []managedNodePool{{Name: "default"}, {Name: "other"}}
+	assert.Equal(t, []managedNodePool{{Name: "other"}}, withoutKeptRunning(nodePools, nil, resumed.cluster("ap-southeast-2/test-cluster")))
+}
@@ -2,108 +2,85 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"os"
-	"strings"
 
 	"github.com/aws/aws-lambda-go/lambda"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
-	"k8s.io/apimachinery/pkg/runtime/schema"
 )
 
 type ActionEvent struct {
 	Action string `json:"Action"`
+	// Continuation resumes a run that ran out of time
+	Continuation *Continuation `json:"Continuation,omitempty"`
 }
 
-func handler(ctx context.Context, request ActionEvent) error {
+func handler(ctx context.Context, request ActionEvent) (RunResult, error) {
 	fmt.Printf("ctx: %v", ctx)
 	fmt.Printf("Requested action: %s", request.Action)
 
-	nodePoolsStr := os.Getenv("KARPENTER_NODEPOOLS")
-	if nodePoolsStr == "" {
-		return fmt.Errorf("KARPENTER_NODEPOOLS environment variable not set")
-	}
-
-	// Parse comma-separated list of nodepools
-	nodePoolNames := strings.Split(nodePoolsStr, ",")
-	for i := range nodePoolNames {
-		nodePoolNames[i] = strings.TrimSpace(nodePoolNames[i])
+	cfg, err := loadConfig(ctx)
+	if err != nil {
+		return RunResult{}, err
 	}
 
-	fmt.Printf("Processing nodepools: %v\n", nodePoolNames)
-
-	dynamicClient, err := newDynamicClient(ctx)
+	progress, err := newRunProgress(ctx, request.Continuation)
 	if err != nil {
-		return fmt.Errorf("failed to create dynamic client: %v", err)
+		return RunResult{}, err
 	}
-
-	// common const setup
-	nodePoolGVR := schema.GroupVersionResource{
-		Group:    "karpenter.sh",
-		Version:  "v1",
-		Resource: "nodepools",
+	if err := progress.checkWaits(cfg); err != nil {
+		return RunResult{}, err
+	}
+	if progress.store, err = newStateStore(ctx); err != nil {
+		return RunResult{}, err
 	}
 
-	// Process each nodepool
-	for _, nodePoolName := range nodePoolNames {
-		if nodePoolName == "" {
+	// Clusters are isolated from each other - a failure in one is recorded
+	// and the remaining clusters are still processed
+	result := RunResult{Action: request.Action}
+	var errs []error
+	deferred := false
+	for _, cluster := range cfg.Clusters {
+		if progress.clusterDone(cluster.key()) {
+			fmt.Printf("Cluster %s was processed by an earlier invocation\n", cluster.Name)
 			continue
 		}
-
-		fmt.Printf("\n=== Processing nodepool: %s ===\n", nodePoolName)
-
-		np, err := dynamicClient.Resource(nodePoolGVR).Get(ctx, nodePoolName, metav1.GetOptions{})
+		if progress.outOfTime() {
+			deferred = true
+			break
+		}
+		fmt.Printf("\n##### Processing cluster: %s #####\n", cluster.Name)
+
+		clusterResult, err := processCluster(ctx, request.Action, cluster, progress.cluster(cluster.key()))
+		result.Clusters = append(result.Clusters, clusterResult)
+		if errors.Is(err, errDeadline) {
+			fmt.Printf("Deferring the rest of cluster %s: %v\n", cluster.Name, err)
+			deferred = true
+			break
+		}
 		if err != nil {
-			return fmt.Errorf("failed to get nodepool %s: %v", nodePoolName, err)
+			fmt.Printf("Failed to process cluster %s: %v\n", cluster.Name, err)
+			result.Clusters[len(result.Clusters)-1].Error = err.Error()
+			errs = append(errs, fmt.Errorf("cluster %s: %w", cluster.Name, err))
 		}
+		progress.completeCluster(cluster.key())
+	}
 
-		switch request.Action {
-		case "shutdown":
-			fmt.Printf("Simulating scaling down nodepool %s\n", nodePoolName)
-			err = unstructured.SetNestedField(np.Object, "0", "spec", "limits", "cpu")
-			if err != nil {
-				return fmt.Errorf("failed to set cpu limit for nodepool %s: %v", nodePoolName, err)
-			}
-
-			_, err = dynamicClient.Resource(nodePoolGVR).Update(ctx, np, metav1.UpdateOptions{})
-			if err != nil {
-				return fmt.Errorf("failed to update nodepool %s: %v", nodePoolName, err)
-			}
-
-			fmt.Printf("Successfully updated nodepool %s to set cpu limit to 0\n", nodePoolName)
-
-			// Delete all nodeclaims with label karpenter.sh/nodepool=<nodepool-name>
-			fmt.Printf("Deleting nodeclaims for nodepool %s...\n", nodePoolName)
-			if err := deleteSpotNodeclaims(ctx, dynamicClient, nodePoolName); err != nil {
-				return fmt.Errorf("failed to delete nodeclaims for nodepool %s: %v", nodePoolName, err)
-			}
-		case "startup":
-			fmt.Printf("Simulating scale up of nodepool %s\n", nodePoolName)
-			cpuLimit := os.Getenv("KARPENTER_NODEPOOL_LIMITS_CPU")
-			if cpuLimit == "" {
-				fmt.Printf("Environment variable KARPENTER_NODEPOOL_LIMITS_CPU not set - using default 1000\n")
-				cpuLimit = "1000"
-			}
-			err = unstructured.SetNestedField(np.Object, cpuLimit, "spec", "limits", "cpu")
-			if err != nil {
-				return fmt.Errorf("failed to set cpu limit for nodepool %s: %v", nodePoolName, err)
-			}
-
-			_, err = dynamicClient.Resource(nodePoolGVR).Update(ctx, np, metav1.UpdateOptions{})
-			if err != nil {
-				return fmt.Errorf("failed to update nodepool %s: %v", nodePoolName, err)
-			}
-			fmt.Printf("Successfully updated nodepool %s to restore cpu limit to %s\n", nodePoolName, cpuLimit)
+	if deferred {
+		result.Continuation = progress.continuation()
+		result.Continued, err = continueRun(ctx, request.Action, result.Continuation, progress.maxInvocations)
+		if err != nil {
+			errs = append(errs, err)
 		}
 	}
 
-	// EC2 interaction - pass all nodepool names
-	if err := ShutdownEC2Instances(ctx, nodePoolNames); err != nil {
-		return err
+	// Returning an error would have Lambda retry this invocation and start a
+	// second chain of continuations, so once the run continued its failures
+	// are only reported in the result
+	if result.Continued && len(errs) > 0 {
+		fmt.Printf("Continued the run despite failures, reported in the result: %v\n", errors.Join(errs...))
+		return result, nil
 	}
-
-	return nil
+	return result, errors.Join(errs...)
 }
 
 func main() {
@@ -2,10 +2,13 @@ package main
 
 import (
 	"context"
+	"fmt"
 	"os"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/dynamic"
 )
 
 func TestActionEvent(t *testing.T) {
@@ -29,7 +32,7 @@ func TestHandlerMissingEnvironmentVariable(t *testing.T) {
 	}()
 
 	request := ActionEvent{Action: "shutdown"}
-	err := handler(ctx, request)
+	_, err := handler(ctx, request)
 
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "KARPENTER_NODEPOOLS environment variable not set")
@@ -52,10 +55,38 @@ func TestHandlerWithMockEnvironment(t *testing.T) {
 
 	// Test with invalid action that should not cause immediate failure
 	request := ActionEvent{Action: "invalid"}
-	err := handler(ctx, request)
+	_, err := handler(ctx, request)
 
 	// The handler should fail when trying to create the dynamic client
 	// since we don't have real AWS credentials in the test environment
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "failed to create dynamic client")
 }
+
+func TestHandlerIsolatesClusterFailures(t *testing.T) {
+	t.Setenv("KARPENTER_CLUSTERS", `{"clusters": [
+		{"name": "broken", "nodePools": ["default"]},
+		{"name": "dev", "nodePools": ["default"], "limits": {"cpu": "100"}}
+	]}`)
+
+	devClient := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": "0"}))
+	originalFactory := newClusterClient
+	newClusterClient = func(ctx context.Context, cluster ClusterConfig) (dynamic.Interface, error) {
+		if cluster.Name == "broken" {
+			return nil, fmt.Errorf("cluster unreachable")
+		}
+		return devClient, nil
+	}
+	defer func() { newClusterClient = originalFactory }()
+
+	result, err := handler(context.Background(), ActionEvent{Action: "startup"})
+
+	assert.ErrorContains(t, err, "cluster broken: failed to create dynamic client: cluster unreachable")
+	require.Len(t, result.Clusters, 2)
+	assert.Equal(t, "broken", result.Clusters[0].Name)
+	assert.Contains(t, result.Clusters[0].Error, "cluster unreachable")
+	assert.Equal(t, "dev", result.Clusters[1].Name)
+	assert.Empty(t, result.Clusters[1].Error)
+	assert.Equal(t, []NodePoolResult{{Name: "default", Status: nodePoolStatusUpdated}}, result.Clusters[1].NodePools)
+	assert.Equal(t, "100", getNodePoolLimits(t, devClient, "default")["cpu"])
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+var nodePoolGVR = schema.GroupVersionResource{
+	Group:    "karpenter.sh",
+	Version:  "v1",
+	Resource: "nodepools",
+}
+
+// defaultLimits are restored on startup when neither the nodepool nor the
+// cluster configures any.
+var defaultLimits = map[string]string{"cpu": "1000"}
+
+// processNodePools applies the action to the nodepools using up to
+// parallelism workers. Results are returned in the nodepools' order. After a
+// failure no further nodepools are started, those already running finish.
+// Nodepools processed by an earlier invocation are skipped, and once the
+// invocation runs out of time the remaining ones are deferred, as are those
+// still waiting for do-not-disrupt pods.
+func processNodePools(ctx context.Context, dynamicClient dynamic.Interface, action string, nodePools []managedNodePool, parallelism int, progress *clusterProgress) ([]NodePoolResult, error) {
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	results := make([]*NodePoolResult, len(nodePools))
+	errs := make([]error, len(nodePools))
+	deferred := false
+	var failed, waiting atomic.Bool
+	var wg sync.WaitGroup
+	workers := make(chan struct{}, parallelism)
+
+start:
+	for i, np := range nodePools {
+		if progress.done(np.Name) {
+			fmt.Printf("Nodepool %s was processed by an earlier invocation\n", np.Name)
+			continue
+		}
+
+		select {
+		case workers <- struct{}{}:
+		case <-ctx.Done():
+			break start
+		}
+		if failed.Load() || ctx.Err() != nil {
+			<-workers
+			break
+		}
+		if progress.outOfTime() {
+			<-workers
+			deferred = true
+			for j := i; j < len(nodePools); j++ {
+				if !progress.done(nodePools[j].Name) {
+					results[j] = &NodePoolResult{Name: nodePools[j].Name, Status: nodePoolStatusDeferred}
+				}
+			}
+			break
+		}
+
+		wg.Add(1)
+		go func(i int, np managedNodePool) {
+			defer wg.Done()
+			defer func() { <-workers }()
+
+			fmt.Printf("\n=== Processing nodepool: %s ===\n", np.Name)
+			status, err := processNodePool(ctx, dynamicClient, action, np, progress)
+			if errors.Is(err, errDeadline) {
+				waiting.Store(true)
+				results[i] = &NodePoolResult{Name: np.Name, Status: nodePoolStatusDeferred}
+				return
+			}
+			if err != nil {
+				failed.Store(true)
+				errs[i] = err
+				results[i] = &NodePoolResult{Name: np.Name, Status: nodePoolStatusFailed, Error: err.Error()}
+				return
+			}
+			progress.complete(np.Name)
+			results[i] = &NodePoolResult{Name: np.Name, Status: status}
+		}(i, np)
+	}
+	wg.Wait()
+
+	var collected []NodePoolResult
+	for _, result := range results {
+		if result != nil {
+			collected = append(collected, *result)
+		}
+	}
+	if err := errors.Join(errs...); err != nil {
+		return collected, err
+	}
+	if deferred || waiting.Load() {
+		return collected, errDeadline
+	}
+	return collected, ctx.Err()
+}
+
+func processNodePool(ctx context.Context, dynamicClient dynamic.Interface, action string, np managedNodePool, progress *clusterProgress) (string, error) {
+	nodePoolName := np.Name
+	nodePool, err := dynamicClient.Resource(nodePoolGVR).Get(ctx, nodePoolName, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) && action == "startup" && np.Recreate {
+		return recreateNodePool(ctx, dynamicClient, np, progress)
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to get nodepool %s: %v", nodePoolName, err)
+	}
+
+	switch action {
+	case "shutdown":
+		if err := saveNodePoolSnapshot(ctx, dynamicClient, nodePool, progress); err != nil {
+			return "", fmt.Errorf("failed to snapshot nodepool %s: %v", nodePoolName, err)
+		}
+
+		fmt.Printf("Simulating scaling down nodepool %s\n", nodePoolName)
+		err = unstructured.SetNestedField(nodePool.Object, "0", "spec", "limits", "cpu")
+		if err != nil {
+			return "", fmt.Errorf("failed to set cpu limit for nodepool %s: %v", nodePoolName, err)
+		}
+
+		_, err = dynamicClient.Resource(nodePoolGVR).Update(ctx, nodePool, metav1.UpdateOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to update nodepool %s: %v", nodePoolName, err)
+		}
+
+		fmt.Printf("Successfully updated nodepool %s to set cpu limit to 0\n", nodePoolName)
+
+		keep, err := applyDoNotDisruptPolicy(ctx, dynamicClient, np, progress)
+		if err != nil {
+			return "", err
+		}
+
+		if np.Drain {
+			fmt.Printf("Draining nodes of nodepool %s...\n", nodePoolName)
+			if err := drainNodePool(ctx, dynamicClient, nodePoolName, keep); err != nil {
+				return "", fmt.Errorf("failed to drain nodepool %s: %v", nodePoolName, err)
+			}
+		}
+
+		if !np.DeleteNodeClaims {
+			fmt.Printf("Keeping nodeclaims of nodepool %s as configured\n", nodePoolName)
+			return nodePoolStatusUpdated, nil
+		}
+
+		// Delete all nodeclaims with label karpenter.sh/nodepool=<nodepool-name>
+		fmt.Printf("Deleting nodeclaims for nodepool %s...\n", nodePoolName)
+		if err := deleteSpotNodeclaims(ctx, dynamicClient, nodePoolName, keep); err != nil {
+			return "", fmt.Errorf("failed to delete nodeclaims for nodepool %s: %v", nodePoolName, err)
+		}
+		return nodePoolStatusUpdated, nil
+	case "scale":
+		return scaleNodePool(ctx, dynamicClient, nodePool, np, progress)
+	case "spot":
+		return spotNodePool(ctx, dynamicClient, nodePool)
+	case "offpeak":
+		return offPeakNodePool(ctx, dynamicClient, nodePool, np)
+	case "startup":
+		fmt.Printf("Simulating scale up of nodepool %s\n", nodePoolName)
+		limits := np.Limits
+		restore, err := getRestoreState(nodePool)
+		if err != nil {
+			return "", err
+		}
+		snapshot, err := progress.latestSnapshot(ctx, nodePoolName)
+		if err != nil {
+			return "", err
+		}
+		recorded := false
+		if restore != nil && len(restore.Limits) > 0 {
+			fmt.Printf("Restoring limits of nodepool %s saved before the night\n", nodePoolName)
+			limits = restore.Limits
+			recorded = true
+		} else if snapshot != nil && len(snapshot.Limits) > 0 {
+			fmt.Printf("Restoring limits of nodepool %s from the snapshot of run %s\n", nodePoolName, snapshot.RunID)
+			limits = snapshot.Limits
+			recorded = true
+		} else if len(limits) == 0 {
+			fmt.Printf("No limits configured for nodepool %s - using default cpu limit 1000\n", nodePoolName)
+			limits = defaultLimits
+		}
+		// Recorded limits are the whole daytime set, so limits added
+		// overnight, such as by the scale action, are dropped
+		if recorded {
+			unstructured.RemoveNestedField(nodePool.Object, "spec", "limits")
+		}
+		if err := setLimits(nodePool, limits); err != nil {
+			return "", fmt.Errorf("failed to set limits for nodepool %s: %v", nodePoolName, err)
+		}
+		if err := restoreRequirements(nodePool, restore); err != nil {
+			return "", err
+		}
+		removeRestoreState(nodePool)
+
+		_, err = dynamicClient.Resource(nodePoolGVR).Update(ctx, nodePool, metav1.UpdateOptions{})
+		if err != nil {
+			return "", fmt.Errorf("failed to update nodepool %s: %v", nodePoolName, err)
+		}
+		fmt.Printf("Successfully updated nodepool %s to restore limits to %v\n", nodePoolName, limits)
+
+		if err := uncordonNodePool(ctx, dynamicClient, nodePoolName); err != nil {
+			return "", err
+		}
+		return nodePoolStatusUpdated, nil
+	}
+
+	return nodePoolStatusSkipped, nil
+}
+
+// nodePoolLimits reads the nodepool's spec.limits. Karpenter accepts the
+// quantities as strings or numbers, e.g. cpu: 1000, so numbers are turned
+// into strings and every value must parse as a resource.Quantity.
+func nodePoolLimits(nodePool *unstructured.Unstructured) (map[string]string, error) {
+	raw, found, err := unstructured.NestedMap(nodePool.Object, "spec", "limits")
+	if err != nil || !found {
+		return nil, err
+	}
+	limits := make(map[string]string, len(raw))
+	for name, value := range raw {
+		var limit string
+		switch v := value.(type) {
+		case string:
+			limit = v
+		case int64:
+			limit = strconv.FormatInt(v, 10)
+		case float64:
+			limit = strconv.FormatFloat(v, 'f', -1, 64)
+		default:
+			return nil, fmt.Errorf("invalid limit %s: unsupported value %v of type %T", name, value, value)
+		}
+		if _, err := resource.ParseQuantity(limit); err != nil {
+			return nil, fmt.Errorf("invalid limit %s: %v", name, err)
+		}
+		limits[name] = limit
+	}
+	return limits, nil
+}
+
+// setLimits sets each resource limit on the nodepool spec.
+func setLimits(np *unstructured.Unstructured, limits map[string]string) error {
+	resources := make([]string, 0, len(limits))
+	for resource := range limits {
+		resources = append(resources, resource)
+	}
+	sort.Strings(resources)
+
+	for _, resource := range resources {
+		if err := unstructured.SetNestedField(np.Object, limits[resource], "spec", "limits", resource); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// newFakeClient returns a fake dynamic client that knows the list kinds of
+// every resource the handler touches.
+func newFakeClient(objects ...runtime.Object) *fake.FakeDynamicClient {
+	return fake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{
+			nodePoolGVR:          "NodePoolList",
+			nodeClaimGVR:         "NodeClaimList",
+			nodeGVR:              "NodeList",
+			podGVR:               "PodList",
+			nodeClassGVR:         "EC2NodeClassList",
+			deploymentGVR:        "DeploymentList",
+			statefulSetGVR:       "StatefulSetList",
+			cronJobGVR:           "CronJobList",
+			hpaGVR:               "HorizontalPodAutoscalerList",
+			scaledObjectGVR:      "ScaledObjectList",
+			argoApplicationGVR:   "ApplicationList",
+			fluxKustomizationGVR: "KustomizationList",
+			fluxHelmReleaseGVR:   "HelmReleaseList",
+			ingressGVR:           "IngressList",
+			httpRouteGVR:         "HTTPRouteList",
+			jobGVR:               "JobList",
+			configMapGVR:         "ConfigMapList",
+		},
+		objects...)
+}
+
+func newTestNodePool(name string, limits map[string]interface{}) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "karpenter.sh/v1",
+			"kind":       "NodePool",
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+			"spec": map[string]interface{}{
+				"limits": limits,
+			},
+		},
+	}
+}
+
+func newTestNodeClaim(name, nodePoolName string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "karpenter.sh/v1",
+			"kind":       "NodeClaim",
+			"metadata": map[string]interface{}{
+				"name": name,
+				"labels": map[string]interface{}{
+					"karpenter.sh/nodepool": nodePoolName,
+				},
+			},
+		},
+	}
+}
+
+func getNodePoolLimits(t *testing.T, client *fake.FakeDynamicClient, name string) map[string]string {
+	np, err := client.Resource(nodePoolGVR).Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	limits, err := nodePoolLimits(np)
+	require.NoError(t, err)
+	return limits
+}
+
+// processConfiguredNodePools resolves the cluster's nodepools against the
+// fake client and applies the action to them.
+func processConfiguredNodePools(t *testing.T, client *fake.FakeDynamicClient, action string, cluster ClusterConfig) ([]NodePoolResult, error) {
+	nodePools, err := resolveClusterNodePools(context.Background(), client, cluster)
+	require.NoError(t, err)
+	return processNodePools(context.Background(), client, action, nodePools, cluster.Parallelism, nil)
+}
+
+func TestProcessNodePoolsShutdown(t *testing.T) {
+	client := newFakeClient(
+		newTestNodePool("default", map[string]interface{}{"cpu": "1000"}),
+		newTestNodeClaim("default-abc", "default"),
+	)
+	cluster := ClusterConfig{Name: "test-cluster", NodePools: splitNodePools("default")}
+
+	results, err := processConfiguredNodePools(t, client, "shutdown", cluster)
+
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{{Name: "default", Status: nodePoolStatusUpdated}}, results)
+	assert.Equal(t, "0", getNodePoolLimits(t, client, "default")["cpu"])
+
+	nodeClaims, err := client.Resource(nodeClaimGVR).List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Empty(t, nodeClaims.Items)
+}
+
+func TestProcessNodePoolsStartupLimits(t *testing.T) {
+	client := newFakeClient(
+		newTestNodePool("default", map[string]interface{}{"cpu": "0"}),
+		newTestNodePool("gpu", map[string]interface{}{"cpu": "0"}),
+	)
+
+	cluster := ClusterConfig{
+		Name:      "test-cluster",
+		NodePools: splitNodePools("default"),
+		Limits:    map[string]string{"cpu": "200", "memory": "800Gi"},
+	}
+	_, err := processConfiguredNodePools(t, client, "startup", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "200", "memory": "800Gi"}, getNodePoolLimits(t, client, "default"))
+
+	// Without configured limits the default cpu limit is restored
+	cluster = ClusterConfig{Name: "test-cluster", NodePools: splitNodePools("gpu")}
+	_, err = processConfiguredNodePools(t, client, "startup", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "1000"}, getNodePoolLimits(t, client, "gpu"))
+}
+
+func TestProcessNodePoolsMissingNodePool(t *testing.T) {
+	client := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": "0"}))
+	cluster := ClusterConfig{Name: "test-cluster", NodePools: splitNodePools("missing,default")}
+
+	results, err := processConfiguredNodePools(t, client, "startup", cluster)
+
+	assert.ErrorContains(t, err, "failed to get nodepool missing")
+	require.Len(t, results, 1)
+	assert.Equal(t, nodePoolStatusFailed, results[0].Status)
+}
+
+func TestProcessNodePoolsKeepNodeClaims(t *testing.T) {
+	client := newFakeClient(
+		newTestNodePool("default", map[string]interface{}{"cpu": "1000"}),
+		newTestNodeClaim("default-abc", "default"),
+	)
+	keep := false
+	cluster := ClusterConfig{
+		Name:      "test-cluster",
+		NodePools: []NodePoolConfig{{Name: "default", NodePoolProfile: NodePoolProfile{DeleteNodeClaims: &keep}}},
+	}
+
+	_, err := processConfiguredNodePools(t, client, "shutdown", cluster)
+
+	require.NoError(t, err)
+	assert.Equal(t, "0", getNodePoolLimits(t, client, "default")["cpu"])
+	nodeClaims, err := client.Resource(nodeClaimGVR).List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	assert.Len(t, nodeClaims.Items, 1)
+}
+
+func TestProcessNodePoolsOrder(t *testing.T) {
+	client := newFakeClient(
+		newTestNodePool("app", map[string]interface{}{"cpu": "0"}),
+		newTestNodePool("system", map[string]interface{}{"cpu": "0"}),
+	)
+	first := -1
+	cluster := ClusterConfig{
+		Name: "test-cluster",
+		NodePools: []NodePoolConfig{
+			{Name: "app"},
+			{Name: "system", NodePoolProfile: NodePoolProfile{Order: &first}},
+		},
+	}
+
+	results, err := processConfiguredNodePools(t, client, "startup", cluster)
+
+	require.NoError(t, err)
+	assert.Equal(t, "system", results[0].Name)
+	assert.Equal(t, "app", results[1].Name)
+}
+
+func TestProcessNodePoolsPatterns(t *testing.T) {
+	client := newFakeClient(
+		newTestNodePool("team-a", map[string]interface{}{"cpu": "1000"}),
+		newTestNodePool("team-b", map[string]interface{}{"cpu": "1000"}),
+		newTestNodePool("ci-runners", map[string]interface{}{"cpu": "1000"}),
+		newTestNodePool("system", map[string]interface{}{"cpu": "1000"}),
+	)
+	cluster := ClusterConfig{Name: "test-cluster", NodePools: splitNodePools("team-*,/^ci-.*/,!team-b")}
+
+	results, err := processConfiguredNodePools(t, client, "shutdown", cluster)
+
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{
+		{Name: "team-a", Status: nodePoolStatusUpdated},
+		{Name: "ci-runners", Status: nodePoolStatusUpdated},
+	}, results)
+	assert.Equal(t, "1000", getNodePoolLimits(t, client, "team-b")["cpu"])
+	assert.Equal(t, "1000", getNodePoolLimits(t, client, "system")["cpu"])
+}
+
+func TestProcessNodePoolsParallel(t *testing.T) {
+	var objects []runtime.Object
+	var nodePools []managedNodePool
+	for i := 0; i < 8; i++ {
+		name := fmt.Sprintf("pool-%d", i)
+		objects = append(objects, newTestNodePool(name, map[string]interface{}{"cpu": "0"}))
+		nodePools = append(nodePools, managedNodePool{Name: name, Limits: map[string]string{"cpu": "10"}})
+	}
+	client := newFakeClient(objects...)
+
+	results, err := processNodePools(context.Background(), client, "startup", nodePools, 3, nil)
+
+	require.NoError(t, err)
+	require.Len(t, results, 8)
+	for i, result := range results {
+		name := fmt.Sprintf("pool-%d", i)
+		assert.Equal(t, NodePoolResult{Name: name, Status: nodePoolStatusUpdated}, result)
+		assert.Equal(t, "10", getNodePoolLimits(t, client, name)["cpu"])
+	}
+}
+
+func TestProcessNodePoolsParallelErrors(t *testing.T) {
+	client := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": "0"}))
+	// Slow the API down so all three workers start before the first failure
+	client.PrependReactor("get", "nodepools", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		time.Sleep(10 * time.Millisecond)
+		return false, nil, nil
+	})
+	nodePools := []managedNodePool{{Name: "missing-a"}, {Name: "default"}, {Name: "missing-b"}}
+
+	results, err := processNodePools(context.Background(), client, "startup", nodePools, 3, nil)
+
+	assert.ErrorContains(t, err, "failed to get nodepool missing-a")
+	assert.ErrorContains(t, err, "failed to get nodepool missing-b")
+	require.Len(t, results, 3)
+	assert.Equal(t, []string{nodePoolStatusFailed, nodePoolStatusUpdated, nodePoolStatusFailed},
+		[]string{results[0].Status, results[1].Status, results[2].Status})
+}
+
+func TestProcessNodePoolsCancelled(t *testing.T) {
+	client := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": "0"}))
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	results, err := processNodePools(ctx, client, "startup", []managedNodePool{{Name: "default"}}, 2, nil)
+
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, results)
+}
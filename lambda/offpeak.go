@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// Well-known labels the offpeak action narrows.
+const (
+	instanceTypeLabel = "node.kubernetes.io/instance-type"
+	instanceSizeLabel = "karpenter.k8s.aws/instance-size"
+)
+
+// offPeakNodePool narrows the nodepool's instance type and size
+// requirements to the configured cheap ones overnight. The daytime
+// requirements are kept in the restoreAnnotation for startup, and Karpenter
+// replaces the nodes that no longer match as drifted.
+func offPeakNodePool(ctx context.Context, dynamicClient dynamic.Interface, nodePool *unstructured.Unstructured, np managedNodePool) (string, error) {
+	if np.OffPeak == nil {
+		fmt.Printf("No off-peak profile configured for nodepool %s - skipping\n", np.Name)
+		return nodePoolStatusSkipped, nil
+	}
+	if _, err := recordRestoreState(nodePool); err != nil {
+		return "", err
+	}
+
+	requirements, _, err := unstructured.NestedSlice(nodePool.Object, "spec", "template", "spec", "requirements")
+	if err != nil {
+		return "", fmt.Errorf("failed to read requirements of nodepool %s: %v", np.Name, err)
+	}
+	requirements = offPeakRequirements(requirements, *np.OffPeak)
+	if err := unstructured.SetNestedSlice(nodePool.Object, requirements, "spec", "template", "spec", "requirements"); err != nil {
+		return "", fmt.Errorf("failed to set requirements for nodepool %s: %v", np.Name, err)
+	}
+
+	if _, err := dynamicClient.Resource(nodePoolGVR).Update(ctx, nodePool, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update nodepool %s: %v", np.Name, err)
+	}
+	fmt.Printf("Successfully narrowed nodepool %s to off-peak instance types %v and sizes %v\n", np.Name, np.OffPeak.InstanceTypes, np.OffPeak.InstanceSizes)
+	return nodePoolStatusUpdated, nil
+}
+
+// offPeakRequirements replaces the instance type and size requirements set
+// by the off-peak profile, keeping every other requirement in place.
+func offPeakRequirements(requirements []interface{}, offPeak OffPeakConfig) []interface{} {
+	if len(offPeak.InstanceTypes) > 0 {
+		requirements = replaceRequirement(requirements, instanceTypeLabel, offPeak.InstanceTypes)
+	}
+	if len(offPeak.InstanceSizes) > 0 {
+		requirements = replaceRequirement(requirements, instanceSizeLabel, offPeak.InstanceSizes)
+	}
+	return requirements
+}
+
+// validateOffPeak checks an off-peak profile.
+func validateOffPeak(offPeak *OffPeakConfig) error {
+	if offPeak == nil {
+		return nil
+	}
+	if len(offPeak.InstanceTypes) == 0 && len(offPeak.InstanceSizes) == 0 {
+		return fmt.Errorf("offPeak needs instanceTypes or instanceSizes")
+	}
+	return nil
+}
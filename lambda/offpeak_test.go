@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestOffPeakRequirements(t *testing.T) {
+	daytime := []interface{}{
+		requirement(instanceSizeLabel, "large", "xlarge", "2xlarge"),
+		requirement(capacityTypeLabel, "on-demand"),
+	}
+
+	assert.Equal(t,
+		[]interface{}{requirement(instanceSizeLabel, "medium"), requirement(capacityTypeLabel, "on-demand")},
+		offPeakRequirements(daytime, OffPeakConfig{InstanceSizes: []string{"medium"}}))
+	assert.Equal(t,
+		[]interface{}{daytime[0], daytime[1], requirement(instanceTypeLabel, "t3.medium", "t3a.medium")},
+		offPeakRequirements(daytime, OffPeakConfig{InstanceTypes: []string{"t3.medium", "t3a.medium"}}))
+}
+
+func TestProcessNodePoolsOffPeakAndStartup(t *testing.T) {
+	daytime := []interface{}{requirement(instanceSizeLabel, "xlarge", "2xlarge")}
+	nodePool := newTestNodePool("default", map[string]interface{}{"cpu": "40"})
+	require.NoError(t, unstructured.SetNestedSlice(nodePool.Object, daytime, "spec", "template", "spec", "requirements"))
+	client := newFakeClient(nodePool, newTestNodePool("system", map[string]interface{}{"cpu": "8"}))
+	cluster := ClusterConfig{
+		Name: "test-cluster",
+		NodePools: []NodePoolConfig{
+			{Name: "default", NodePoolProfile: NodePoolProfile{OffPeak: &OffPeakConfig{InstanceSizes: []string{"medium", "large"}}}},
+			{Name: "system"},
+		},
+	}
+
+	getRequirements := func() []interface{} {
+		np, err := client.Resource(nodePoolGVR).Get(context.Background(), "default", metav1.GetOptions{})
+		require.NoError(t, err)
+		requirements, _, err := unstructured.NestedSlice(np.Object, "spec", "template", "spec", "requirements")
+		require.NoError(t, err)
+		return requirements
+	}
+
+	results, err := processConfiguredNodePools(t, client, "offpeak", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{
+		{Name: "default", Status: nodePoolStatusUpdated},
+		{Name: "system", Status: nodePoolStatusSkipped},
+	}, results)
+	assert.Equal(t, []interface{}{requirement(instanceSizeLabel, "medium", "large")}, getRequirements())
+
+	_, err = processConfiguredNodePools(t, client, "startup", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, daytime, getRequirements())
+}
+
+func TestProcessNodePoolsOffPeakWithoutRequirements(t *testing.T) {
+	client := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": "40"}))
+	cluster := ClusterConfig{
+		Name:      "test-cluster",
+		NodePools: splitNodePools("default"),
+		OffPeak:   &OffPeakConfig{InstanceSizes: []string{"medium"}},
+	}
+
+	getRequirements := func() []interface{} {
+		np, err := client.Resource(nodePoolGVR).Get(context.Background(), "default", metav1.GetOptions{})
+		require.NoError(t, err)
+		requirements, _, err := unstructured.NestedSlice(np.Object, "spec", "template", "spec", "requirements")
+		require.NoError(t, err)
+		return requirements
+	}
+
+	_, err := processConfiguredNodePools(t, client, "offpeak", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{requirement(instanceSizeLabel, "medium")}, getRequirements())
+
+	// A second night action keeps the recorded empty requirements
+	_, err = processConfiguredNodePools(t, client, "spot", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{requirement(instanceSizeLabel, "medium"), requirement(capacityTypeLabel, "spot")}, getRequirements())
+
+	_, err = processConfiguredNodePools(t, client, "startup", cluster)
+	require.NoError(t, err)
+	assert.Empty(t, getRequirements())
+}
+
+func TestProcessNodePoolsOffPeakIntegerLimits(t *testing.T) {
+	client := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": int64(1000)}))
+	cluster := ClusterConfig{
+		Name:      "test-cluster",
+		NodePools: splitNodePools("default"),
+		OffPeak:   &OffPeakConfig{InstanceSizes: []string{"medium"}},
+	}
+
+	results, err := processConfiguredNodePools(t, client, "offpeak", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{{Name: "default", Status: nodePoolStatusUpdated}}, results)
+
+	_, err = processConfiguredNodePools(t, client, "startup", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "1000"}, getNodePoolLimits(t, client, "default"))
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"time"
+	_ "time/tzdata" // the Lambda runtime has no zoneinfo
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"sigs.k8s.io/yaml"
+)
+
+var configMapGVR = schema.GroupVersionResource{Version: "v1", Resource: "configmaps"}
+
+// defaultOverridesConfigMap is read when a cluster names no overrides
+// ConfigMap.
+const defaultOverridesConfigMap = "kube-system/shutdown-schedule-overrides"
+
+// overridesKey is the ConfigMap key holding the overrides document.
+const overridesKey = "overrides.yaml"
+
+// scheduleOverrides change what the schedule does for a while, edited by the
+// platform on-call with kubectl. Entries without nodePools apply to the
+// whole cluster, including its workload steps.
+type scheduleOverrides struct {
+	// Timezone of dates, e.g. "Australia/Sydney", default UTC
+	Timezone string `json:"timezone,omitempty"`
+	// Skip are dates on which every action leaves the nodepools alone
+	Skip []overrideDates `json:"skip,omitempty"`
+	// Awake are ranges during which the night actions leave the nodepools
+	// running
+	Awake []overrideRange `json:"awake,omitempty"`
+	// Asleep are ranges during which startup leaves the nodepools shut down
+	Asleep []overrideRange `json:"asleep,omitempty"`
+
+	location *time.Location
+}
+
+type overrideDates struct {
+	// Dates are days in the timezone, e.g. "2026-12-25"
+	Dates []string `json:"dates"`
+	// NodePools are names or patterns, see nodePoolPattern
+	NodePools []string `json:"nodePools,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+}
+
+type overrideRange struct {
+	// From and Until are RFC3339 times or days in the timezone. A day as
+	// Until includes the whole day. Either may be left open.
+	From      string   `json:"from,omitempty"`
+	Until     string   `json:"until,omitempty"`
+	NodePools []string `json:"nodePools,omitempty"`
+	Reason    string   `json:"reason,omitempty"`
+}
+
+// loadOverrides reads the overrides ConfigMap, given as namespace/name. A
+// missing ConfigMap means no overrides. The default ConfigMap may also be
+// unreadable, but one named explicitly must be readable, as overrides the
+// on-call relies on would otherwise be ignored.
+func loadOverrides(ctx context.Context, dynamicClient dynamic.Interface, ref string) (*scheduleOverrides, error) {
+	explicit := ref != defaultOverridesConfigMap
+	namespace, name := splitResourceRef(ref, "kube-system")
+	configMap, err := dynamicClient.Resource(configMapGVR).Namespace(namespace).Get(ctx, name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		if explicit {
+			fmt.Printf("WARNING: overrides ConfigMap %s not found - no overrides apply\n", ref)
+		}
+		return nil, nil
+	}
+	if apierrors.IsForbidden(err) && !explicit {
+		fmt.Printf("Not allowed to read overrides ConfigMap %s - ignoring overrides\n", ref)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get overrides ConfigMap %s: %v", ref, err)
+	}
+
+	data, _, _ := unstructured.NestedString(configMap.Object, "data", overridesKey)
+	overrides, err := parseOverrides([]byte(data))
+	if err != nil {
+		return nil, fmt.Errorf("invalid overrides ConfigMap %s: %v", ref, err)
+	}
+	fmt.Printf("Loaded overrides from ConfigMap %s\n", ref)
+	return overrides, nil
+}
+
+// parseOverrides decodes and validates an overrides document.
+func parseOverrides(data []byte) (*scheduleOverrides, error) {
+	jsonData, err := yaml.YAMLToJSON(data)
+	if err != nil {
+		return nil, err
+	}
+	overrides := &scheduleOverrides{}
+	if string(jsonData) != "null" {
+		decoder := json.NewDecoder(bytes.NewReader(jsonData))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(overrides); err != nil {
+			return nil, err
+		}
+	}
+
+	if overrides.location, err = time.LoadLocation(overrides.Timezone); err != nil {
+		return nil, fmt.Errorf("invalid timezone %q: %v", overrides.Timezone, err)
+	}
+	for i, entry := range overrides.Skip {
+		if len(entry.Dates) == 0 {
+			return nil, fmt.Errorf("skip[%d]: at least one date is required", i)
+		}
+		for _, date := range entry.Dates {
+			if _, err := time.ParseInLocation(time.DateOnly, date, overrides.location); err != nil {
+				return nil, fmt.Errorf("skip[%d]: invalid date %q, expected YYYY-MM-DD", i, date)
+			}
+		}
+		if err := validateOverrideNodePools(entry.NodePools); err != nil {
+			return nil, fmt.Errorf("skip[%d]: %v", i, err)
+		}
+	}
+	for field, ranges := range map[string][]overrideRange{"awake": overrides.Awake, "asleep": overrides.Asleep} {
+		for i, entry := range ranges {
+			if entry.From == "" && entry.Until == "" {
+				return nil, fmt.Errorf("%s[%d]: from or until is required", field, i)
+			}
+			if _, _, err := entry.bounds(overrides.location); err != nil {
+				return nil, fmt.Errorf("%s[%d]: %v", field, i, err)
+			}
+			if err := validateOverrideNodePools(entry.NodePools); err != nil {
+				return nil, fmt.Errorf("%s[%d]: %v", field, i, err)
+			}
+		}
+	}
+	return overrides, nil
+}
+
+func validateOverrideNodePools(entries []string) error {
+	for _, entry := range entries {
+		if _, err := parseNodePoolPattern(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// bounds returns the range's start and end, zero when open.
+func (r overrideRange) bounds(location *time.Location) (time.Time, time.Time, error) {
+	from, err := parseOverrideTime(r.From, location, false)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	until, err := parseOverrideTime(r.Until, location, true)
+	if err != nil {
+		return time.Time{}, time.Time{}, err
+	}
+	return from, until, nil
+}
+
+// parseOverrideTime parses an RFC3339 time or a day, which as an end
+// includes the whole day.
+func parseOverrideTime(value string, location *time.Location, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	day, err := time.ParseInLocation(time.DateOnly, value, location)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, expected RFC3339 or YYYY-MM-DD", value)
+	}
+	if end {
+		day = day.AddDate(0, 0, 1)
+	}
+	return day, nil
+}
+
+func (r overrideRange) contains(at time.Time, location *time.Location) bool {
+	from, until, _ := r.bounds(location)
+	return (from.IsZero() || !at.Before(from)) && (until.IsZero() || at.Before(until))
+}
+
+// match returns why the overrides hold the action back for the nodepool at
+// the given time, or "" when they do not. An empty nodepool name matches
+// only the entries for the whole cluster.
+func (o *scheduleOverrides) match(action, nodePool string, at time.Time) string {
+	if o == nil {
+		return ""
+	}
+	selects := func(entries []string) bool {
+		if len(entries) == 0 {
+			return true
+		}
+		if nodePool == "" {
+			return false
+		}
+		selected, _ := selectsNodePool(entries, nodePool)
+		return selected
+	}
+	withReason := func(message, reason string) string {
+		if reason != "" {
+			return message + ": " + reason
+		}
+		return message
+	}
+
+	today := at.In(o.location).Format(time.DateOnly)
+	for _, entry := range o.Skip {
+		for _, date := range entry.Dates {
+			if date == today && selects(entry.NodePools) {
+				return withReason("skip date "+date, entry.Reason)
+			}
+		}
+	}
+
+	ranges, state := o.Asleep, "asleep"
+	if isNightAction(action) {
+		ranges, state = o.Awake, "awake"
+	} else if action != "startup" {
+		return ""
+	}
+	for _, entry := range ranges {
+		if entry.contains(at, o.location) && selects(entry.NodePools) {
+			message := "forced " + state
+			if entry.Until != "" {
+				message += " until " + entry.Until
+			}
+			return withReason(message, entry.Reason)
+		}
+	}
+	return ""
+}
+
+// overridesRef names the cluster's overrides ConfigMap.
+func (c ClusterConfig) overridesRef() string {
+	if c.Overrides != "" {
+		return c.Overrides
+	}
+	return defaultOverridesConfigMap
+}
+
+// validateOverridesRef checks the overrides ConfigMap reference.
+func validateOverridesRef(ref string) error {
+	if ref == "" {
+		return nil
+	}
+	namespace, name := splitResourceRef(ref, "kube-system")
+	if namespace == "" || name == "" || strings.Contains(name, "/") {
+		return fmt.Errorf("overrides: invalid ConfigMap %q, expected name or namespace/name", ref)
+	}
+	return nil
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+const testOverrides = `
+timezone: Australia/Sydney
+skip:
+  - dates: ["2026-12-25"]
+    reason: Christmas
+awake:
+  - nodePools: ["team-*"]
+    from: 2026-10-20T18:00:00+11:00
+    until: 2026-10-21T06:00:00+11:00
+    reason: late release
+asleep:
+  - nodePools: ["!system"]
+    from: 2026-12-24
+    until: 2027-01-02
+`
+
+func newTestOverridesConfigMap(namespace, name, overrides string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "v1",
+			"kind":       "ConfigMap",
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"data": map[string]interface{}{overridesKey: overrides},
+		},
+	}
+}
+
+func TestOverridesMatch(t *testing.T) {
+	overrides, err := parseOverrides([]byte(testOverrides))
+	require.NoError(t, err)
+
+	sydney := func(value string) time.Time {
+		at, err := time.Parse(time.RFC3339, value)
+		require.NoError(t, err)
+		return at
+	}
+	tests := []struct {
+		name     string
+		action   string
+		nodePool string
+		at       time.Time
+		expected string
+	}{
+		{"skip date in the timezone", "shutdown", "default", sydney("2026-12-25T00:30:00+11:00"), "skip date 2026-12-25: Christmas"},
+		{"skip date for the cluster", "startup", "", sydney("2026-12-25T08:00:00+11:00"), "skip date 2026-12-25: Christmas"},
+		{"day before the skip date", "shutdown", "default", sydney("2026-12-24T12:00:00Z"), ""},
+		{"forced awake", "shutdown", "team-a", sydney("2026-10-20T19:00:00+11:00"), "forced awake until 2026-10-21T06:00:00+11:00: late release"},
+		{"forced awake other nodepool", "shutdown", "system", sydney("2026-10-20T19:00:00+11:00"), ""},
+		{"forced awake cluster", "shutdown", "", sydney("2026-10-20T19:00:00+11:00"), ""},
+		{"forced awake does not hold startup", "startup", "team-a", sydney("2026-10-20T19:00:00+11:00"), ""},
+		{"forced awake ended", "scale", "team-a", sydney("2026-10-21T06:00:00+11:00"), ""},
+		{"forced asleep", "startup", "team-a", sydney("2027-01-02T08:00:00+11:00"), "forced asleep until 2027-01-02"},
+		{"forced asleep excluded", "startup", "system", sydney("2027-01-02T08:00:00+11:00"), ""},
+		{"forced asleep ended", "startup", "team-a", sydney("2027-01-03T08:00:00+11:00"), ""},
+		{"forced asleep does not hold shutdown", "shutdown", "team-a", sydney("2026-12-28T19:00:00+11:00"), ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.expected, overrides.match(tt.action, tt.nodePool, tt.at))
+		})
+	}
+
+	var none *scheduleOverrides
+	assert.Empty(t, none.match("shutdown", "default", time.Now()))
+}
+
+func TestParseOverridesValidation(t *testing.T) {
+	tests := []struct {
+		name        string
+		doc         string
+		expectError string
+	}{
+		{"unknown field", `skipDates: ["2026-12-25"]`, `unknown field "skipDates"`},
+		{"bad timezone", `timezone: Mars/Olympus`, `invalid timezone "Mars/Olympus"`},
+		{"skip without dates", `skip: [{reason: holiday}]`, "skip[0]: at least one date is required"},
+		{"bad skip date", `skip: [{dates: ["25/12/2026"]}]`, `skip[0]: invalid date "25/12/2026"`},
+		{"open range", `awake: [{nodePools: [a]}]`, "awake[0]: from or until is required"},
+		{"bad range time", `asleep: [{until: "next week"}]`, `asleep[0]: invalid time "next week"`},
+		{"bad nodepool pattern", `asleep: [{until: "2027-01-02", nodePools: ["/[/"]}]`, "asleep[0]: invalid nodepool regular expression"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseOverrides([]byte(tt.doc))
+			assert.ErrorContains(t, err, tt.expectError)
+		})
+	}
+
+	overrides, err := parseOverrides(nil)
+	require.NoError(t, err)
+	assert.Empty(t, overrides.match("shutdown", "default", time.Now()))
+}
+
+func TestLoadOverrides(t *testing.T) {
+	client := newFakeClient(newTestOverridesConfigMap("platform", "overrides", "timezone: Australia/Sydney\n"))
+
+	overrides, err := loadOverrides(context.Background(), client, "platform/overrides")
+	require.NoError(t, err)
+	assert.Equal(t, "Australia/Sydney", overrides.Timezone)
+
+	overrides, err = loadOverrides(context.Background(), client, defaultOverridesConfigMap)
+	require.NoError(t, err)
+	assert.Nil(t, overrides)
+
+	client.PrependReactor("get", "configmaps", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(configMapGVR.GroupResource(), "overrides", nil)
+	})
+	// Only the default ConfigMap may be unreadable
+	overrides, err = loadOverrides(context.Background(), client, defaultOverridesConfigMap)
+	require.NoError(t, err)
+	assert.Nil(t, overrides)
+	_, err = loadOverrides(context.Background(), client, "platform/overrides")
+	assert.ErrorContains(t, err, "failed to get overrides ConfigMap platform/overrides")
+
+	client = newFakeClient(newTestOverridesConfigMap("kube-system", "shutdown-schedule-overrides", "skip: [{}]"))
+	_, err = loadOverrides(context.Background(), client, defaultOverridesConfigMap)
+	assert.ErrorContains(t, err, "invalid overrides ConfigMap kube-system/shutdown-schedule-overrides")
+}
+
+func TestProcessClusterOverrides(t *testing.T) {
+	today := time.Now().UTC().Format(time.DateOnly)
+	client := newFakeClient(
+		newTestNodePool("system", map[string]interface{}{"cpu": "0"}),
+		newTestNodePool("team-a", map[string]interface{}{"cpu": "0"}),
+		newTestWorkload("Deployment", "preview", "web", 0, nil),
+		newTestOverridesConfigMap("kube-system", "shutdown-schedule-overrides", `
+skip:
+  - dates: ["`+today+`"]
+    nodePools: ["team-*"]
+    reason: release freeze
+`),
+	)
+	originalFactory := newClusterClient
+	newClusterClient = func(ctx context.Context, cluster ClusterConfig) (dynamic.Interface, error) {
+		return client, nil
+	}
+	defer func() { newClusterClient = originalFactory }()
+
+	cluster := ClusterConfig{
+		Name:      "test-cluster",
+		NodePools: splitNodePools("system,team-a"),
+		Limits:    map[string]string{"cpu": "100"},
+		Workloads: &WorkloadConfig{Namespaces: []string{"preview"}},
+	}
+
+	result, err := processCluster(context.Background(), "startup", cluster, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{
+		{Name: "team-a", Status: nodePoolStatusOverridden, Reason: "skip date " + today + ": release freeze"},
+		{Name: "system", Status: nodePoolStatusUpdated},
+	}, result.NodePools)
+	assert.Equal(t, "100", getNodePoolLimits(t, client, "system")["cpu"])
+	assert.Equal(t, "0", getNodePoolLimits(t, client, "team-a")["cpu"])
+	// The overridden nodepool keeps its workloads shut down
+	assert.Empty(t, result.Workloads)
+	assert.Equal(t, int64(0), getReplicas(t, client, deploymentGVR, "preview", "web"))
+
+	// An awake range for a nodepool keeps its workloads running at night
+	client = newFakeClient(
+		newTestNodePool("system", map[string]interface{}{"cpu": "100"}),
+		newTestNodePool("team-a", map[string]interface{}{"cpu": "100"}),
+		newTestWorkload("Deployment", "preview", "web", 3, nil),
+		newTestOverridesConfigMap("kube-system", "shutdown-schedule-overrides", `
+awake:
+  - until: "`+today+`"
+    nodePools: ["team-a"]
+`),
+	)
+	cluster.Overrides = ""
+	keep := false
+	cluster.NodePools = []NodePoolConfig{
+		{Name: "system", NodePoolProfile: NodePoolProfile{TerminateInstances: &keep}},
+		{Name: "team-a", NodePoolProfile: NodePoolProfile{TerminateInstances: &keep}},
+	}
+	result, err = processCluster(context.Background(), "shutdown", cluster, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{
+		{Name: "team-a", Status: nodePoolStatusOverridden, Reason: "forced awake until " + today},
+		{Name: "system", Status: nodePoolStatusUpdated},
+	}, result.NodePools)
+	assert.Equal(t, "0", getNodePoolLimits(t, client, "system")["cpu"])
+	assert.Equal(t, "100", getNodePoolLimits(t, client, "team-a")["cpu"])
+	assert.Empty(t, result.Workloads)
+	assert.Equal(t, int64(3), getReplicas(t, client, deploymentGVR, "preview", "web"))
+
+	// An override for the whole cluster holds back the workload steps too
+	client = newFakeClient(
+		newTestNodePool("system", map[string]interface{}{"cpu": "100"}),
+		newTestWorkload("Deployment", "preview", "web", 3, nil),
+		newTestOverridesConfigMap("platform", "overrides", `skip: [{dates: ["`+today+`"]}]`),
+	)
+	cluster.NodePools = splitNodePools("system")
+	cluster.Overrides = "platform/overrides"
+	result, err = processCluster(context.Background(), "shutdown", cluster, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{{Name: "system", Status: nodePoolStatusOverridden, Reason: "skip date " + today}}, result.NodePools)
+	assert.Empty(t, result.Workloads)
+	assert.Equal(t, int64(3), getReplicas(t, client, deploymentGVR, "preview", "web"))
+}
@@ -0,0 +1,183 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/dynamic"
+)
+
+// nodePoolPattern is one entry of a nodepool list. Entries are exact names,
+// globs such as "team-*", or regular expressions between slashes such as
+// "/^ci-.*/". A leading "!" turns the entry into an exclusion.
+type nodePoolPattern struct {
+	exclude bool
+	glob    string
+	re      *regexp.Regexp
+}
+
+func parseNodePoolPattern(entry string) (nodePoolPattern, error) {
+	var p nodePoolPattern
+	if strings.HasPrefix(entry, "!") {
+		p.exclude = true
+		entry = entry[1:]
+	}
+	if entry == "" {
+		return p, fmt.Errorf("empty nodepool pattern")
+	}
+
+	if len(entry) > 1 && strings.HasPrefix(entry, "/") && strings.HasSuffix(entry, "/") {
+		re, err := regexp.Compile(entry[1 : len(entry)-1])
+		if err != nil {
+			return p, fmt.Errorf("invalid nodepool regular expression %q: %v", entry, err)
+		}
+		p.re = re
+		return p, nil
+	}
+
+	if _, err := path.Match(entry, ""); err != nil {
+		return p, fmt.Errorf("invalid nodepool glob %q: %v", entry, err)
+	}
+	p.glob = entry
+	return p, nil
+}
+
+// literal reports whether the entry names a single nodepool.
+func (p nodePoolPattern) literal() bool {
+	return p.re == nil && !strings.ContainsAny(p.glob, `*?[\`)
+}
+
+func (p nodePoolPattern) matches(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	matched, _ := path.Match(p.glob, name)
+	return matched
+}
+
+// needsNodePoolList reports whether resolving the nodepools requires the
+// live list of NodePools, i.e. whether any entry is a pattern or exclusion.
+func (c ClusterConfig) needsNodePoolList() bool {
+	for _, np := range c.NodePools {
+		p, err := parseNodePoolPattern(np.Name)
+		if err != nil || p.exclude || !p.literal() {
+			return true
+		}
+	}
+	return false
+}
+
+// resolveNodePools expands the nodepool entries against the live NodePool
+// names, sorted by order. Exact names are kept even when the NodePool does
+// not exist so the failure is reported, patterns only match existing
+// NodePools and exclusions win over both. A list made only of exclusions
+// selects every other NodePool. Each NodePool takes its settings from the
+// first entry that selects it.
+func (c ClusterConfig) resolveNodePools(live []string) ([]managedNodePool, error) {
+	sortedLive := append([]string(nil), live...)
+	sort.Strings(sortedLive)
+
+	patterns := make([]nodePoolPattern, len(c.NodePools))
+	var excludes []nodePoolPattern
+	includes := 0
+	for i, np := range c.NodePools {
+		p, err := parseNodePoolPattern(np.Name)
+		if err != nil {
+			return nil, err
+		}
+		patterns[i] = p
+		if p.exclude {
+			excludes = append(excludes, p)
+		} else {
+			includes++
+		}
+	}
+
+	excluded := func(name string) bool {
+		for _, p := range excludes {
+			if p.matches(name) {
+				return true
+			}
+		}
+		return false
+	}
+
+	var nodePools []managedNodePool
+	seen := map[string]bool{}
+	add := func(name string, np NodePoolConfig) {
+		if seen[name] || excluded(name) {
+			return
+		}
+		seen[name] = true
+		nodePools = append(nodePools, c.managedNodePool(name, np))
+	}
+
+	for i, np := range c.NodePools {
+		p := patterns[i]
+		switch {
+		case p.exclude:
+			continue
+		case p.literal():
+			add(p.glob, np)
+		default:
+			for _, name := range sortedLive {
+				if p.matches(name) {
+					add(name, np)
+				}
+			}
+		}
+	}
+	if includes == 0 {
+		for _, name := range sortedLive {
+			add(name, NodePoolConfig{})
+		}
+	}
+
+	sort.SliceStable(nodePools, func(i, j int) bool {
+		return nodePools[i].Order < nodePools[j].Order
+	})
+	return nodePools, nil
+}
+
+// resolveClusterNodePools lists the cluster's NodePools when the
+// configuration uses patterns and resolves the nodepools to manage.
+func resolveClusterNodePools(ctx context.Context, dynamicClient dynamic.Interface, cluster ClusterConfig) ([]managedNodePool, error) {
+	var live []string
+	if cluster.needsNodePoolList() {
+		list, err := dynamicClient.Resource(nodePoolGVR).List(ctx, metav1.ListOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to list nodepools: %v", err)
+		}
+		for _, item := range list.Items {
+			live = append(live, item.GetName())
+		}
+	}
+
+	return cluster.resolveNodePools(live)
+}
+
+// selectsNodePool reports whether the entries select the named nodepool,
+// following the rules of resolveNodePools.
+func selectsNodePool(entries []string, name string) (bool, error) {
+	included, includes := false, 0
+	for _, entry := range entries {
+		p, err := parseNodePoolPattern(entry)
+		if err != nil {
+			return false, err
+		}
+		if p.exclude {
+			if p.matches(name) {
+				return false, nil
+			}
+			continue
+		}
+		includes++
+		included = included || p.matches(name)
+	}
+	return included || includes == 0, nil
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNodePoolPatternMatches(t *testing.T) {
+	tests := []struct {
+		entry   string
+		name    string
+		matches bool
+		literal bool
+	}{
+		{"default", "default", true, true},
+		{"default", "default-2", false, true},
+		{"team-*", "team-a", true, false},
+		{"team-?", "team-ab", false, false},
+		{"/^ci-.*/", "ci-runners", true, false},
+		{"/^ci-.*/", "my-ci-runners", false, false},
+		{"!system", "system", true, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.entry+"/"+tt.name, func(t *testing.T) {
+			p, err := parseNodePoolPattern(tt.entry)
+			require.NoError(t, err)
+			assert.Equal(t, tt.matches, p.matches(tt.name))
+			assert.Equal(t, tt.literal, p.literal())
+		})
+	}
+}
+
+func TestParseNodePoolPatternInvalid(t *testing.T) {
+	for _, entry := range []string{"!", "/ci-(/", "team-[a"} {
+		_, err := parseNodePoolPattern(entry)
+		assert.Error(t, err, entry)
+	}
+}
+
+func TestResolveNodePools(t *testing.T) {
+	first := -1
+	cluster := ClusterConfig{
+		Name:     "test-cluster",
+		Profiles: map[string]NodePoolProfile{"ci": {Order: &first}},
+		NodePools: []NodePoolConfig{
+			{Name: "team-*"},
+			{Name: "/^ci-.*/", Profile: "ci"},
+			{Name: "missing"},
+			{Name: "!team-b"},
+		},
+	}
+	live := []string{"team-b", "ci-runners", "team-a", "system"}
+
+	nodePools, err := cluster.resolveNodePools(live)
+	require.NoError(t, err)
+
+	var names []string
+	for _, np := range nodePools {
+		names = append(names, np.Name)
+	}
+	// Exact names are kept even if missing, the ci profile sorts its match first
+	assert.Equal(t, []string{"ci-runners", "team-a", "missing"}, names)
+	assert.True(t, cluster.needsNodePoolList())
+
+	// Exclusions alone select every other nodepool
+	cluster = ClusterConfig{Name: "test-cluster", NodePools: splitNodePools("!system")}
+	nodePools, err = cluster.resolveNodePools(live)
+	require.NoError(t, err)
+	assert.Len(t, nodePools, 3)
+
+	cluster = ClusterConfig{Name: "test-cluster", NodePools: splitNodePools("default,gpu")}
+	assert.False(t, cluster.needsNodePoolList())
+}
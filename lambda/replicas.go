@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// replicasAnnotation holds a workload's replica count from before shutdown.
+const replicasAnnotation = "shutdown-schedule/replicas"
+
+var (
+	deploymentGVR  = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "deployments"}
+	statefulSetGVR = schema.GroupVersionResource{Group: "apps", Version: "v1", Resource: "statefulsets"}
+)
+
+// replicaStep scales the Deployments and StatefulSets in scope to zero on
+// shutdown, so no pods are left pending overnight, and restores their
+// replica counts on startup.
+type replicaStep struct {
+	scope WorkloadConfig
+}
+
+func (s replicaStep) shutdown(ctx context.Context, dynamicClient dynamic.Interface) ([]WorkloadResult, error) {
+	return applyToWorkloads(ctx, dynamicClient, s.scope, scaleWorkloadToZero, deploymentGVR, statefulSetGVR)
+}
+
+func (s replicaStep) startup(ctx context.Context, dynamicClient dynamic.Interface) ([]WorkloadResult, error) {
+	return applyToWorkloads(ctx, dynamicClient, s.scope, restoreWorkloadReplicas, deploymentGVR, statefulSetGVR)
+}
+
+// scaleWorkloadToZero records the replica count and scales the workload to
+// zero. A workload already recorded keeps its count, so running shutdown
+// twice does not lose it.
+func scaleWorkloadToZero(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error) {
+	replicas, found, err := unstructured.NestedInt64(item.Object, "spec", "replicas")
+	if err != nil {
+		return "", fmt.Errorf("failed to read replicas: %v", err)
+	}
+	if !found {
+		// The API server defaults replicas to 1
+		replicas = 1
+	}
+
+	annotations := item.GetAnnotations()
+	if _, recorded := annotations[replicasAnnotation]; !recorded {
+		if replicas == 0 {
+			return nodePoolStatusSkipped, nil
+		}
+		if annotations == nil {
+			annotations = map[string]string{}
+		}
+		annotations[replicasAnnotation] = strconv.FormatInt(replicas, 10)
+		item.SetAnnotations(annotations)
+	} else if replicas == 0 {
+		return nodePoolStatusSkipped, nil
+	}
+
+	if err := unstructured.SetNestedField(item.Object, int64(0), "spec", "replicas"); err != nil {
+		return "", fmt.Errorf("failed to set replicas: %v", err)
+	}
+	if _, err := resource.Update(ctx, &item, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update: %v", err)
+	}
+	fmt.Printf("Scaled %s %s/%s to zero from %s replica(s)\n", item.GetKind(), item.GetNamespace(), item.GetName(), annotations[replicasAnnotation])
+	return nodePoolStatusUpdated, nil
+}
+
+// restoreWorkloadReplicas restores the recorded replica count and removes
+// the annotation.
+func restoreWorkloadReplicas(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error) {
+	annotations := item.GetAnnotations()
+	value, recorded := annotations[replicasAnnotation]
+	if !recorded {
+		return nodePoolStatusSkipped, nil
+	}
+	replicas, err := strconv.ParseInt(value, 10, 32)
+	if err != nil || replicas < 0 {
+		return "", fmt.Errorf("invalid %s annotation %q", replicasAnnotation, value)
+	}
+
+	if err := unstructured.SetNestedField(item.Object, replicas, "spec", "replicas"); err != nil {
+		return "", fmt.Errorf("failed to set replicas: %v", err)
+	}
+	delete(annotations, replicasAnnotation)
+	item.SetAnnotations(annotations)
+	if _, err := resource.Update(ctx, &item, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update: %v", err)
+	}
+	fmt.Printf("Restored %s %s/%s to %d replica(s)\n", item.GetKind(), item.GetNamespace(), item.GetName(), replicas)
+	return nodePoolStatusUpdated, nil
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestWorkload(kind, namespace, name string, replicas int64, labels map[string]string) *unstructured.Unstructured {
+	workload := &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "apps/v1",
+			"kind":       kind,
+			"metadata": map[string]interface{}{
+				"name":      name,
+				"namespace": namespace,
+			},
+			"spec": map[string]interface{}{
+				"replicas": replicas,
+			},
+		},
+	}
+	workload.SetLabels(labels)
+	return workload
+}
+
+func getWorkload(t *testing.T, client *fake.FakeDynamicClient, gvr schema.GroupVersionResource, namespace, name string) *unstructured.Unstructured {
+	workload, err := client.Resource(gvr).Namespace(namespace).Get(context.Background(), name, metav1.GetOptions{})
+	require.NoError(t, err)
+	return workload
+}
+
+func getReplicas(t *testing.T, client *fake.FakeDynamicClient, gvr schema.GroupVersionResource, namespace, name string) int64 {
+	replicas, _, err := unstructured.NestedInt64(getWorkload(t, client, gvr, namespace, name).Object, "spec", "replicas")
+	require.NoError(t, err)
+	return replicas
+}
+
+func TestReplicaStepNamespaces(t *testing.T) {
+	client := newFakeClient(
+		newTestWorkload("Deployment", "preview", "web", 3, nil),
+		newTestWorkload("StatefulSet", "preview", "db", 1, nil),
+		newTestWorkload("Deployment", "preview", "idle", 0, nil),
+		newTestWorkload("Deployment", "production", "web", 5, nil),
+	)
+	step := replicaStep{scope: WorkloadConfig{Namespaces: []string{"preview"}}}
+
+	results, err := step.shutdown(context.Background(), client)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []WorkloadResult{
+		{Kind: "Deployment", Namespace: "preview", Name: "web", Status: nodePoolStatusUpdated},
+		{Kind: "Deployment", Namespace: "preview", Name: "idle", Status: nodePoolStatusSkipped},
+		{Kind: "StatefulSet", Namespace: "preview", Name: "db", Status: nodePoolStatusUpdated},
+	}, results)
+	assert.Equal(t, int64(0), getReplicas(t, client, deploymentGVR, "preview", "web"))
+	assert.Equal(t, "3", getWorkload(t, client, deploymentGVR, "preview", "web").GetAnnotations()[replicasAnnotation])
+	assert.Equal(t, int64(0), getReplicas(t, client, statefulSetGVR, "preview", "db"))
+	assert.Equal(t, int64(5), getReplicas(t, client, deploymentGVR, "production", "web"))
+
+	// Running shutdown again keeps the recorded count
+	_, err = step.shutdown(context.Background(), client)
+	require.NoError(t, err)
+	assert.Equal(t, "3", getWorkload(t, client, deploymentGVR, "preview", "web").GetAnnotations()[replicasAnnotation])
+
+	_, err = step.startup(context.Background(), client)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), getReplicas(t, client, deploymentGVR, "preview", "web"))
+	assert.NotContains(t, getWorkload(t, client, deploymentGVR, "preview", "web").GetAnnotations(), replicasAnnotation)
+	assert.Equal(t, int64(1), getReplicas(t, client, statefulSetGVR, "preview", "db"))
+	assert.Equal(t, int64(0), getReplicas(t, client, deploymentGVR, "preview", "idle"))
+}
+
+func TestReplicaStepSelector(t *testing.T) {
+	optIn := map[string]string{"shutdown-schedule/scale-to-zero": "true"}
+	client := newFakeClient(
+		newTestWorkload("Deployment", "team-a", "worker", 2, optIn),
+		newTestWorkload("Deployment", "team-a", "api", 2, nil),
+		newTestWorkload("Deployment", "team-b", "worker", 4, optIn),
+	)
+	step := replicaStep{scope: WorkloadConfig{Selector: "shutdown-schedule/scale-to-zero=true"}}
+
+	_, err := step.shutdown(context.Background(), client)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), getReplicas(t, client, deploymentGVR, "team-a", "worker"))
+	assert.Equal(t, int64(2), getReplicas(t, client, deploymentGVR, "team-a", "api"))
+	assert.Equal(t, int64(0), getReplicas(t, client, deploymentGVR, "team-b", "worker"))
+}
+
+func TestRestoreWorkloadReplicasInvalidAnnotation(t *testing.T) {
+	workload := newTestWorkload("Deployment", "preview", "web", 0, nil)
+	workload.SetAnnotations(map[string]string{replicasAnnotation: "many"})
+	client := newFakeClient(workload)
+	step := replicaStep{scope: WorkloadConfig{Namespaces: []string{"preview"}}}
+
+	results, err := step.startup(context.Background(), client)
+	assert.ErrorContains(t, err, `Deployment preview/web: invalid shutdown-schedule/replicas annotation "many"`)
+	require.Len(t, results, 1)
+	assert.Equal(t, nodePoolStatusFailed, results[0].Status)
+}
+
+func TestProcessClusterWorkloads(t *testing.T) {
+	client := newFakeClient(
+		newTestNodePool("default", map[string]interface{}{"cpu": "1000"}),
+		newTestWorkload("Deployment", "preview", "web", 3, nil),
+	)
+	originalFactory := newClusterClient
+	newClusterClient = func(ctx context.Context, cluster ClusterConfig) (dynamic.Interface, error) {
+		return client, nil
+	}
+	defer func() { newClusterClient = originalFactory }()
+
+	keep := false
+	cluster := ClusterConfig{
+		Name:      "test-cluster",
+		NodePools: []NodePoolConfig{{Name: "default", NodePoolProfile: NodePoolProfile{TerminateInstances: &keep}}},
+		Workloads: &WorkloadConfig{Namespaces: []string{"preview"}},
+	}
+
+	result, err := processCluster(context.Background(), "shutdown", cluster, nil)
+	require.NoError(t, err)
+	assert.Equal(t, []WorkloadResult{{Kind: "Deployment", Namespace: "preview", Name: "web", Status: nodePoolStatusUpdated}}, result.Workloads)
+	assert.Equal(t, int64(0), getReplicas(t, client, deploymentGVR, "preview", "web"))
+
+	result, err = processCluster(context.Background(), "startup", cluster, nil)
+	require.NoError(t, err)
+	assert.Len(t, result.Workloads, 1)
+	assert.Equal(t, int64(3), getReplicas(t, client, deploymentGVR, "preview", "web"))
+
+	// Other actions leave workloads alone
+	result, err = processCluster(context.Background(), "spot", cluster, nil)
+	require.NoError(t, err)
+	assert.Empty(t, result.Workloads)
+}
+
+func TestProcessClusterStartupWorkloadsAfterNodePoolFailure(t *testing.T) {
+	client := newFakeClient(
+		newTestNodePool("default", map[string]interface{}{"cpu": "1000"}),
+		newTestWorkload("Deployment", "preview", "web", 3, nil),
+	)
+	originalFactory := newClusterClient
+	newClusterClient = func(ctx context.Context, cluster ClusterConfig) (dynamic.Interface, error) {
+		return client, nil
+	}
+	defer func() { newClusterClient = originalFactory }()
+
+	keep := false
+	cluster := ClusterConfig{
+		Name:      "test-cluster",
+		NodePools: []NodePoolConfig{{Name: "default", NodePoolProfile: NodePoolProfile{TerminateInstances: &keep}}},
+		Workloads: &WorkloadConfig{Namespaces: []string{"preview"}},
+	}
+
+	_, err := processCluster(context.Background(), "shutdown", cluster, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), getReplicas(t, client, deploymentGVR, "preview", "web"))
+
+	client.PrependReactor("update", "nodepools", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("admission webhook denied the request")
+	})
+
+	// The workloads are restored even though the nodepool failed to start
+	result, err := processCluster(context.Background(), "startup", cluster, nil)
+	assert.ErrorContains(t, err, "admission webhook denied the request")
+	assert.Equal(t, []WorkloadResult{{Kind: "Deployment", Namespace: "preview", Name: "web", Status: nodePoolStatusUpdated}}, result.Workloads)
+	assert.Equal(t, int64(3), getReplicas(t, client, deploymentGVR, "preview", "web"))
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+// restoreAnnotation holds what a night-time action changed on a NodePool, so
+// startup can put it back.
+const restoreAnnotation = "shutdown-schedule/restore"
+
+// restoreState is the content of the restoreAnnotation.
+type restoreState struct {
+	// Limits are the daytime spec.limits
+	Limits map[string]string `json:"limits,omitempty"`
+	// Requirements are the daytime spec.template.spec.requirements, nil
+	// when they were not recorded and empty when the nodepool had none
+	Requirements *[]interface{} `json:"requirements,omitempty"`
+}
+
+// getRestoreState reads the restoreAnnotation, returning nil when the
+// nodepool has none.
+func getRestoreState(nodePool *unstructured.Unstructured) (*restoreState, error) {
+	value, ok := nodePool.GetAnnotations()[restoreAnnotation]
+	if !ok {
+		return nil, nil
+	}
+	var state restoreState
+	if err := json.Unmarshal([]byte(value), &state); err != nil {
+		return nil, fmt.Errorf("invalid %s annotation on nodepool %s: %v", restoreAnnotation, nodePool.GetName(), err)
+	}
+	return &state, nil
+}
+
+// recordRestoreState saves the nodepool's current limits and requirements
+// in the restoreAnnotation, unless an earlier night-time action already did,
+// so that running several actions or the same one twice keeps the daytime
+// values. The limits of a nodepool already shut down are not daytime values
+// and are left out. The annotation is written with the nodepool's next
+// update.
+func recordRestoreState(nodePool *unstructured.Unstructured) (*restoreState, error) {
+	state, err := getRestoreState(nodePool)
+	if err != nil {
+		return nil, err
+	}
+	if state == nil {
+		state = &restoreState{}
+	}
+	if len(state.Limits) == 0 {
+		limits, err := nodePoolLimits(nodePool)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read limits of nodepool %s: %v", nodePool.GetName(), err)
+		}
+		if limits["cpu"] == "0" {
+			fmt.Printf("Nodepool %s is already scaled down - not recording its limits\n", nodePool.GetName())
+		} else {
+			state.Limits = limits
+		}
+	}
+	if state.Requirements == nil {
+		requirements, _, err := unstructured.NestedSlice(nodePool.Object, "spec", "template", "spec", "requirements")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read requirements of nodepool %s: %v", nodePool.GetName(), err)
+		}
+		if requirements == nil {
+			requirements = []interface{}{}
+		}
+		state.Requirements = &requirements
+	}
+	if err := setRestoreState(nodePool, state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
+
+// restoreRequirements puts back the requirements recorded in the state,
+// including an empty list.
+func restoreRequirements(nodePool *unstructured.Unstructured, state *restoreState) error {
+	if state == nil || state.Requirements == nil {
+		return nil
+	}
+	if err := unstructured.SetNestedSlice(nodePool.Object, *state.Requirements, "spec", "template", "spec", "requirements"); err != nil {
+		return fmt.Errorf("failed to restore requirements for nodepool %s: %v", nodePool.GetName(), err)
+	}
+	fmt.Printf("Restoring requirements of nodepool %s saved before the night\n", nodePool.GetName())
+	return nil
+}
+
+func setRestoreState(nodePool *unstructured.Unstructured, state *restoreState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return fmt.Errorf("failed to encode %s annotation: %v", restoreAnnotation, err)
+	}
+	annotations := nodePool.GetAnnotations()
+	if annotations == nil {
+		annotations = map[string]string{}
+	}
+	annotations[restoreAnnotation] = string(data)
+	nodePool.SetAnnotations(annotations)
+	return nil
+}
+
+func removeRestoreState(nodePool *unstructured.Unstructured) {
+	annotations := nodePool.GetAnnotations()
+	if _, ok := annotations[restoreAnnotation]; !ok {
+		return
+	}
+	delete(annotations, restoreAnnotation)
+	nodePool.SetAnnotations(annotations)
+}
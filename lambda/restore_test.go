@@ -0,0 +1,39 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRestoreState(t *testing.T) {
+	nodePool := newTestNodePool("default", map[string]interface{}{"cpu": "4"})
+
+	state, err := getRestoreState(nodePool)
+	require.NoError(t, err)
+	assert.Nil(t, state)
+
+	require.NoError(t, setRestoreState(nodePool, &restoreState{Limits: map[string]string{"cpu": "40"}}))
+	assert.Equal(t, `{"limits":{"cpu":"40"}}`, nodePool.GetAnnotations()[restoreAnnotation])
+
+	state, err = getRestoreState(nodePool)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "40"}, state.Limits)
+
+	removeRestoreState(nodePool)
+	assert.NotContains(t, nodePool.GetAnnotations(), restoreAnnotation)
+
+	// Requirements are recorded even when the nodepool has none
+	_, err = recordRestoreState(nodePool)
+	require.NoError(t, err)
+	assert.Equal(t, `{"limits":{"cpu":"4"},"requirements":[]}`, nodePool.GetAnnotations()[restoreAnnotation])
+	state, err = getRestoreState(nodePool)
+	require.NoError(t, err)
+	require.NotNil(t, state.Requirements)
+	assert.Empty(t, *state.Requirements)
+
+	nodePool.SetAnnotations(map[string]string{restoreAnnotation: "{"})
+	_, err = getRestoreState(nodePool)
+	assert.ErrorContains(t, err, "invalid shutdown-schedule/restore annotation")
+}
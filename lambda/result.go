@@ -0,0 +1,61 @@
+package main
+
+// Nodepool outcomes reported in NodePoolResult.Status, also used for
+// WorkloadResult.Status.
+const (
+	nodePoolStatusUpdated = "updated"
+	nodePoolStatusSkipped = "skipped"
+	nodePoolStatusFailed  = "failed"
+	// nodePoolStatusRecreated nodepools were missing and recreated from a snapshot
+	nodePoolStatusRecreated = "recreated"
+	// nodePoolStatusScaled nodepools were reduced to their night-time capacity
+	nodePoolStatusScaled = "scaled"
+	// nodePoolStatusDeferred nodepools are left to a continuation of the run
+	nodePoolStatusDeferred = "deferred"
+	// nodePoolStatusBlocked nodepools kept running past the cut-off for
+	// their blocking workloads
+	nodePoolStatusBlocked = "blocked"
+	// nodePoolStatusKeptAwake nodepools were left running by a keep-awake
+	// annotation
+	nodePoolStatusKeptAwake = "kept-awake"
+	// nodePoolStatusOverridden nodepools were left alone by the overrides
+	// ConfigMap
+	nodePoolStatusOverridden = "overridden"
+)
+
+// RunResult is returned by the handler and records what happened in each cluster.
+type RunResult struct {
+	Action   string          `json:"action"`
+	Clusters []ClusterResult `json:"clusters"`
+	// Continuation is set when the run ran out of time, to resume it
+	Continuation *Continuation `json:"continuation,omitempty"`
+	// Continued reports whether the function invoked itself to resume the run
+	Continued bool `json:"continued,omitempty"`
+}
+
+type ClusterResult struct {
+	Name   string `json:"name"`
+	Region string `json:"region,omitempty"`
+	// ResolvedNodePools are the nodepools selected after expanding patterns
+	ResolvedNodePools []string         `json:"resolvedNodePools,omitempty"`
+	NodePools         []NodePoolResult `json:"nodePools,omitempty"`
+	// Workloads are the workloads changed around the nodepools
+	Workloads []WorkloadResult `json:"workloads,omitempty"`
+	Error     string           `json:"error,omitempty"`
+}
+
+type NodePoolResult struct {
+	Name   string `json:"name"`
+	Status string `json:"status"`
+	// Reason explains a deferred or blocked nodepool
+	Reason string `json:"reason,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+type WorkloadResult struct {
+	Kind      string `json:"kind"`
+	Namespace string `json:"namespace,omitempty"`
+	Name      string `json:"name"`
+	Status    string `json:"status"`
+	Error     string `json:"error,omitempty"`
+}
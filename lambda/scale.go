@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// NodeClaim removal orders of the scale action.
+const (
+	scaleRemoveNewest    = "newest"
+	scaleRemoveExpensive = "expensive"
+)
+
+// scaleNodePool reduces the nodepool's limits to its night-time capacity and
+// removes the NodeClaims that no longer fit, following the nodepool's
+// do-not-disrupt policy. The daytime limits are kept in the
+// restoreAnnotation for startup, and scaling again starts from them rather
+// than from the already reduced limits. A nodepool already shut down scales
+// from its snapshot or its configured limits instead.
+func scaleNodePool(ctx context.Context, dynamicClient dynamic.Interface, nodePool *unstructured.Unstructured, np managedNodePool, progress *clusterProgress) (string, error) {
+	if np.Scale == nil {
+		fmt.Printf("No scale configured for nodepool %s - skipping\n", np.Name)
+		return nodePoolStatusSkipped, nil
+	}
+
+	state, err := recordRestoreState(nodePool)
+	if err != nil {
+		return "", err
+	}
+
+	daytime := state.Limits
+	if len(daytime) == 0 {
+		snapshot, err := progress.latestSnapshot(ctx, np.Name)
+		if err != nil {
+			return "", err
+		}
+		if snapshot != nil && len(snapshot.Limits) > 0 {
+			daytime = snapshot.Limits
+		} else {
+			daytime = np.Limits
+		}
+	}
+	night, err := scaleLimits(daytime, *np.Scale)
+	if err != nil {
+		return "", fmt.Errorf("failed to scale limits of nodepool %s: %v", np.Name, err)
+	}
+
+	if err := setLimits(nodePool, night); err != nil {
+		return "", fmt.Errorf("failed to set limits for nodepool %s: %v", np.Name, err)
+	}
+	if _, err := dynamicClient.Resource(nodePoolGVR).Update(ctx, nodePool, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update nodepool %s: %v", np.Name, err)
+	}
+	fmt.Printf("Successfully scaled nodepool %s from %v to %v\n", np.Name, daytime, night)
+
+	if !np.DeleteNodeClaims {
+		fmt.Printf("Keeping nodeclaims of nodepool %s as configured\n", np.Name)
+		return nodePoolStatusScaled, nil
+	}
+	keep, err := applyDoNotDisruptPolicy(ctx, dynamicClient, np, progress)
+	if err != nil {
+		return "", err
+	}
+	if err := removeExcessNodeClaims(ctx, dynamicClient, np.Name, night, np.Scale.Remove, keep); err != nil {
+		return "", fmt.Errorf("failed to remove excess nodeclaims for nodepool %s: %v", np.Name, err)
+	}
+	return nodePoolStatusScaled, nil
+}
+
+// scaleLimits computes the night-time limits: the fraction of each daytime
+// limit, overridden by any absolute limits.
+func scaleLimits(daytime map[string]string, scale ScaleConfig) (map[string]string, error) {
+	night := map[string]string{}
+	if scale.Fraction != "" {
+		if len(daytime) == 0 {
+			return nil, fmt.Errorf("no daytime limits to take a fraction of")
+		}
+		fraction, err := parseFraction(scale.Fraction)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range daytime {
+			scaled, err := scaleQuantity(value, fraction)
+			if err != nil {
+				return nil, fmt.Errorf("limit %s: %v", name, err)
+			}
+			night[name] = scaled
+		}
+	}
+	for name, value := range scale.Limits {
+		night[name] = value
+	}
+	return night, nil
+}
+
+// parseFraction accepts "10%" or "0.1".
+func parseFraction(value string) (float64, error) {
+	var fraction float64
+	var err error
+	if percent, ok := strings.CutSuffix(value, "%"); ok {
+		fraction, err = strconv.ParseFloat(percent, 64)
+		fraction /= 100
+	} else {
+		fraction, err = strconv.ParseFloat(value, 64)
+	}
+	if err != nil || fraction < 0 || fraction > 1 {
+		return 0, fmt.Errorf("invalid fraction %q, expected a percentage or a number between 0 and 1", value)
+	}
+	return fraction, nil
+}
+
+// scaleQuantity multiplies a resource quantity, rounding up to the nearest milli unit.
+func scaleQuantity(value string, fraction float64) (string, error) {
+	quantity, err := resource.ParseQuantity(value)
+	if err != nil {
+		return "", err
+	}
+	milli := int64(math.Ceil(float64(quantity.MilliValue()) * fraction))
+	if milli%1000 == 0 {
+		return resource.NewQuantity(milli/1000, quantity.Format).String(), nil
+	}
+	return resource.NewMilliQuantity(milli, resource.DecimalSI).String(), nil
+}
+
+// removeExcessNodeClaims deletes NodeClaims of the nodepool, in the given
+// order, until the capacity of the remaining ones fits within the limits.
+// The NodeClaims of nodes in keep count towards the capacity but are not
+// deleted.
+func removeExcessNodeClaims(ctx context.Context, dynamicClient dynamic.Interface, nodePoolName string, limits map[string]string, order string, keep map[string]string) error {
+	labelSelector := fmt.Sprintf("karpenter.sh/nodepool=%s", nodePoolName)
+	nodeClaimList, err := dynamicClient.Resource(nodeClaimGVR).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return fmt.Errorf("failed to list nodeclaims with label selector %s: %v", labelSelector, err)
+	}
+
+	maximum := map[string]resource.Quantity{}
+	for name, value := range limits {
+		quantity, err := resource.ParseQuantity(value)
+		if err != nil {
+			return fmt.Errorf("invalid limit %s %q: %v", name, value, err)
+		}
+		maximum[name] = quantity
+	}
+
+	nodeClaims := nodeClaimList.Items
+	usage := map[string]*resource.Quantity{}
+	for _, nodeClaim := range nodeClaims {
+		for name, quantity := range nodeClaimCapacity(nodeClaim) {
+			if usage[name] == nil {
+				usage[name] = resource.NewQuantity(0, quantity.Format)
+			}
+			usage[name].Add(quantity)
+		}
+	}
+
+	sortNodeClaimsForRemoval(nodeClaims, order)
+
+	removed := 0
+	for _, nodeClaim := range nodeClaims {
+		if fitsLimits(usage, maximum) {
+			break
+		}
+		nodeName, _, _ := unstructured.NestedString(nodeClaim.Object, "status", "nodeName")
+		if _, ok := keep[nodeName]; ok {
+			fmt.Printf("Keeping nodeclaim %s of node %s\n", nodeClaim.GetName(), nodeName)
+			continue
+		}
+		fmt.Printf("Deleting excess nodeclaim: %s\n", nodeClaim.GetName())
+		if err := dynamicClient.Resource(nodeClaimGVR).Delete(ctx, nodeClaim.GetName(), metav1.DeleteOptions{}); err != nil {
+			return fmt.Errorf("failed to delete nodeclaim %s: %v", nodeClaim.GetName(), err)
+		}
+		for name, quantity := range nodeClaimCapacity(nodeClaim) {
+			usage[name].Sub(quantity)
+		}
+		removed++
+	}
+
+	fmt.Printf("Removed %d of %d nodeclaim(s) of nodepool %s\n", removed, len(nodeClaims), nodePoolName)
+	return nil
+}
+
+func nodeClaimCapacity(nodeClaim unstructured.Unstructured) map[string]resource.Quantity {
+	capacity, _, _ := unstructured.NestedStringMap(nodeClaim.Object, "status", "capacity")
+	quantities := map[string]resource.Quantity{}
+	for name, value := range capacity {
+		if quantity, err := resource.ParseQuantity(value); err == nil {
+			quantities[name] = quantity
+		}
+	}
+	return quantities
+}
+
+func fitsLimits(usage map[string]*resource.Quantity, maximum map[string]resource.Quantity) bool {
+	for name, limit := range maximum {
+		if used := usage[name]; used != nil && used.Cmp(limit) > 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// sortNodeClaimsForRemoval puts the NodeClaims to remove first at the front:
+// the newest, or the most expensive using on-demand before spot and then
+// the largest CPU capacity as a proxy for price.
+func sortNodeClaimsForRemoval(nodeClaims []unstructured.Unstructured, order string) {
+	newer := func(i, j int) bool {
+		ti, tj := nodeClaims[i].GetCreationTimestamp(), nodeClaims[j].GetCreationTimestamp()
+		return tj.Before(&ti)
+	}
+	if order != scaleRemoveExpensive {
+		sort.SliceStable(nodeClaims, newer)
+		return
+	}
+
+	sort.SliceStable(nodeClaims, func(i, j int) bool {
+		ci, cj := capacityTypeRank(nodeClaims[i]), capacityTypeRank(nodeClaims[j])
+		if ci != cj {
+			return ci < cj
+		}
+		cpuI, cpuJ := nodeClaimCapacity(nodeClaims[i])["cpu"], nodeClaimCapacity(nodeClaims[j])["cpu"]
+		if cmp := cpuI.Cmp(cpuJ); cmp != 0 {
+			return cmp > 0
+		}
+		return newer(i, j)
+	})
+}
+
+func capacityTypeRank(nodeClaim unstructured.Unstructured) int {
+	switch nodeClaim.GetLabels()["karpenter.sh/capacity-type"] {
+	case "on-demand":
+		return 0
+	case "spot":
+		return 1
+	}
+	return 2
+}
+
+// validateScale checks a scale setting.
+func validateScale(scale *ScaleConfig) error {
+	if scale == nil {
+		return nil
+	}
+	if scale.Fraction == "" && len(scale.Limits) == 0 {
+		return fmt.Errorf("scale needs a fraction or limits")
+	}
+	if scale.Fraction != "" {
+		if _, err := parseFraction(scale.Fraction); err != nil {
+			return fmt.Errorf("scale: %v", err)
+		}
+	}
+	for name, value := range scale.Limits {
+		if _, err := resource.ParseQuantity(value); err != nil {
+			return fmt.Errorf("scale: invalid limit %s %q", name, value)
+		}
+	}
+	switch scale.Remove {
+	case "", scaleRemoveNewest, scaleRemoveExpensive:
+	default:
+		return fmt.Errorf("scale: invalid remove order %q, expected %s or %s", scale.Remove, scaleRemoveNewest, scaleRemoveExpensive)
+	}
+	return nil
+}
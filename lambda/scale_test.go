@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic/fake"
+)
+
+func newSizedTestNodeClaim(name, nodePoolName, capacityType, cpu string, created time.Time) *unstructured.Unstructured {
+	nodeClaim := newTestNodeClaim(name, nodePoolName)
+	nodeClaim.SetCreationTimestamp(metav1.NewTime(created))
+	labels := nodeClaim.GetLabels()
+	labels["karpenter.sh/capacity-type"] = capacityType
+	nodeClaim.SetLabels(labels)
+	_ = unstructured.SetNestedStringMap(nodeClaim.Object, map[string]string{"cpu": cpu}, "status", "capacity")
+	return nodeClaim
+}
+
+func remainingNodeClaims(t *testing.T, client *fake.FakeDynamicClient) []string {
+	list, err := client.Resource(nodeClaimGVR).List(context.Background(), metav1.ListOptions{})
+	require.NoError(t, err)
+	var names []string
+	for _, item := range list.Items {
+		names = append(names, item.GetName())
+	}
+	return names
+}
+
+func TestScaleLimits(t *testing.T) {
+	daytime := map[string]string{"cpu": "1000", "memory": "400Gi"}
+
+	night, err := scaleLimits(daytime, ScaleConfig{Fraction: "10%"})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "100", "memory": "40Gi"}, night)
+
+	// Fractions round up and absolute limits win
+	night, err = scaleLimits(map[string]string{"cpu": "5"}, ScaleConfig{Fraction: "0.25", Limits: map[string]string{"memory": "8Gi"}})
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "1250m", "memory": "8Gi"}, night)
+
+	_, err = scaleLimits(nil, ScaleConfig{Fraction: "10%"})
+	assert.ErrorContains(t, err, "no daytime limits")
+}
+
+func TestParseFraction(t *testing.T) {
+	for value, expected := range map[string]float64{"10%": 0.1, "0.5": 0.5, "0": 0, "100%": 1} {
+		fraction, err := parseFraction(value)
+		require.NoError(t, err, value)
+		assert.InDelta(t, expected, fraction, 1e-9, value)
+	}
+	for _, value := range []string{"", "abc", "150%", "-0.1", "2"} {
+		_, err := parseFraction(value)
+		assert.Error(t, err, value)
+	}
+}
+
+func TestValidateScale(t *testing.T) {
+	assert.NoError(t, validateScale(nil))
+	assert.NoError(t, validateScale(&ScaleConfig{Fraction: "10%", Remove: "expensive"}))
+	assert.ErrorContains(t, validateScale(&ScaleConfig{}), "needs a fraction or limits")
+	assert.ErrorContains(t, validateScale(&ScaleConfig{Limits: map[string]string{"cpu": "lots"}}), "invalid limit cpu")
+	assert.ErrorContains(t, validateScale(&ScaleConfig{Fraction: "10%", Remove: "oldest"}), "invalid remove order")
+}
+
+func TestProcessNodePoolsScaleAndStartup(t *testing.T) {
+	now := time.Now()
+	client := newFakeClient(
+		newTestNodePool("default", map[string]interface{}{"cpu": "40"}),
+		newSizedTestNodeClaim("oldest", "default", "on-demand", "4", now.Add(-3*time.Hour)),
+		newSizedTestNodeClaim("older", "default", "spot", "8", now.Add(-2*time.Hour)),
+		newSizedTestNodeClaim("newest", "default", "spot", "4", now.Add(-time.Hour)),
+	)
+	cluster := ClusterConfig{Name: "test-cluster", NodePools: splitNodePools("default"), Scale: &ScaleConfig{Fraction: "10%"}}
+
+	results, err := processConfiguredNodePools(t, client, "scale", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{{Name: "default", Status: nodePoolStatusScaled}}, results)
+	assert.Equal(t, map[string]string{"cpu": "4"}, getNodePoolLimits(t, client, "default"))
+	assert.Equal(t, []string{"oldest"}, remainingNodeClaims(t, client))
+
+	// Scaling again starts from the daytime limits, not the night ones
+	_, err = processConfiguredNodePools(t, client, "scale", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "4"}, getNodePoolLimits(t, client, "default"))
+
+	_, err = processConfiguredNodePools(t, client, "startup", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "40"}, getNodePoolLimits(t, client, "default"))
+
+	np, err := client.Resource(nodePoolGVR).Get(context.Background(), "default", metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.NotContains(t, np.GetAnnotations(), restoreAnnotation)
+}
+
+func TestProcessNodePoolsScaleExpensiveFirst(t *testing.T) {
+	now := time.Now()
+	client := newFakeClient(
+		newTestNodePool("default", map[string]interface{}{"cpu": "100"}),
+		newSizedTestNodeClaim("small-spot", "default", "spot", "4", now.Add(-time.Hour)),
+		newSizedTestNodeClaim("large-spot", "default", "spot", "16", now.Add(-2*time.Hour)),
+		newSizedTestNodeClaim("small-on-demand", "default", "on-demand", "4", now.Add(-3*time.Hour)),
+	)
+	cluster := ClusterConfig{
+		Name:      "test-cluster",
+		NodePools: splitNodePools("default"),
+		Scale:     &ScaleConfig{Limits: map[string]string{"cpu": "8"}, Remove: scaleRemoveExpensive},
+	}
+
+	_, err := processConfiguredNodePools(t, client, "scale", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "8"}, getNodePoolLimits(t, client, "default"))
+	assert.Equal(t, []string{"small-spot"}, remainingNodeClaims(t, client))
+}
+
+func TestProcessNodePoolsScaleIntegerLimits(t *testing.T) {
+	client := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": int64(40)}))
+	cluster := ClusterConfig{Name: "test-cluster", NodePools: splitNodePools("default"), Scale: &ScaleConfig{Fraction: "10%"}}
+
+	results, err := processConfiguredNodePools(t, client, "scale", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{{Name: "default", Status: nodePoolStatusScaled}}, results)
+	assert.Equal(t, map[string]string{"cpu": "4"}, getNodePoolLimits(t, client, "default"))
+
+	_, err = processConfiguredNodePools(t, client, "startup", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "40"}, getNodePoolLimits(t, client, "default"))
+}
+
+func TestProcessNodePoolsScaleAddedLimitsRemovedOnStartup(t *testing.T) {
+	client := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": "40"}))
+	cluster := ClusterConfig{
+		Name:      "test-cluster",
+		NodePools: splitNodePools("default"),
+		Scale:     &ScaleConfig{Limits: map[string]string{"cpu": "4", "memory": "16Gi"}},
+	}
+
+	_, err := processConfiguredNodePools(t, client, "scale", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "4", "memory": "16Gi"}, getNodePoolLimits(t, client, "default"))
+
+	// The memory limit was not there during the day, so startup drops it
+	_, err = processConfiguredNodePools(t, client, "startup", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "40"}, getNodePoolLimits(t, client, "default"))
+}
+
+func TestProcessNodePoolsScaleAfterShutdown(t *testing.T) {
+	client := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": "0"}))
+	cluster := ClusterConfig{
+		Name:      "test-cluster",
+		NodePools: splitNodePools("default"),
+		Limits:    map[string]string{"cpu": "40"},
+		Scale:     &ScaleConfig{Fraction: "10%"},
+	}
+
+	_, err := processConfiguredNodePools(t, client, "scale", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "4"}, getNodePoolLimits(t, client, "default"))
+
+	np, err := client.Resource(nodePoolGVR).Get(context.Background(), "default", metav1.GetOptions{})
+	require.NoError(t, err)
+	state, err := getRestoreState(np)
+	require.NoError(t, err)
+	assert.Empty(t, state.Limits)
+
+	// Startup restores the configured limits rather than the shut down ones
+	_, err = processConfiguredNodePools(t, client, "startup", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "40"}, getNodePoolLimits(t, client, "default"))
+}
+
+func TestProcessNodePoolsScaleWithoutConfig(t *testing.T) {
+	client := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": "40"}))
+	cluster := ClusterConfig{Name: "test-cluster", NodePools: splitNodePools("default")}
+
+	results, err := processConfiguredNodePools(t, client, "scale", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{{Name: "default", Status: nodePoolStatusSkipped}}, results)
+	assert.Equal(t, map[string]string{"cpu": "40"}, getNodePoolLimits(t, client, "default"))
+}
@@ -3,34 +3,50 @@ package main
 import (
 	"context"
 	"fmt"
-	"os"
+	"slices"
 
-	"github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/aws"
 	"github.com/aws/aws-sdk-go-v2/service/ec2"
 	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 )
 
-// ShutdownEC2Instances terminates EC2 instances with tags matching the given nodepools.
-func ShutdownEC2Instances(ctx context.Context, nodePoolNames []string) error {
+type ec2API interface {
+	DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error)
+	TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error)
+}
+
+// newEC2Client is swapped out in tests to avoid talking to AWS.
+var newEC2Client = func(cfg aws.Config) ec2API {
+	return ec2.NewFromConfig(cfg)
+}
+
+// ShutdownEC2Instances terminates the EC2 instances of the cluster with tags
+// matching the given nodepools. Karpenter tags its instances with
+// kubernetes.io/cluster/<name>, which keeps clusters sharing an account,
+// region and nodepool names apart. cfg carries the region and, for clusters
+// in other accounts, the assumed role. Instances listed in keep are left
+// running.
+func ShutdownEC2Instances(ctx context.Context, cfg aws.Config, clusterName string, nodePoolNames []string, keep []string) error {
 	if len(nodePoolNames) == 0 {
 		return fmt.Errorf("no nodepool names provided")
 	}
-
-	cfg, err := config.LoadDefaultConfig(ctx, config.WithRegion(os.Getenv("AWS_REGION")))
-	if err != nil {
-		return fmt.Errorf("failed to load AWS configuration: %v", err)
+	if clusterName == "" {
+		return fmt.Errorf("no cluster name provided")
 	}
 
-	ec2Svc := ec2.NewFromConfig(cfg)
+	ec2Svc := newEC2Client(cfg)
 
-	// Build filters for all nodepools
-	ec2NodeTagKey := "tag:karpenter.sh/nodepool"
+	// Build filters for all nodepools of the cluster
 	input := &ec2.DescribeInstancesInput{
 		Filters: []types.Filter{
 			{
-				Name:   &ec2NodeTagKey,
+				Name:   aws.String("tag:karpenter.sh/nodepool"),
 				Values: nodePoolNames,
 			},
+			{
+				Name:   aws.String("tag-key"),
+				Values: []string{"kubernetes.io/cluster/" + clusterName},
+			},
 		},
 	}
 
@@ -42,6 +58,10 @@ func ShutdownEC2Instances(ctx context.Context, nodePoolNames []string) error {
 	var instanceIds []string
 	for _, reservation := range result.Reservations {
 		for _, instance := range reservation.Instances {
+			if slices.Contains(keep, *instance.InstanceId) {
+				fmt.Printf("Keeping instance %s running\n", *instance.InstanceId)
+				continue
+			}
 			instanceIds = append(instanceIds, *instance.InstanceId)
 		}
 	}
@@ -57,7 +77,7 @@ func ShutdownEC2Instances(ctx context.Context, nodePoolNames []string) error {
 		}
 		fmt.Printf("Successfully terminated %d instance(s)\n", len(instanceIds))
 	} else {
-		fmt.Printf("Found no matching EC2 instances for nodepools: %v\n", nodePoolNames)
+		fmt.Printf("Found no matching EC2 instances of cluster %s for nodepools: %v\n", clusterName, nodePoolNames)
 	}
 
 	return nil
@@ -3,16 +3,53 @@ package main
 import (
 	"context"
 	"os"
+	"slices"
+	"strings"
 	"testing"
 
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/ec2"
+	"github.com/aws/aws-sdk-go-v2/service/ec2/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
+// fakeEC2 serves instances by their tags, applying the tag and tag-key
+// filters of DescribeInstances.
+type fakeEC2 struct {
+	instances  map[string]map[string]string
+	terminated []string
+}
+
+func (f *fakeEC2) DescribeInstances(ctx context.Context, params *ec2.DescribeInstancesInput, optFns ...func(*ec2.Options)) (*ec2.DescribeInstancesOutput, error) {
+	var instances []types.Instance
+	for id, tags := range f.instances {
+		matches := true
+		for _, filter := range params.Filters {
+			name := aws.ToString(filter.Name)
+			if name == "tag-key" {
+				matches = matches && slices.ContainsFunc(filter.Values, func(key string) bool { _, ok := tags[key]; return ok })
+			} else if key, ok := strings.CutPrefix(name, "tag:"); ok {
+				matches = matches && slices.Contains(filter.Values, tags[key])
+			}
+		}
+		if matches {
+			instances = append(instances, types.Instance{InstanceId: aws.String(id)})
+		}
+	}
+	return &ec2.DescribeInstancesOutput{Reservations: []types.Reservation{{Instances: instances}}}, nil
+}
+
+func (f *fakeEC2) TerminateInstances(ctx context.Context, params *ec2.TerminateInstancesInput, optFns ...func(*ec2.Options)) (*ec2.TerminateInstancesOutput, error) {
+	f.terminated = append(f.terminated, params.InstanceIds...)
+	return &ec2.TerminateInstancesOutput{}, nil
+}
+
 func TestShutdownEC2InstancesMissingNodepools(t *testing.T) {
 	ctx := context.Background()
 
 	// Test with empty nodepool names
-	err := ShutdownEC2Instances(ctx, []string{})
+	err := ShutdownEC2Instances(ctx, aws.Config{}, "test-cluster", []string{}, nil)
 
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "no nodepool names provided")
@@ -28,8 +65,11 @@ func TestShutdownEC2InstancesWithNodepools(t *testing.T) {
 	}()
 
 	// Test with valid nodepool names
+	cfg, err := loadAWSConfig(ctx, os.Getenv("AWS_REGION"), assumeRoleConfig{})
+	assert.NoError(t, err)
+
 	nodepools := []string{"test-pool-1", "test-pool-2"}
-	err := ShutdownEC2Instances(ctx, nodepools)
+	err = ShutdownEC2Instances(ctx, cfg, "test-cluster", nodepools, nil)
 
 	// In a test environment, the function may succeed if AWS config loads but no instances found
 	// or it may fail if AWS credentials are not available
@@ -38,3 +78,17 @@ func TestShutdownEC2InstancesWithNodepools(t *testing.T) {
 		assert.NotContains(t, err.Error(), "no nodepool names provided")
 	}
 }
+
+func TestShutdownEC2InstancesSharedNodePoolName(t *testing.T) {
+	client := &fakeEC2{instances: map[string]map[string]string{
+		"i-dev":     {"karpenter.sh/nodepool": "default", "kubernetes.io/cluster/dev": "owned"},
+		"i-dev-gpu": {"karpenter.sh/nodepool": "gpu", "kubernetes.io/cluster/dev": "owned"},
+		"i-staging": {"karpenter.sh/nodepool": "default", "kubernetes.io/cluster/staging": "owned"},
+	}}
+	originalFactory := newEC2Client
+	newEC2Client = func(cfg aws.Config) ec2API { return client }
+	defer func() { newEC2Client = originalFactory }()
+
+	require.NoError(t, ShutdownEC2Instances(context.Background(), aws.Config{}, "dev", []string{"default"}, nil))
+	assert.Equal(t, []string{"i-dev"}, client.terminated)
+}
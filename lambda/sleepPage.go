@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	utiljson "k8s.io/apimachinery/pkg/util/json"
+	"k8s.io/client-go/dynamic"
+)
+
+const (
+	// sleepAnnotation opts an Ingress or HTTPRoute into the sleep page
+	sleepAnnotation = "shutdown-schedule/sleep"
+	// originalSpecAnnotation holds a route's spec from before shutdown, as JSON
+	originalSpecAnnotation = "shutdown-schedule/original-spec"
+)
+
+var (
+	ingressGVR   = schema.GroupVersionResource{Group: "networking.k8s.io", Version: "v1", Resource: "ingresses"}
+	httpRouteGVR = schema.GroupVersionResource{Group: "gateway.networking.k8s.io", Version: "v1", Resource: "httproutes"}
+)
+
+// sleepPageStep points the Ingresses and HTTPRoutes annotated with
+// sleepAnnotation at the sleep page Service on shutdown, so visitors see
+// that the environment is asleep rather than connection errors, and puts
+// their original spec back on startup.
+type sleepPageStep struct {
+	config SleepPageConfig
+}
+
+func (s sleepPageStep) shutdown(ctx context.Context, dynamicClient dynamic.Interface) ([]WorkloadResult, error) {
+	ingresses, err := s.apply(ctx, dynamicClient, ingressGVR, func(item *unstructured.Unstructured) error {
+		return sleepIngress(item, s.config)
+	})
+	routes, routeErr := s.apply(ctx, dynamicClient, httpRouteGVR, func(item *unstructured.Unstructured) error {
+		return sleepHTTPRoute(item, s.config)
+	})
+	return append(ingresses, routes...), errors.Join(err, routeErr)
+}
+
+func (s sleepPageStep) startup(ctx context.Context, dynamicClient dynamic.Interface) ([]WorkloadResult, error) {
+	ingresses, err := applyToWorkloads(ctx, dynamicClient, WorkloadConfig{}, wakeRoute, ingressGVR)
+	routes, routeErr := applyToWorkloads(ctx, dynamicClient, WorkloadConfig{}, wakeRoute, httpRouteGVR)
+	return append(ingresses, routes...), errors.Join(err, routeErr)
+}
+
+// apply saves the spec of every opted-in route not yet asleep and rewrites
+// its backends.
+func (s sleepPageStep) apply(ctx context.Context, dynamicClient dynamic.Interface, gvr schema.GroupVersionResource, rewrite func(item *unstructured.Unstructured) error) ([]WorkloadResult, error) {
+	var results []WorkloadResult
+	var errs []error
+	items, err := listWorkloads(ctx, dynamicClient, gvr, WorkloadConfig{})
+	if err != nil {
+		return nil, err
+	}
+	for _, item := range items {
+		annotations := item.GetAnnotations()
+		if annotations[sleepAnnotation] != "true" {
+			continue
+		}
+		status, err := sleepRoute(ctx, dynamicClient.Resource(gvr).Namespace(item.GetNamespace()), item, rewrite)
+		results = append(results, workloadResult(item, status, err))
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s %s/%s: %v", item.GetKind(), item.GetNamespace(), item.GetName(), err))
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+func sleepRoute(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured, rewrite func(item *unstructured.Unstructured) error) (string, error) {
+	annotations := item.GetAnnotations()
+	if _, asleep := annotations[originalSpecAnnotation]; asleep {
+		return nodePoolStatusSkipped, nil
+	}
+
+	spec, _, err := unstructured.NestedMap(item.Object, "spec")
+	if err != nil {
+		return "", fmt.Errorf("failed to read spec: %v", err)
+	}
+	data, err := json.Marshal(spec)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode spec: %v", err)
+	}
+	annotations[originalSpecAnnotation] = string(data)
+	item.SetAnnotations(annotations)
+	if err := rewrite(&item); err != nil {
+		return "", err
+	}
+	if _, err := resource.Update(ctx, &item, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update: %v", err)
+	}
+	fmt.Printf("Pointed %s %s/%s at the sleep page\n", item.GetKind(), item.GetNamespace(), item.GetName())
+	return nodePoolStatusUpdated, nil
+}
+
+// sleepIngress sends every path and the default backend to the sleep page.
+func sleepIngress(item *unstructured.Unstructured, config SleepPageConfig) error {
+	backend := map[string]interface{}{
+		"service": map[string]interface{}{
+			"name": config.Service,
+			"port": map[string]interface{}{"number": int64(config.Port)},
+		},
+	}
+
+	if _, found, _ := unstructured.NestedMap(item.Object, "spec", "defaultBackend"); found {
+		if err := unstructured.SetNestedField(item.Object, backend, "spec", "defaultBackend"); err != nil {
+			return fmt.Errorf("failed to set defaultBackend: %v", err)
+		}
+	}
+	rules, _, err := unstructured.NestedSlice(item.Object, "spec", "rules")
+	if err != nil {
+		return fmt.Errorf("failed to read rules: %v", err)
+	}
+	for _, r := range rules {
+		rule, ok := r.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		paths, _, _ := unstructured.NestedSlice(rule, "http", "paths")
+		for _, p := range paths {
+			if path, ok := p.(map[string]interface{}); ok {
+				path["backend"] = runtime.DeepCopyJSONValue(backend)
+			}
+		}
+		if len(paths) > 0 {
+			if err := unstructured.SetNestedSlice(rule, paths, "http", "paths"); err != nil {
+				return fmt.Errorf("failed to set paths: %v", err)
+			}
+		}
+	}
+	return unstructured.SetNestedSlice(item.Object, rules, "spec", "rules")
+}
+
+// sleepHTTPRoute sends every rule to the sleep page.
+func sleepHTTPRoute(item *unstructured.Unstructured, config SleepPageConfig) error {
+	rules, _, err := unstructured.NestedSlice(item.Object, "spec", "rules")
+	if err != nil {
+		return fmt.Errorf("failed to read rules: %v", err)
+	}
+	for _, r := range rules {
+		if rule, ok := r.(map[string]interface{}); ok {
+			rule["backendRefs"] = []interface{}{
+				map[string]interface{}{"name": config.Service, "port": int64(config.Port)},
+			}
+		}
+	}
+	return unstructured.SetNestedSlice(item.Object, rules, "spec", "rules")
+}
+
+// wakeRoute puts back the spec saved by sleepRoute.
+func wakeRoute(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error) {
+	annotations := item.GetAnnotations()
+	value, asleep := annotations[originalSpecAnnotation]
+	if !asleep {
+		return nodePoolStatusSkipped, nil
+	}
+	var spec map[string]interface{}
+	// Decoded like the API machinery does, keeping integers as int64
+	if err := utiljson.Unmarshal([]byte(value), &spec); err != nil {
+		return "", fmt.Errorf("invalid %s annotation: %v", originalSpecAnnotation, err)
+	}
+
+	item.Object["spec"] = spec
+	delete(annotations, originalSpecAnnotation)
+	item.SetAnnotations(annotations)
+	if _, err := resource.Update(ctx, &item, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update: %v", err)
+	}
+	fmt.Printf("Restored the backends of %s %s/%s\n", item.GetKind(), item.GetNamespace(), item.GetName())
+	return nodePoolStatusUpdated, nil
+}
+
+// validateSleepPage checks a sleep page setting.
+func validateSleepPage(config *SleepPageConfig) error {
+	if config == nil {
+		return nil
+	}
+	if config.Service == "" {
+		return fmt.Errorf("sleepPage: service is required")
+	}
+	if config.Port < 1 || config.Port > 65535 {
+		return fmt.Errorf("sleepPage: invalid port %d", config.Port)
+	}
+	return nil
+}
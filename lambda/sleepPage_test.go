@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func newTestRoute(apiVersion, kind, namespace, name string, annotations map[string]string, spec map[string]interface{}) *unstructured.Unstructured {
+	route := newTestGitOpsResource(apiVersion, kind, namespace, name, spec)
+	route.SetAnnotations(annotations)
+	return route
+}
+
+func TestSleepPageStep(t *testing.T) {
+	optIn := map[string]string{sleepAnnotation: "true"}
+	ingressSpec := map[string]interface{}{
+		"ingressClassName": "alb",
+		"rules": []interface{}{
+			map[string]interface{}{
+				"host": "app.dev.example.com",
+				"http": map[string]interface{}{
+					"paths": []interface{}{
+						map[string]interface{}{
+							"path":     "/api",
+							"pathType": "Prefix",
+							"backend": map[string]interface{}{
+								"service": map[string]interface{}{"name": "api", "port": map[string]interface{}{"number": int64(8080)}},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+	routeSpec := map[string]interface{}{
+		"hostnames": []interface{}{"web.dev.example.com"},
+		"rules": []interface{}{
+			map[string]interface{}{
+				"backendRefs": []interface{}{map[string]interface{}{"name": "web", "port": int64(80)}},
+			},
+		},
+	}
+	client := newFakeClient(
+		newTestRoute("networking.k8s.io/v1", "Ingress", "preview", "app", optIn, ingressSpec),
+		newTestRoute("networking.k8s.io/v1", "Ingress", "preview", "admin", nil, map[string]interface{}{}),
+		newTestRoute("gateway.networking.k8s.io/v1", "HTTPRoute", "preview", "web", optIn, routeSpec),
+	)
+	step := sleepPageStep{config: SleepPageConfig{Service: "sleep-page", Port: 80}}
+
+	results, err := step.shutdown(context.Background(), client)
+	require.NoError(t, err)
+	assert.Equal(t, []WorkloadResult{
+		{Kind: "Ingress", Namespace: "preview", Name: "app", Status: nodePoolStatusUpdated},
+		{Kind: "HTTPRoute", Namespace: "preview", Name: "web", Status: nodePoolStatusUpdated},
+	}, results)
+
+	ingress := getWorkload(t, client, ingressGVR, "preview", "app")
+	service, _, _ := unstructured.NestedSlice(ingress.Object, "spec", "rules")
+	backend, _, _ := unstructured.NestedMap(service[0].(map[string]interface{}), "http")
+	assert.Equal(t, map[string]interface{}{
+		"service": map[string]interface{}{"name": "sleep-page", "port": map[string]interface{}{"number": int64(80)}},
+	}, backend["paths"].([]interface{})[0].(map[string]interface{})["backend"])
+	assert.Contains(t, ingress.GetAnnotations(), originalSpecAnnotation)
+
+	route := getWorkload(t, client, httpRouteGVR, "preview", "web")
+	rules, _, _ := unstructured.NestedSlice(route.Object, "spec", "rules")
+	assert.Equal(t, []interface{}{map[string]interface{}{"name": "sleep-page", "port": int64(80)}}, rules[0].(map[string]interface{})["backendRefs"])
+
+	// A second shutdown keeps the original spec
+	results, err = step.shutdown(context.Background(), client)
+	require.NoError(t, err)
+	assert.Equal(t, nodePoolStatusSkipped, results[0].Status)
+
+	_, err = step.startup(context.Background(), client)
+	require.NoError(t, err)
+	ingress = getWorkload(t, client, ingressGVR, "preview", "app")
+	restored, _, _ := unstructured.NestedMap(ingress.Object, "spec")
+	assert.Equal(t, ingressSpec, restored)
+	assert.Equal(t, optIn, ingress.GetAnnotations())
+	restored, _, _ = unstructured.NestedMap(getWorkload(t, client, httpRouteGVR, "preview", "web").Object, "spec")
+	assert.Equal(t, routeSpec, restored)
+}
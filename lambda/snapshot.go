@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+var nodeClassGVR = schema.GroupVersionResource{
+	Group:    "karpenter.k8s.aws",
+	Version:  "v1",
+	Resource: "ec2nodeclasses",
+}
+
+// snapshotNodePool records the nodepool's spec and limits together with its
+// NodeClaims and their EC2 instances.
+func snapshotNodePool(ctx context.Context, dynamicClient dynamic.Interface, nodePool *unstructured.Unstructured) (nodePoolSnapshot, error) {
+	snapshot := nodePoolSnapshot{NodePool: nodePool.GetName(), TakenAt: time.Now().UTC()}
+
+	limits, err := nodePoolLimits(nodePool)
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to read limits of nodepool %s: %v", nodePool.GetName(), err)
+	}
+	snapshot.Limits = limits
+	// A nodepool scaled for the night keeps its daytime limits in the annotation
+	if restore, err := getRestoreState(nodePool); err == nil && restore != nil && len(restore.Limits) > 0 {
+		snapshot.Limits = restore.Limits
+	}
+
+	spec, _, err := unstructured.NestedMap(nodePool.Object, "spec")
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to read spec of nodepool %s: %v", nodePool.GetName(), err)
+	}
+	snapshot.Spec = spec
+	snapshot.NodeClassRef, _, _ = unstructured.NestedString(nodePool.Object, "spec", "template", "spec", "nodeClassRef", "name")
+
+	labelSelector := fmt.Sprintf("karpenter.sh/nodepool=%s", nodePool.GetName())
+	nodeClaimList, err := dynamicClient.Resource(nodeClaimGVR).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return snapshot, fmt.Errorf("failed to list nodeclaims with label selector %s: %v", labelSelector, err)
+	}
+	snapshot.NodeClaims = len(nodeClaimList.Items)
+	for _, nodeClaim := range nodeClaimList.Items {
+		providerID, _, _ := unstructured.NestedString(nodeClaim.Object, "status", "providerID")
+		if instanceID := instanceIDFromProviderID(providerID); instanceID != "" {
+			snapshot.Instances = append(snapshot.Instances, instanceID)
+		}
+	}
+
+	return snapshot, nil
+}
+
+// instanceIDFromProviderID extracts i-0123... from aws:///ap-southeast-2a/i-0123...
+func instanceIDFromProviderID(providerID string) string {
+	instanceID := providerID[strings.LastIndex(providerID, "/")+1:]
+	if !strings.HasPrefix(instanceID, "i-") {
+		return ""
+	}
+	return instanceID
+}
+
+// saveNodePoolSnapshot snapshots the nodepool into the run's state store
+// before it is shut down. A nodepool already scaled down keeps its previous
+// snapshot, so running shutdown twice does not lose the daytime limits.
+func saveNodePoolSnapshot(ctx context.Context, dynamicClient dynamic.Interface, nodePool *unstructured.Unstructured, progress *clusterProgress) error {
+	if !progress.keepsState() {
+		return nil
+	}
+	if limits, _ := nodePoolLimits(nodePool); limits["cpu"] == "0" {
+		fmt.Printf("Nodepool %s is already scaled down - keeping its previous snapshot\n", nodePool.GetName())
+		return nil
+	}
+
+	snapshot, err := snapshotNodePool(ctx, dynamicClient, nodePool)
+	if err != nil {
+		return err
+	}
+	if err := progress.saveSnapshot(ctx, snapshot); err != nil {
+		return err
+	}
+	fmt.Printf("Saved snapshot of nodepool %s: limits %v, %d nodeclaim(s)\n", snapshot.NodePool, snapshot.Limits, snapshot.NodeClaims)
+	return nil
+}
+
+// recreateNodePool recreates a nodepool deleted since the shutdown from its
+// latest snapshot, with the snapshot's daytime limits. The EC2NodeClass it
+// references must still exist.
+func recreateNodePool(ctx context.Context, dynamicClient dynamic.Interface, np managedNodePool, progress *clusterProgress) (string, error) {
+	if !progress.keepsState() {
+		return "", fmt.Errorf("nodepool %s not found and no state store is configured to recreate it from", np.Name)
+	}
+	snapshot, err := progress.latestSnapshot(ctx, np.Name)
+	if err != nil {
+		return "", err
+	}
+	if snapshot == nil || len(snapshot.Spec) == 0 {
+		return "", fmt.Errorf("nodepool %s not found and there is no snapshot to recreate it from", np.Name)
+	}
+
+	if snapshot.NodeClassRef != "" {
+		if _, err := dynamicClient.Resource(nodeClassGVR).Get(ctx, snapshot.NodeClassRef, metav1.GetOptions{}); err != nil {
+			return "", fmt.Errorf("cannot recreate nodepool %s, EC2NodeClass %s: %v", np.Name, snapshot.NodeClassRef, err)
+		}
+	}
+
+	nodePool := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "karpenter.sh/v1",
+		"kind":       "NodePool",
+		"metadata":   map[string]interface{}{"name": np.Name},
+		"spec":       runtime.DeepCopyJSONValue(snapshot.Spec),
+	}}
+	if len(snapshot.Limits) > 0 {
+		if err := setLimits(nodePool, snapshot.Limits); err != nil {
+			return "", fmt.Errorf("failed to set limits for nodepool %s: %v", np.Name, err)
+		}
+	}
+
+	if _, err := dynamicClient.Resource(nodePoolGVR).Create(ctx, nodePool, metav1.CreateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to recreate nodepool %s: %v", np.Name, err)
+	}
+	fmt.Printf("Recreated nodepool %s from the snapshot of run %s\n", np.Name, snapshot.RunID)
+	return nodePoolStatusRecreated, nil
+}
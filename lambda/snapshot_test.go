@@ -0,0 +1,139 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func TestInstanceIDFromProviderID(t *testing.T) {
+	assert.Equal(t, "i-0123456789abcdef0", instanceIDFromProviderID("aws:///ap-southeast-2a/i-0123456789abcdef0"))
+	assert.Empty(t, instanceIDFromProviderID(""))
+	assert.Empty(t, instanceIDFromProviderID("kind://docker/kind/kind-worker"))
+}
+
+func TestSnapshotRestoresLimitsOnStartup(t *testing.T) {
+	nodeClaim := newTestNodeClaim("default-abc", "default")
+	nodeClaim.Object["status"] = map[string]interface{}{"providerID": "aws:///ap-southeast-2a/i-0123456789abcdef0"}
+	client := newFakeClient(
+		newTestNodePool("default", map[string]interface{}{"cpu": "250", "memory": "1000Gi"}),
+		nodeClaim,
+	)
+
+	progress, err := newRunProgress(context.Background(), nil)
+	require.NoError(t, err)
+	store := newMemoryStore()
+	progress.store = store
+	cluster := progress.cluster("ap-southeast-2/dev")
+	nodePools := []managedNodePool{{Name: "default", DeleteNodeClaims: true}}
+
+	_, err = processNodePools(context.Background(), client, "shutdown", nodePools, 1, cluster)
+	require.NoError(t, err)
+
+	snapshot, err := store.latestSnapshot(context.Background(), "ap-southeast-2/dev", "default")
+	require.NoError(t, err)
+	require.NotNil(t, snapshot)
+	assert.Equal(t, progress.runID(), snapshot.RunID)
+	assert.Equal(t, map[string]string{"cpu": "250", "memory": "1000Gi"}, snapshot.Limits)
+	assert.Equal(t, 1, snapshot.NodeClaims)
+	assert.Equal(t, []string{"i-0123456789abcdef0"}, snapshot.Instances)
+
+	// A second shutdown keeps the daytime snapshot
+	progress, err = newRunProgress(context.Background(), nil)
+	require.NoError(t, err)
+	progress.store = store
+	_, err = processNodePools(context.Background(), client, "shutdown", nodePools, 1, progress.cluster("ap-southeast-2/dev"))
+	require.NoError(t, err)
+	snapshot, err = store.latestSnapshot(context.Background(), "ap-southeast-2/dev", "default")
+	require.NoError(t, err)
+	assert.Equal(t, "250", snapshot.Limits["cpu"])
+
+	// Startup prefers the snapshot over the configured limits
+	nodePools[0].Limits = map[string]string{"cpu": "1000"}
+	progress, err = newRunProgress(context.Background(), nil)
+	require.NoError(t, err)
+	progress.store = store
+	_, err = processNodePools(context.Background(), client, "startup", nodePools, 1, progress.cluster("ap-southeast-2/dev"))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "250", "memory": "1000Gi"}, getNodePoolLimits(t, client, "default"))
+}
+
+func TestSnapshotIntegerLimits(t *testing.T) {
+	client := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": int64(1000), "memory": "1000Gi", "nvidia.com/gpu": float64(0.5)}))
+
+	progress, err := newRunProgress(context.Background(), nil)
+	require.NoError(t, err)
+	store := newMemoryStore()
+	progress.store = store
+	nodePools := []managedNodePool{{Name: "default"}}
+
+	results, err := processNodePools(context.Background(), client, "shutdown", nodePools, 1, progress.cluster("ap-southeast-2/dev"))
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{{Name: "default", Status: nodePoolStatusUpdated}}, results)
+
+	snapshot, err := store.latestSnapshot(context.Background(), "ap-southeast-2/dev", "default")
+	require.NoError(t, err)
+	require.NotNil(t, snapshot)
+	assert.Equal(t, map[string]string{"cpu": "1000", "memory": "1000Gi", "nvidia.com/gpu": "0.5"}, snapshot.Limits)
+}
+
+func newTestNodeClass(name string) *unstructured.Unstructured {
+	return &unstructured.Unstructured{
+		Object: map[string]interface{}{
+			"apiVersion": "karpenter.k8s.aws/v1",
+			"kind":       "EC2NodeClass",
+			"metadata": map[string]interface{}{
+				"name": name,
+			},
+		},
+	}
+}
+
+func TestRecreateDeletedNodePoolOnStartup(t *testing.T) {
+	nodePool := newTestNodePool("gpu", map[string]interface{}{"cpu": "64"})
+	require.NoError(t, unstructured.SetNestedField(nodePool.Object, "gpu-class", "spec", "template", "spec", "nodeClassRef", "name"))
+	require.NoError(t, unstructured.SetNestedField(nodePool.Object, int64(10), "spec", "weight"))
+	client := newFakeClient(nodePool, newTestNodeClass("gpu-class"))
+
+	store := newMemoryStore()
+	runWithStore := func(action string, np managedNodePool) ([]NodePoolResult, error) {
+		progress, err := newRunProgress(context.Background(), nil)
+		require.NoError(t, err)
+		progress.store = store
+		return processNodePools(context.Background(), client, action, []managedNodePool{np}, 1, progress.cluster("ap-southeast-2/dev"))
+	}
+	np := managedNodePool{Name: "gpu", DeleteNodeClaims: true, Recreate: true}
+
+	_, err := runWithStore("shutdown", np)
+	require.NoError(t, err)
+	snapshot, err := store.latestSnapshot(context.Background(), "ap-southeast-2/dev", "gpu")
+	require.NoError(t, err)
+	assert.Equal(t, "gpu-class", snapshot.NodeClassRef)
+
+	// Someone deletes the nodepool overnight
+	require.NoError(t, client.Resource(nodePoolGVR).Delete(context.Background(), "gpu", metav1.DeleteOptions{}))
+
+	results, err := runWithStore("startup", np)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{{Name: "gpu", Status: nodePoolStatusRecreated}}, results)
+	assert.Equal(t, map[string]string{"cpu": "64"}, getNodePoolLimits(t, client, "gpu"))
+	recreated, err := client.Resource(nodePoolGVR).Get(context.Background(), "gpu", metav1.GetOptions{})
+	require.NoError(t, err)
+	nodeClassRef, _, _ := unstructured.NestedString(recreated.Object, "spec", "template", "spec", "nodeClassRef", "name")
+	assert.Equal(t, "gpu-class", nodeClassRef)
+
+	// Without the EC2NodeClass the nodepool cannot be recreated
+	require.NoError(t, client.Resource(nodePoolGVR).Delete(context.Background(), "gpu", metav1.DeleteOptions{}))
+	require.NoError(t, client.Resource(nodeClassGVR).Delete(context.Background(), "gpu-class", metav1.DeleteOptions{}))
+	_, err = runWithStore("startup", np)
+	assert.ErrorContains(t, err, "cannot recreate nodepool gpu, EC2NodeClass gpu-class")
+
+	// Recreation is opt-in
+	np.Recreate = false
+	_, err = runWithStore("startup", np)
+	assert.ErrorContains(t, err, "failed to get nodepool gpu")
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+// capacityTypeLabel is the well-known Karpenter label for spot or on-demand capacity.
+const capacityTypeLabel = "karpenter.sh/capacity-type"
+
+// spotNodePool restricts the nodepool to spot capacity overnight by
+// rewriting its capacity type requirement. The original requirements are
+// kept in the restoreAnnotation for startup. Karpenter treats the change as
+// drift and replaces the nodepool's on-demand nodes with spot ones.
+func spotNodePool(ctx context.Context, dynamicClient dynamic.Interface, nodePool *unstructured.Unstructured) (string, error) {
+	nodePoolName := nodePool.GetName()
+	if _, err := recordRestoreState(nodePool); err != nil {
+		return "", err
+	}
+
+	requirements, _, err := unstructured.NestedSlice(nodePool.Object, "spec", "template", "spec", "requirements")
+	if err != nil {
+		return "", fmt.Errorf("failed to read requirements of nodepool %s: %v", nodePoolName, err)
+	}
+	requirements = spotRequirements(requirements)
+	if err := unstructured.SetNestedSlice(nodePool.Object, requirements, "spec", "template", "spec", "requirements"); err != nil {
+		return "", fmt.Errorf("failed to set requirements for nodepool %s: %v", nodePoolName, err)
+	}
+
+	if _, err := dynamicClient.Resource(nodePoolGVR).Update(ctx, nodePool, metav1.UpdateOptions{}); err != nil {
+		return "", fmt.Errorf("failed to update nodepool %s: %v", nodePoolName, err)
+	}
+	fmt.Printf("Successfully restricted nodepool %s to spot capacity\n", nodePoolName)
+	return nodePoolStatusUpdated, nil
+}
+
+// spotRequirements replaces the capacity type requirements with one
+// allowing only spot, keeping every other requirement in place.
+func spotRequirements(requirements []interface{}) []interface{} {
+	return replaceRequirement(requirements, capacityTypeLabel, []string{"spot"})
+}
+
+// replaceRequirement replaces the requirements on key with one allowing only
+// the values, in place of the first of them, or appends it.
+func replaceRequirement(requirements []interface{}, key string, values []string) []interface{} {
+	allowed := make([]interface{}, len(values))
+	for i, value := range values {
+		allowed[i] = value
+	}
+	replacement := map[string]interface{}{
+		"key":      key,
+		"operator": "In",
+		"values":   allowed,
+	}
+
+	rewritten := make([]interface{}, 0, len(requirements)+1)
+	replaced := false
+	for _, r := range requirements {
+		requirement, ok := r.(map[string]interface{})
+		if !ok || requirement["key"] != key {
+			rewritten = append(rewritten, r)
+			continue
+		}
+		if !replaced {
+			rewritten = append(rewritten, replacement)
+			replaced = true
+		}
+	}
+	if !replaced {
+		rewritten = append(rewritten, replacement)
+	}
+	return rewritten
+}
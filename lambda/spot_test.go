@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+)
+
+func requirement(key string, values ...interface{}) map[string]interface{} {
+	return map[string]interface{}{"key": key, "operator": "In", "values": values}
+}
+
+func TestSpotRequirements(t *testing.T) {
+	arch := requirement("kubernetes.io/arch", "arm64")
+
+	assert.Equal(t,
+		[]interface{}{arch, requirement(capacityTypeLabel, "spot")},
+		spotRequirements([]interface{}{arch, requirement(capacityTypeLabel, "on-demand", "spot")}))
+
+	// Duplicates are collapsed and a missing requirement is added
+	assert.Equal(t,
+		[]interface{}{requirement(capacityTypeLabel, "spot"), arch},
+		spotRequirements([]interface{}{requirement(capacityTypeLabel, "on-demand"), arch, requirement(capacityTypeLabel, "spot")}))
+	assert.Equal(t,
+		[]interface{}{arch, requirement(capacityTypeLabel, "spot")},
+		spotRequirements([]interface{}{arch}))
+}
+
+func TestProcessNodePoolsSpotAndStartup(t *testing.T) {
+	daytime := []interface{}{
+		requirement(capacityTypeLabel, "on-demand", "spot"),
+		requirement("kubernetes.io/arch", "amd64"),
+	}
+	nodePool := newTestNodePool("default", map[string]interface{}{"cpu": "40"})
+	require.NoError(t, unstructured.SetNestedSlice(nodePool.Object, daytime, "spec", "template", "spec", "requirements"))
+	client := newFakeClient(nodePool)
+	cluster := ClusterConfig{Name: "test-cluster", NodePools: splitNodePools("default")}
+
+	getRequirements := func() []interface{} {
+		np, err := client.Resource(nodePoolGVR).Get(context.Background(), "default", metav1.GetOptions{})
+		require.NoError(t, err)
+		requirements, _, err := unstructured.NestedSlice(np.Object, "spec", "template", "spec", "requirements")
+		require.NoError(t, err)
+		return requirements
+	}
+
+	results, err := processConfiguredNodePools(t, client, "spot", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{{Name: "default", Status: nodePoolStatusUpdated}}, results)
+	assert.Equal(t, []interface{}{requirement(capacityTypeLabel, "spot"), requirement("kubernetes.io/arch", "amd64")}, getRequirements())
+
+	// Running it twice keeps the daytime requirements
+	_, err = processConfiguredNodePools(t, client, "spot", cluster)
+	require.NoError(t, err)
+
+	_, err = processConfiguredNodePools(t, client, "startup", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, daytime, getRequirements())
+	assert.Equal(t, map[string]string{"cpu": "40"}, getNodePoolLimits(t, client, "default"))
+}
+
+func TestProcessNodePoolsSpotIntegerLimits(t *testing.T) {
+	client := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": int64(1000)}))
+	cluster := ClusterConfig{Name: "test-cluster", NodePools: splitNodePools("default")}
+
+	results, err := processConfiguredNodePools(t, client, "spot", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, []NodePoolResult{{Name: "default", Status: nodePoolStatusUpdated}}, results)
+
+	_, err = processConfiguredNodePools(t, client, "startup", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"cpu": "1000"}, getNodePoolLimits(t, client, "default"))
+}
+
+func TestProcessNodePoolsSpotWithoutRequirements(t *testing.T) {
+	client := newFakeClient(newTestNodePool("default", map[string]interface{}{"cpu": "40"}))
+	cluster := ClusterConfig{Name: "test-cluster", NodePools: splitNodePools("default")}
+
+	getRequirements := func() []interface{} {
+		np, err := client.Resource(nodePoolGVR).Get(context.Background(), "default", metav1.GetOptions{})
+		require.NoError(t, err)
+		requirements, _, err := unstructured.NestedSlice(np.Object, "spec", "template", "spec", "requirements")
+		require.NoError(t, err)
+		return requirements
+	}
+
+	_, err := processConfiguredNodePools(t, client, "spot", cluster)
+	require.NoError(t, err)
+	assert.Equal(t, []interface{}{requirement(capacityTypeLabel, "spot")}, getRequirements())
+
+	// Running it twice keeps the recorded empty requirements
+	_, err = processConfiguredNodePools(t, client, "spot", cluster)
+	require.NoError(t, err)
+
+	_, err = processConfiguredNodePools(t, client, "startup", cluster)
+	require.NoError(t, err)
+	assert.Empty(t, getRequirements())
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/dynamic"
+)
+
+// defaultStageName names the stage of nodepools not selected by any other.
+const defaultStageName = "default"
+
+// defaultStageTimeout bounds a stage's wait when it sets no timeout, well
+// within the Lambda timeout.
+const defaultStageTimeout = 2 * time.Minute
+
+// stagePollInterval is how often a waiting stage checks the cluster.
+var stagePollInterval = 10 * time.Second
+
+// nodePoolStage is a stage with its nodepools resolved.
+type nodePoolStage struct {
+	Name      string
+	NodePools []managedNodePool
+	Wait      bool
+	Timeout   time.Duration
+}
+
+// stages assigns each nodepool to the first stage selecting it, keeping the
+// nodepools' order within a stage. Stages are returned in the order they run
+// for the action: as listed for startup and reversed for the night actions.
+func (c ClusterConfig) stages(action string, nodePools []managedNodePool) ([]nodePoolStage, error) {
+	stages := make([]nodePoolStage, 0, len(c.Stages)+1)
+	for _, stage := range c.Stages {
+		timeout := defaultStageTimeout
+		if stage.Timeout != "" {
+			var err error
+			if timeout, err = time.ParseDuration(stage.Timeout); err != nil {
+				return nil, fmt.Errorf("stage %s: invalid timeout %q: %v", stage.Name, stage.Timeout, err)
+			}
+		}
+		stages = append(stages, nodePoolStage{Name: stage.Name, Wait: stage.Wait, Timeout: timeout})
+	}
+	defaultStage := nodePoolStage{Name: defaultStageName}
+
+	for _, np := range nodePools {
+		assigned := false
+		for i, stage := range c.Stages {
+			selected, err := selectsNodePool(stage.NodePools, np.Name)
+			if err != nil {
+				return nil, fmt.Errorf("stage %s: %v", stage.Name, err)
+			}
+			if selected {
+				stages[i].NodePools = append(stages[i].NodePools, np)
+				assigned = true
+				break
+			}
+		}
+		if !assigned {
+			defaultStage.NodePools = append(defaultStage.NodePools, np)
+		}
+	}
+	if len(defaultStage.NodePools) > 0 {
+		stages = append(stages, defaultStage)
+	}
+
+	if isNightAction(action) {
+		for i, j := 0, len(stages)-1; i < j; i, j = i+1, j-1 {
+			stages[i], stages[j] = stages[j], stages[i]
+		}
+	}
+	return stages, nil
+}
+
+// isNightAction reports whether the action reduces capacity for the night,
+// as opposed to startup restoring it.
+func isNightAction(action string) bool {
+	switch action {
+	case "shutdown", "scale", "spot", "offpeak":
+		return true
+	}
+	return false
+}
+
+// validateStages checks the stage names, patterns and timeouts.
+func validateStages(stages []StageConfig) error {
+	seen := map[string]bool{}
+	for i, stage := range stages {
+		if stage.Name == "" {
+			return fmt.Errorf("stages[%d]: name is required", i)
+		}
+		if seen[stage.Name] {
+			return fmt.Errorf("stages[%d]: duplicate stage %s", i, stage.Name)
+		}
+		seen[stage.Name] = true
+
+		if len(stage.NodePools) == 0 {
+			return fmt.Errorf("stage %s: at least one nodepool is required", stage.Name)
+		}
+		for _, entry := range stage.NodePools {
+			if _, err := parseNodePoolPattern(entry); err != nil {
+				return fmt.Errorf("stage %s: %v", stage.Name, err)
+			}
+		}
+		if stage.Timeout != "" {
+			if timeout, err := time.ParseDuration(stage.Timeout); err != nil || timeout <= 0 {
+				return fmt.Errorf("stage %s: invalid timeout %q", stage.Name, stage.Timeout)
+			}
+		}
+	}
+	return nil
+}
+
+// waitForStage blocks until the stage has settled for the action: every
+// nodepool has a Ready node after startup, and none of the nodepools whose
+// NodeClaims are deleted has any left after shutdown, apart from those of
+// nodes the skip do-not-disrupt policy keeps.
+func waitForStage(ctx context.Context, dynamicClient dynamic.Interface, action string, stage nodePoolStage) error {
+	var settled func(ctx context.Context, np managedNodePool) (bool, error)
+	switch action {
+	case "startup":
+		settled = func(ctx context.Context, np managedNodePool) (bool, error) {
+			return hasReadyNode(ctx, dynamicClient, np.Name)
+		}
+	case "shutdown":
+		settled = func(ctx context.Context, np managedNodePool) (bool, error) {
+			if !np.DeleteNodeClaims {
+				return true, nil
+			}
+			var keep map[string]string
+			if np.DoNotDisrupt.Policy == doNotDisruptSkip {
+				var err error
+				if keep, err = protectedNodes(ctx, dynamicClient, np.Name); err != nil {
+					return false, err
+				}
+			}
+			return hasNoNodeClaims(ctx, dynamicClient, np.Name, keep)
+		}
+	default:
+		return nil
+	}
+
+	fmt.Printf("Waiting up to %s for stage %s to %s\n", stage.Timeout, stage.Name, action)
+	pending := ""
+	err := wait.PollUntilContextTimeout(ctx, stagePollInterval, stage.Timeout, true, func(ctx context.Context) (bool, error) {
+		for _, np := range stage.NodePools {
+			ok, err := settled(ctx, np)
+			if err != nil {
+				return false, err
+			}
+			if !ok {
+				pending = np.Name
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		if wait.Interrupted(err) {
+			return fmt.Errorf("timed out after %s waiting for nodepool %s", stage.Timeout, pending)
+		}
+		return err
+	}
+
+	fmt.Printf("Stage %s completed %s\n", stage.Name, action)
+	return nil
+}
+
+func hasReadyNode(ctx context.Context, dynamicClient dynamic.Interface, nodePoolName string) (bool, error) {
+	labelSelector := fmt.Sprintf("karpenter.sh/nodepool=%s", nodePoolName)
+	nodeList, err := dynamicClient.Resource(nodeGVR).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return false, fmt.Errorf("failed to list nodes with label selector %s: %v", labelSelector, err)
+	}
+
+	for _, node := range nodeList.Items {
+		conditions, _, _ := unstructured.NestedSlice(node.Object, "status", "conditions")
+		for _, c := range conditions {
+			condition, ok := c.(map[string]interface{})
+			if ok && condition["type"] == "Ready" && condition["status"] == "True" {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// hasNoNodeClaims reports whether the nodepool has no NodeClaims left other
+// than those of the nodes in keep.
+func hasNoNodeClaims(ctx context.Context, dynamicClient dynamic.Interface, nodePoolName string, keep map[string]string) (bool, error) {
+	labelSelector := fmt.Sprintf("karpenter.sh/nodepool=%s", nodePoolName)
+	nodeClaimList, err := dynamicClient.Resource(nodeClaimGVR).List(ctx, metav1.ListOptions{LabelSelector: labelSelector})
+	if err != nil {
+		return false, fmt.Errorf("failed to list nodeclaims with label selector %s: %v", labelSelector, err)
+	}
+	for _, nodeClaim := range nodeClaimList.Items {
+		nodeName, _, _ := unstructured.NestedString(nodeClaim.Object, "status", "nodeName")
+		if _, ok := keep[nodeName]; !ok {
+			return false, nil
+		}
+	}
+	return true, nil
+}
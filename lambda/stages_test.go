@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/client-go/dynamic"
+)
+
+func newReadyTestNode(name, nodePoolName string) *unstructured.Unstructured {
+	node := newTestNode(name, nodePoolName)
+	node.Object["status"] = map[string]interface{}{
+		"conditions": []interface{}{
+			map[string]interface{}{"type": "Ready", "status": "True"},
+		},
+	}
+	return node
+}
+
+func stageNames(stages []nodePoolStage) [][]string {
+	var names [][]string
+	for _, stage := range stages {
+		stageNames := []string{stage.Name}
+		for _, np := range stage.NodePools {
+			stageNames = append(stageNames, np.Name)
+		}
+		names = append(names, stageNames)
+	}
+	return names
+}
+
+func TestClusterStages(t *testing.T) {
+	cluster := ClusterConfig{
+		Name: "test-cluster",
+		Stages: []StageConfig{
+			{Name: "system", NodePools: []string{"system", "ingress"}, Wait: true, Timeout: "5m"},
+			{Name: "apps", NodePools: []string{"team-*"}},
+		},
+	}
+	nodePools, err := ClusterConfig{NodePools: splitNodePools("team-a,ingress,batch,system")}.resolveNodePools(nil)
+	require.NoError(t, err)
+
+	stages, err := cluster.stages("startup", nodePools)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"system", "ingress", "system"},
+		{"apps", "team-a"},
+		{"default", "batch"},
+	}, stageNames(stages))
+	assert.True(t, stages[0].Wait)
+	assert.Equal(t, 5*time.Minute, stages[0].Timeout)
+	assert.Equal(t, defaultStageTimeout, stages[1].Timeout)
+
+	stages, err = cluster.stages("shutdown", nodePools)
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{
+		{"default", "batch"},
+		{"apps", "team-a"},
+		{"system", "ingress", "system"},
+	}, stageNames(stages))
+}
+
+func TestWaitForStageStartup(t *testing.T) {
+	originalInterval := stagePollInterval
+	stagePollInterval = time.Millisecond
+	defer func() { stagePollInterval = originalInterval }()
+
+	stage := nodePoolStage{
+		Name:      "system",
+		NodePools: []managedNodePool{{Name: "system"}},
+		Timeout:   20 * time.Millisecond,
+	}
+
+	client := newFakeClient(newTestNode("node-1", "system"))
+	err := waitForStage(context.Background(), client, "startup", stage)
+	assert.ErrorContains(t, err, "timed out after 20ms waiting for nodepool system")
+
+	client = newFakeClient(newTestNode("node-1", "system"), newReadyTestNode("node-2", "system"))
+	assert.NoError(t, waitForStage(context.Background(), client, "startup", stage))
+}
+
+func TestWaitForStageShutdown(t *testing.T) {
+	originalInterval := stagePollInterval
+	stagePollInterval = time.Millisecond
+	defer func() { stagePollInterval = originalInterval }()
+
+	stage := nodePoolStage{
+		Name: "apps",
+		NodePools: []managedNodePool{
+			{Name: "team-a", DeleteNodeClaims: true},
+			{Name: "batch"},
+		},
+		Timeout: 20 * time.Millisecond,
+	}
+
+	client := newFakeClient(newTestNodeClaim("team-a-abc", "team-a"))
+	err := waitForStage(context.Background(), client, "shutdown", stage)
+	assert.ErrorContains(t, err, "waiting for nodepool team-a")
+
+	// NodeClaims kept by configuration are not waited for
+	client = newFakeClient(newTestNodeClaim("batch-abc", "batch"))
+	assert.NoError(t, waitForStage(context.Background(), client, "shutdown", stage))
+}
+
+func TestProcessClusterStagesStopOnTimeout(t *testing.T) {
+	originalInterval := stagePollInterval
+	stagePollInterval = time.Millisecond
+	defer func() { stagePollInterval = originalInterval }()
+
+	client := newFakeClient(
+		newTestNodePool("system", map[string]interface{}{"cpu": "0"}),
+		newTestNodePool("app", map[string]interface{}{"cpu": "0"}),
+	)
+	originalFactory := newClusterClient
+	newClusterClient = func(ctx context.Context, cluster ClusterConfig) (dynamic.Interface, error) {
+		return client, nil
+	}
+	defer func() { newClusterClient = originalFactory }()
+
+	cluster := ClusterConfig{
+		Name:      "test-cluster",
+		NodePools: splitNodePools("app,system"),
+		Stages:    []StageConfig{{Name: "system", NodePools: []string{"system"}, Wait: true, Timeout: "10ms"}},
+	}
+
+	result, err := processCluster(context.Background(), "startup", cluster, nil)
+
+	assert.ErrorContains(t, err, "stage system: timed out")
+	assert.Equal(t, []NodePoolResult{{Name: "system", Status: nodePoolStatusUpdated}}, result.NodePools)
+	assert.Equal(t, "0", getNodePoolLimits(t, client, "app")["cpu"])
+}
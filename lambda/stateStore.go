@@ -0,0 +1,167 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// snapshotRetention is how long snapshots are kept in the state table.
+const snapshotRetention = 30 * 24 * time.Hour
+
+// nodePoolSnapshot records a nodepool as it was before a shutdown.
+type nodePoolSnapshot struct {
+	// Cluster is the cluster's region/name
+	Cluster  string    `json:"cluster"`
+	NodePool string    `json:"nodePool"`
+	RunID    string    `json:"runId"`
+	TakenAt  time.Time `json:"takenAt"`
+	// Limits are the nodepool's spec.limits
+	Limits map[string]string `json:"limits,omitempty"`
+	// NodeClaims is the number of NodeClaims the nodepool had
+	NodeClaims int `json:"nodeClaims"`
+	// Instances are the EC2 instance IDs of those NodeClaims
+	Instances []string `json:"instances,omitempty"`
+	// Spec is the nodepool's spec, to recreate it if it is deleted
+	Spec map[string]interface{} `json:"spec,omitempty"`
+	// NodeClassRef is the name of the EC2NodeClass the nodepool references
+	NodeClassRef string `json:"nodeClassRef,omitempty"`
+}
+
+// stateStore keeps nodepool snapshots outside the cluster, so startup can
+// restore what the nodepools looked like before the shutdown.
+type stateStore interface {
+	saveSnapshot(ctx context.Context, snapshot nodePoolSnapshot) error
+	// latestSnapshot returns the newest snapshot of the nodepool, or nil
+	latestSnapshot(ctx context.Context, cluster, nodePool string) (*nodePoolSnapshot, error)
+}
+
+// newStateStore returns the DynamoDB store named by KARPENTER_STATE_TABLE,
+// or nil when no state is kept.
+var newStateStore = func(ctx context.Context) (stateStore, error) {
+	table := os.Getenv("KARPENTER_STATE_TABLE")
+	if table == "" {
+		return nil, nil
+	}
+
+	cfg, err := loadAWSConfig(ctx, "", assumeRoleConfig{})
+	if err != nil {
+		return nil, err
+	}
+	return &dynamoStore{client: dynamodb.NewFromConfig(cfg), table: table}, nil
+}
+
+// memoryStore keeps snapshots in memory, for tests and local runs.
+type memoryStore struct {
+	mu        sync.Mutex
+	snapshots map[string][]nodePoolSnapshot
+}
+
+func newMemoryStore() *memoryStore {
+	return &memoryStore{snapshots: map[string][]nodePoolSnapshot{}}
+}
+
+func (m *memoryStore) saveSnapshot(ctx context.Context, snapshot nodePoolSnapshot) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := snapshotKey(snapshot.Cluster, snapshot.NodePool)
+	snapshots := m.snapshots[key]
+	for i, existing := range snapshots {
+		if existing.RunID == snapshot.RunID {
+			snapshots[i] = snapshot
+			return nil
+		}
+	}
+	snapshots = append(snapshots, snapshot)
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].RunID < snapshots[j].RunID })
+	m.snapshots[key] = snapshots
+	return nil
+}
+
+func (m *memoryStore) latestSnapshot(ctx context.Context, cluster, nodePool string) (*nodePoolSnapshot, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	snapshots := m.snapshots[snapshotKey(cluster, nodePool)]
+	if len(snapshots) == 0 {
+		return nil, nil
+	}
+	latest := snapshots[len(snapshots)-1]
+	return &latest, nil
+}
+
+type dynamoDBAPI interface {
+	PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error)
+	Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error)
+}
+
+// dynamoStore keeps snapshots in a DynamoDB table keyed by "pk" (cluster and
+// nodepool) and "runId", with the snapshot itself as JSON. Items expire
+// through the table's "expiresAt" TTL attribute.
+type dynamoStore struct {
+	client dynamoDBAPI
+	table  string
+}
+
+func (d *dynamoStore) saveSnapshot(ctx context.Context, snapshot nodePoolSnapshot) error {
+	data, err := json.Marshal(snapshot)
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %v", err)
+	}
+
+	_, err = d.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(d.table),
+		Item: map[string]dynamodbtypes.AttributeValue{
+			"pk":        &dynamodbtypes.AttributeValueMemberS{Value: snapshotKey(snapshot.Cluster, snapshot.NodePool)},
+			"runId":     &dynamodbtypes.AttributeValueMemberS{Value: snapshot.RunID},
+			"snapshot":  &dynamodbtypes.AttributeValueMemberS{Value: string(data)},
+			"expiresAt": &dynamodbtypes.AttributeValueMemberN{Value: strconv.FormatInt(snapshot.TakenAt.Add(snapshotRetention).Unix(), 10)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save snapshot of nodepool %s to %s: %v", snapshot.NodePool, d.table, err)
+	}
+	return nil
+}
+
+func (d *dynamoStore) latestSnapshot(ctx context.Context, cluster, nodePool string) (*nodePoolSnapshot, error) {
+	out, err := d.client.Query(ctx, &dynamodb.QueryInput{
+		TableName:              aws.String(d.table),
+		KeyConditionExpression: aws.String("pk = :pk"),
+		ExpressionAttributeValues: map[string]dynamodbtypes.AttributeValue{
+			":pk": &dynamodbtypes.AttributeValueMemberS{Value: snapshotKey(cluster, nodePool)},
+		},
+		ScanIndexForward: aws.Bool(false),
+		Limit:            aws.Int32(1),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to query snapshots of nodepool %s from %s: %v", nodePool, d.table, err)
+	}
+	if len(out.Items) == 0 {
+		return nil, nil
+	}
+
+	attr, ok := out.Items[0]["snapshot"].(*dynamodbtypes.AttributeValueMemberS)
+	if !ok {
+		return nil, fmt.Errorf("snapshot of nodepool %s in %s has no snapshot attribute", nodePool, d.table)
+	}
+	var snapshot nodePoolSnapshot
+	if err := json.Unmarshal([]byte(attr.Value), &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to decode snapshot of nodepool %s: %v", nodePool, err)
+	}
+	return &snapshot, nil
+}
+
+func snapshotKey(cluster, nodePool string) string {
+	return cluster + "#" + nodePool
+}
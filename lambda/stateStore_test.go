@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	dynamodbtypes "github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeDynamoDB keeps items per partition key, ordered by runId.
+type fakeDynamoDB struct {
+	items map[string][]map[string]dynamodbtypes.AttributeValue
+}
+
+func (f *fakeDynamoDB) PutItem(ctx context.Context, params *dynamodb.PutItemInput, optFns ...func(*dynamodb.Options)) (*dynamodb.PutItemOutput, error) {
+	if f.items == nil {
+		f.items = map[string][]map[string]dynamodbtypes.AttributeValue{}
+	}
+	pk := params.Item["pk"].(*dynamodbtypes.AttributeValueMemberS).Value
+	f.items[pk] = append(f.items[pk], params.Item)
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamoDB) Query(ctx context.Context, params *dynamodb.QueryInput, optFns ...func(*dynamodb.Options)) (*dynamodb.QueryOutput, error) {
+	pk := params.ExpressionAttributeValues[":pk"].(*dynamodbtypes.AttributeValueMemberS).Value
+	var latest map[string]dynamodbtypes.AttributeValue
+	for _, item := range f.items[pk] {
+		if latest == nil || strings.Compare(runID(item), runID(latest)) > 0 {
+			latest = item
+		}
+	}
+	if latest == nil {
+		return &dynamodb.QueryOutput{}, nil
+	}
+	return &dynamodb.QueryOutput{Items: []map[string]dynamodbtypes.AttributeValue{latest}}, nil
+}
+
+func runID(item map[string]dynamodbtypes.AttributeValue) string {
+	return item["runId"].(*dynamodbtypes.AttributeValueMemberS).Value
+}
+
+func testStateStores() map[string]stateStore {
+	return map[string]stateStore{
+		"memory":   newMemoryStore(),
+		"dynamodb": &dynamoStore{client: &fakeDynamoDB{}, table: "karpenter-state"},
+	}
+}
+
+func TestStateStoreLatestSnapshot(t *testing.T) {
+	for name, store := range testStateStores() {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+
+			snapshot, err := store.latestSnapshot(ctx, "ap-southeast-2/dev", "default")
+			require.NoError(t, err)
+			assert.Nil(t, snapshot)
+
+			takenAt := time.Date(2025, 7, 1, 22, 0, 0, 0, time.UTC)
+			for _, run := range []struct {
+				id  string
+				cpu string
+			}{{"20250701T220000Z", "100"}, {"20250702T220000Z", "200"}} {
+				require.NoError(t, store.saveSnapshot(ctx, nodePoolSnapshot{
+					Cluster:    "ap-southeast-2/dev",
+					NodePool:   "default",
+					RunID:      run.id,
+					TakenAt:    takenAt,
+					Limits:     map[string]string{"cpu": run.cpu},
+					NodeClaims: 2,
+					Instances:  []string{"i-0123", "i-0456"},
+				}))
+			}
+
+			snapshot, err = store.latestSnapshot(ctx, "ap-southeast-2/dev", "default")
+			require.NoError(t, err)
+			require.NotNil(t, snapshot)
+			assert.Equal(t, "20250702T220000Z", snapshot.RunID)
+			assert.Equal(t, map[string]string{"cpu": "200"}, snapshot.Limits)
+			assert.Equal(t, []string{"i-0123", "i-0456"}, snapshot.Instances)
+
+			snapshot, err = store.latestSnapshot(ctx, "ap-southeast-2/dev", "gpu")
+			require.NoError(t, err)
+			assert.Nil(t, snapshot)
+		})
+	}
+}
+
+func TestDynamoStoreItemExpires(t *testing.T) {
+	client := &fakeDynamoDB{}
+	store := &dynamoStore{client: client, table: "karpenter-state"}
+	takenAt := time.Unix(1751407200, 0)
+
+	require.NoError(t, store.saveSnapshot(context.Background(), nodePoolSnapshot{
+		Cluster: "ap-southeast-2/dev", NodePool: "default", RunID: "20250701T220000Z", TakenAt: takenAt,
+	}))
+
+	item := client.items["ap-southeast-2/dev#default"][0]
+	assert.Equal(t, "1753999200", item["expiresAt"].(*dynamodbtypes.AttributeValueMemberN).Value)
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/dynamic"
+)
+
+// workloadStep is work on a cluster's workloads around its nodepools. Steps
+// run in order before the nodepools are shut down and in reverse after they
+// are started up. Both directions must be safe to repeat, as a continuation
+// may run them again.
+type workloadStep interface {
+	shutdown(ctx context.Context, dynamicClient dynamic.Interface) ([]WorkloadResult, error)
+	startup(ctx context.Context, dynamicClient dynamic.Interface) ([]WorkloadResult, error)
+}
+
+// workloadSteps returns the cluster's configured workload steps in shutdown order.
+func (c ClusterConfig) workloadSteps() []workloadStep {
+	var steps []workloadStep
+	if c.GitOps != nil {
+		steps = append(steps, gitOpsStep{config: *c.GitOps})
+	}
+	if c.SleepPage != nil {
+		steps = append(steps, sleepPageStep{config: *c.SleepPage})
+	}
+	if c.Autoscalers != nil {
+		steps = append(steps, autoscalerStep{scope: *c.Autoscalers})
+	}
+	if c.CronJobs != nil {
+		steps = append(steps, cronJobStep{scope: *c.CronJobs})
+	}
+	if c.Workloads != nil {
+		steps = append(steps, replicaStep{scope: *c.Workloads})
+	}
+	return steps
+}
+
+// runWorkloadSteps runs the steps for the action. The night actions that
+// keep the nodepools running only run the GitOps step, which stops Git from
+// reverting their NodePool changes. A failing step does not stop the
+// others, all errors are returned together.
+func runWorkloadSteps(ctx context.Context, dynamicClient dynamic.Interface, action string, steps []workloadStep) ([]WorkloadResult, error) {
+	var results []WorkloadResult
+	var errs []error
+	switch {
+	case isNightAction(action):
+		for _, step := range steps {
+			if _, gitOps := step.(gitOpsStep); !gitOps && action != "shutdown" {
+				continue
+			}
+			stepResults, err := step.shutdown(ctx, dynamicClient)
+			results = append(results, stepResults...)
+			errs = append(errs, err)
+		}
+	case action == "startup":
+		for i := len(steps) - 1; i >= 0; i-- {
+			stepResults, err := steps[i].startup(ctx, dynamicClient)
+			results = append(results, stepResults...)
+			errs = append(errs, err)
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// listWorkloads lists the resources within the scope: every one in its
+// namespaces, or in all namespaces when it only sets a selector, narrowed
+// by the selector. Resources whose API is not installed, such as KEDA's,
+// are treated as absent.
+func listWorkloads(ctx context.Context, dynamicClient dynamic.Interface, gvr schema.GroupVersionResource, scope WorkloadConfig) ([]unstructured.Unstructured, error) {
+	namespaces := scope.Namespaces
+	if len(namespaces) == 0 {
+		namespaces = []string{metav1.NamespaceAll}
+	}
+
+	var items []unstructured.Unstructured
+	for _, namespace := range namespaces {
+		list, err := dynamicClient.Resource(gvr).Namespace(namespace).List(ctx, metav1.ListOptions{LabelSelector: scope.Selector})
+		if apierrors.IsNotFound(err) {
+			fmt.Printf("No %s API in the cluster - skipping\n", gvr.Resource)
+			return nil, nil
+		}
+		if err != nil {
+			return nil, fmt.Errorf("failed to list %s in namespace %q: %v", gvr.Resource, namespace, err)
+		}
+		items = append(items, list.Items...)
+	}
+	return items, nil
+}
+
+// applyToWorkloads applies the change to every resource of the kinds within
+// the scope. A failing resource does not stop the others.
+func applyToWorkloads(ctx context.Context, dynamicClient dynamic.Interface, scope WorkloadConfig, apply func(ctx context.Context, resource dynamic.ResourceInterface, item unstructured.Unstructured) (string, error), gvrs ...schema.GroupVersionResource) ([]WorkloadResult, error) {
+	var results []WorkloadResult
+	var errs []error
+	for _, gvr := range gvrs {
+		items, err := listWorkloads(ctx, dynamicClient, gvr, scope)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		for _, item := range items {
+			status, err := apply(ctx, dynamicClient.Resource(gvr).Namespace(item.GetNamespace()), item)
+			results = append(results, workloadResult(item, status, err))
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s %s/%s: %v", item.GetKind(), item.GetNamespace(), item.GetName(), err))
+			}
+		}
+	}
+	return results, errors.Join(errs...)
+}
+
+// workloadResult records the outcome for one resource, logging failures.
+func workloadResult(item unstructured.Unstructured, status string, err error) WorkloadResult {
+	result := WorkloadResult{Kind: item.GetKind(), Namespace: item.GetNamespace(), Name: item.GetName(), Status: status}
+	if err != nil {
+		fmt.Printf("Failed to process %s %s/%s: %v\n", item.GetKind(), item.GetNamespace(), item.GetName(), err)
+		result.Status = nodePoolStatusFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// validateWorkloads checks the workload scope set as field.
+func validateWorkloads(field string, scope *WorkloadConfig) error {
+	if scope == nil {
+		return nil
+	}
+	if len(scope.Namespaces) == 0 && scope.Selector == "" {
+		return fmt.Errorf("%s needs namespaces or a selector", field)
+	}
+	if _, err := labels.Parse(scope.Selector); err != nil {
+		return fmt.Errorf("%s: invalid selector %q: %v", field, scope.Selector, err)
+	}
+	return nil
+}
@@ -1,6 +1,8 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"log"
 	"os"
@@ -8,12 +10,14 @@ import (
 	"strings"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsec2"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
 	"github.com/aws/aws-cdk-go/awscdk/v2/awsscheduler"
 	"github.com/aws/constructs-go/constructs/v10"
 	"github.com/aws/jsii-runtime-go"
+	"sigs.k8s.io/yaml"
 
 	"github.com/lendi-au/karpenter-aws-shutdown-schedule/pkg/utils"
 )
@@ -29,13 +33,31 @@ func NewKarpenterAwsShutdownScheduleStack(scope constructs.Construct, id string,
 	}
 	stack := awscdk.NewStack(scope, &id, &sprops)
 
-	name := "karpenter-ec2-instance-stop-start"
+	// Override the name to deploy more than one copy into an account
+	name := utils.GetenvDefault("KARPENTER_FUNCTION_NAME", "karpenter-ec2-instance-stop-start")
 	arch := awslambda.Architecture_ARM_64()
 
 	if os.Getenv("BUILD_ARCH") == "amd64" {
 		arch = awslambda.Architecture_X86_64()
 	}
 
+	// ========================================================================
+	// STATE TABLE
+	// ========================================================================
+	// KARPENTER_STATE_STORE=dynamodb keeps pre-shutdown nodepool snapshots in
+	// a DynamoDB table that startup restores from
+	var stateTable awsdynamodb.Table
+	if os.Getenv("KARPENTER_STATE_STORE") == "dynamodb" {
+		stateTable = awsdynamodb.NewTable(stack, jsii.String("StateTable"), &awsdynamodb.TableProps{
+			TableName:           jsii.String(name + "-state"),
+			PartitionKey:        &awsdynamodb.Attribute{Name: jsii.String("pk"), Type: awsdynamodb.AttributeType_STRING},
+			SortKey:             &awsdynamodb.Attribute{Name: jsii.String("runId"), Type: awsdynamodb.AttributeType_STRING},
+			BillingMode:         awsdynamodb.BillingMode_PAY_PER_REQUEST,
+			TimeToLiveAttribute: jsii.String("expiresAt"),
+			RemovalPolicy:       awscdk.RemovalPolicy_DESTROY,
+		})
+	}
+
 	// ========================================================================
 	// IAM ROLE SETUP
 	// ========================================================================
@@ -45,6 +67,19 @@ func NewKarpenterAwsShutdownScheduleStack(scope constructs.Construct, id string,
 	vpcId := os.Getenv("KARPENTER_VPC_ID")
 	subnetId := os.Getenv("KARPENTER_SUBNET")
 	hasVpcConfig := vpcId != "" && subnetId != ""
+	kubeconfigSecretId := os.Getenv("KUBECONFIG_SECRET_ID")
+	// KARPENTER_CLUSTERS_FILE lists several clusters to manage from this one deployment
+	clustersConfig, clusterRoleArns, kubeconfigSecretIds := loadClustersConfig(os.Getenv("KARPENTER_CLUSTERS_FILE"))
+	if clusterRoleArn := os.Getenv("KUBERNETES_CLUSTER_ROLE_ARN"); clusterRoleArn != "" {
+		clusterRoleArns = append(clusterRoleArns, clusterRoleArn)
+	}
+	if kubeconfigSecretId != "" {
+		kubeconfigSecretIds = append(kubeconfigSecretIds, kubeconfigSecretId)
+	}
+	// The configuration document can instead be read at invocation time from
+	// SSM Parameter Store or S3, so it can change without a redeploy
+	configParameter := os.Getenv("KARPENTER_CONFIG_SSM_PARAMETER")
+	configS3Uri := os.Getenv("KARPENTER_CONFIG_S3_URI")
 
 	var lambdaRole awsiam.IRole
 
@@ -55,7 +90,23 @@ func NewKarpenterAwsShutdownScheduleStack(scope constructs.Construct, id string,
 		fmt.Println("  - ec2:DescribeInstances")
 		fmt.Println("  - ec2:TerminateInstances")
 		fmt.Println("  - eks:DescribeCluster")
+		fmt.Println("  - lambda:InvokeFunction on the function itself, to continue long runs")
 		fmt.Println("  - CloudWatch Logs permissions (AWSLambdaBasicExecutionRole)")
+		if len(kubeconfigSecretIds) > 0 {
+			fmt.Println("  - secretsmanager:GetSecretValue on the kubeconfig secrets")
+		}
+		if len(clusterRoleArns) > 0 {
+			fmt.Println("  - sts:AssumeRole on the cluster roles")
+		}
+		if configParameter != "" {
+			fmt.Println("  - ssm:GetParameter on the config parameter")
+		}
+		if configS3Uri != "" {
+			fmt.Println("  - s3:GetObject and s3:GetObjectVersion on the config object")
+		}
+		if stateTable != nil {
+			fmt.Println("  - dynamodb:PutItem and dynamodb:Query on the state table")
+		}
 		if hasVpcConfig {
 			fmt.Println("  - VPC permissions (AWSLambdaVPCAccessExecutionRole)")
 		}
@@ -76,26 +127,78 @@ func NewKarpenterAwsShutdownScheduleStack(scope constructs.Construct, id string,
 				awsiam.ManagedPolicy_FromAwsManagedPolicyName(jsii.String("service-role/AWSLambdaVPCAccessExecutionRole")))
 		}
 
+		statements := []awsiam.PolicyStatement{
+			awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Effect: awsiam.Effect_ALLOW,
+				Actions: jsii.Strings(
+					"ec2:DescribeInstances",
+					"ec2:TerminateInstances",
+					"eks:DescribeCluster",
+					"logs:CreateLogGroup",
+					"logs:CreateLogStream",
+					"logs:PutLogEvents",
+				),
+				Resources: jsii.Strings("*"),
+			}),
+			// The function invokes itself to continue a run that is running out of time
+			awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Effect:    awsiam.Effect_ALLOW,
+				Actions:   jsii.Strings("lambda:InvokeFunction"),
+				Resources: jsii.Strings(functionArn(stack, name)),
+			}),
+		}
+		if len(kubeconfigSecretIds) > 0 {
+			fmt.Println("Kubeconfig secrets detected - adding secretsmanager:GetSecretValue permission")
+			var secretArns []string
+			for _, secretId := range kubeconfigSecretIds {
+				secretArns = append(secretArns, secretArn(stack, secretId))
+			}
+			statements = append(statements, awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Effect:    awsiam.Effect_ALLOW,
+				Actions:   jsii.Strings("secretsmanager:GetSecretValue"),
+				Resources: jsii.Strings(secretArns...),
+			}))
+		}
+		if len(clusterRoleArns) > 0 {
+			fmt.Println("Cluster roles detected - adding sts:AssumeRole permission")
+			statements = append(statements, awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Effect:    awsiam.Effect_ALLOW,
+				Actions:   jsii.Strings("sts:AssumeRole"),
+				Resources: jsii.Strings(clusterRoleArns...),
+			}))
+		}
+		if configParameter != "" {
+			fmt.Println("Config parameter detected - adding ssm:GetParameter permission")
+			statements = append(statements, awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Effect:    awsiam.Effect_ALLOW,
+				Actions:   jsii.Strings("ssm:GetParameter"),
+				Resources: jsii.Strings(parameterArn(stack, configParameter)),
+			}))
+		}
+		if configS3Uri != "" {
+			fmt.Println("Config object detected - adding s3:GetObject permission")
+			statements = append(statements, awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Effect:    awsiam.Effect_ALLOW,
+				Actions:   jsii.Strings("s3:GetObject", "s3:GetObjectVersion"),
+				Resources: jsii.Strings(s3ObjectArn(configS3Uri)),
+			}))
+		}
+		if stateTable != nil {
+			fmt.Println("State table enabled - adding dynamodb:PutItem and dynamodb:Query permissions")
+			statements = append(statements, awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+				Effect:    awsiam.Effect_ALLOW,
+				Actions:   jsii.Strings("dynamodb:PutItem", "dynamodb:Query"),
+				Resources: &[]*string{stateTable.TableArn()},
+			}))
+		}
+
 		lambdaRole = awsiam.NewRole(stack, jsii.String("LambdaRole"), &awsiam.RoleProps{
 			RoleName:        jsii.String(name),
 			AssumedBy:       awsiam.NewServicePrincipal(jsii.String("lambda.amazonaws.com"), nil),
 			ManagedPolicies: &managedPolicies,
 			InlinePolicies: &map[string]awsiam.PolicyDocument{
 				"LambdaPermissions": awsiam.NewPolicyDocument(&awsiam.PolicyDocumentProps{
-					Statements: &[]awsiam.PolicyStatement{
-						awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
-							Effect: awsiam.Effect_ALLOW,
-							Actions: jsii.Strings(
-								"ec2:DescribeInstances",
-								"ec2:TerminateInstances",
-								"eks:DescribeCluster",
-								"logs:CreateLogGroup",
-								"logs:CreateLogStream",
-								"logs:PutLogEvents",
-							),
-							Resources: jsii.Strings("*"),
-						}),
-					},
+					Statements: &statements,
 				}),
 			},
 		})
@@ -118,6 +221,59 @@ func NewKarpenterAwsShutdownScheduleStack(scope constructs.Construct, id string,
 	if os.Getenv("KARPENTER_EXTRA_SHUTDOWN_TAG") != "" {
 		envMap["SHUTDOWN_TAG"] = jsii.String(os.Getenv("KARPENTER_EXTRA_SHUTDOWN_TAG"))
 	}
+	if authMode := os.Getenv("KUBERNETES_AUTH_MODE"); authMode != "" {
+		envMap["KUBERNETES_AUTH_MODE"] = jsii.String(authMode)
+	}
+	if kubeconfigSecretId != "" {
+		envMap["KUBECONFIG_SECRET_ID"] = jsii.String(kubeconfigSecretId)
+	}
+	if clustersConfig != "" {
+		envMap["KARPENTER_CLUSTERS"] = jsii.String(clustersConfig)
+	}
+	if configParameter != "" {
+		envMap["KARPENTER_CONFIG_SSM_PARAMETER"] = jsii.String(configParameter)
+	}
+	if configS3Uri != "" {
+		envMap["KARPENTER_CONFIG_S3_URI"] = jsii.String(configS3Uri)
+	}
+	if stateTable != nil {
+		envMap["KARPENTER_STATE_TABLE"] = stateTable.TableName()
+	}
+	for _, key := range []string{
+		"KARPENTER_PARALLELISM",
+		"KARPENTER_DEADLINE_THRESHOLD",
+		"KARPENTER_SELF_CONTINUE",
+		"KARPENTER_MAX_INVOCATIONS",
+		"KARPENTER_NODEPOOL_SCALE",
+		"KARPENTER_OFFPEAK_INSTANCE_SIZES",
+		"KARPENTER_WORKLOAD_NAMESPACES",
+		"KARPENTER_WORKLOAD_SELECTOR",
+		"KARPENTER_CRONJOB_NAMESPACES",
+		"KARPENTER_AUTOSCALER_NAMESPACES",
+		"KARPENTER_ARGOCD_APPLICATIONS",
+		"KARPENTER_FLUX_KUSTOMIZATIONS",
+		"KARPENTER_FLUX_HELMRELEASES",
+		"KARPENTER_SLEEP_PAGE_SERVICE",
+		"KARPENTER_DO_NOT_DISRUPT_POLICY",
+		"KARPENTER_DO_NOT_DISRUPT_DEADLINE",
+		"KARPENTER_BLOCK_NAMESPACES",
+		"KARPENTER_BLOCK_SELECTOR",
+		"KARPENTER_BLOCK_CUTOFF",
+		"KARPENTER_OVERRIDES_CONFIGMAP",
+	} {
+		if value := os.Getenv(key); value != "" {
+			envMap[key] = jsii.String(value)
+		}
+	}
+	for _, key := range []string{
+		"KUBERNETES_CLUSTER_ROLE_ARN",
+		"KUBERNETES_CLUSTER_ROLE_EXTERNAL_ID",
+		"KUBERNETES_CLUSTER_ROLE_SESSION_NAME",
+	} {
+		if value := os.Getenv(key); value != "" {
+			envMap[key] = jsii.String(value)
+		}
+	}
 
 	// ========================================================================
 	// BUILD PATH CONFIGURATION
@@ -232,6 +388,11 @@ func NewKarpenterAwsShutdownScheduleStack(scope constructs.Construct, id string,
 	startupSchedule := utils.GetenvDefault("KARPENTER_NODEPOOL_STARTUP_SCHEDULE", "cron(0 7 * * ? *)")    // 7am morning time
 	timezone := utils.GetenvDefault("KARPENTER_SCHEDULE_TIMEZONE", "Australia/Sydney")                    // Yes I'm in Sydney - Adjust to your needs.
 	state := utils.GetenvDefault("KARPENTER_SCHEDULE_FUNCTION_STATE", "ENABLED")
+	// "scale" keeps a reduced capacity overnight instead of shutting down
+	shutdownAction := utils.GetenvDefault("KARPENTER_SHUTDOWN_ACTION", "shutdown")
+	if err := validateShutdownAction(shutdownAction); err != nil {
+		log.Fatal(err)
+	}
 
 	// Create IAM role for EventBridge Scheduler
 	schedulerRole := awsiam.NewRole(stack, jsii.String("SchedulerRole"), &awsiam.RoleProps{
@@ -254,7 +415,7 @@ func NewKarpenterAwsShutdownScheduleStack(scope constructs.Construct, id string,
 		Target: &awsscheduler.CfnSchedule_TargetProperty{
 			Arn:     function.FunctionArn(),
 			RoleArn: schedulerRole.RoleArn(),
-			Input:   jsii.String(`{"Action": "shutdown"}`),
+			Input:   jsii.String(fmt.Sprintf(`{"Action": "%s"}`, shutdownAction)),
 		},
 		FlexibleTimeWindow: &awsscheduler.CfnSchedule_FlexibleTimeWindowProperty{
 			Mode:                   jsii.String("FLEXIBLE"),
@@ -295,6 +456,119 @@ func main() {
 	app.Synth(nil)
 }
 
+// loadClustersConfig reads the multi-cluster configuration document, returning
+// it compacted for the Lambda environment along with the roles it assumes and
+// the kubeconfig secrets it reads.
+func loadClustersConfig(path string) (string, []string, []string) {
+	if path == "" {
+		return "", nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatalf("failed to read KARPENTER_CLUSTERS_FILE: %v", err)
+	}
+	// The function accepts YAML as well as JSON, the environment carries JSON
+	data, err = yaml.YAMLToJSON(data)
+	if err != nil {
+		log.Fatalf("failed to parse KARPENTER_CLUSTERS_FILE: %v", err)
+	}
+
+	var doc struct {
+		Clusters []struct {
+			Name               string `json:"name"`
+			RoleArn            string `json:"roleArn"`
+			KubeconfigSecretId string `json:"kubeconfigSecretId"`
+		} `json:"clusters"`
+	}
+	if err := json.Unmarshal(data, &doc); err != nil {
+		log.Fatalf("failed to parse KARPENTER_CLUSTERS_FILE: %v", err)
+	}
+
+	var roleArns, secretIds []string
+	for _, cluster := range doc.Clusters {
+		fmt.Printf("Managing cluster: %s\n", cluster.Name)
+		if cluster.RoleArn != "" {
+			roleArns = append(roleArns, cluster.RoleArn)
+		}
+		if cluster.KubeconfigSecretId != "" {
+			secretIds = append(secretIds, cluster.KubeconfigSecretId)
+		}
+	}
+
+	var compact bytes.Buffer
+	if err := json.Compact(&compact, data); err != nil {
+		log.Fatalf("failed to compact KARPENTER_CLUSTERS_FILE: %v", err)
+	}
+
+	return compact.String(), roleArns, secretIds
+}
+
+// nightActions are the actions the shutdown schedule can run, see the
+// function's isNightAction.
+var nightActions = []string{"shutdown", "scale", "spot", "offpeak"}
+
+// validateShutdownAction rejects a KARPENTER_SHUTDOWN_ACTION the function
+// does not support, which would otherwise only fail at night.
+func validateShutdownAction(action string) error {
+	for _, supported := range nightActions {
+		if action == supported {
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid KARPENTER_SHUTDOWN_ACTION %q, expected one of %s", action, strings.Join(nightActions, ", "))
+}
+
+// parameterArn returns the ARN of an SSM parameter given by name or ARN,
+// ignoring any ":version" selector after the name's last "/".
+func parameterArn(stack awscdk.Stack, name string) string {
+	if i := strings.LastIndex(name, ":"); i > strings.LastIndex(name, "/") && i > 0 {
+		name = name[:i]
+	}
+	if strings.HasPrefix(name, "arn:") {
+		return name
+	}
+	return *stack.FormatArn(&awscdk.ArnComponents{
+		Service:      jsii.String("ssm"),
+		Resource:     jsii.String("parameter"),
+		ResourceName: jsii.String(strings.TrimPrefix(name, "/")),
+	})
+}
+
+// s3ObjectArn converts s3://bucket/key[?versionId=...] into the object ARN.
+func s3ObjectArn(uri string) string {
+	path := strings.TrimPrefix(uri, "s3://")
+	if i := strings.Index(path, "?"); i >= 0 {
+		path = path[:i]
+	}
+	return fmt.Sprintf("arn:aws:s3:::%s", path)
+}
+
+// functionArn returns the ARN of the Lambda function with the given name in
+// this stack's account and region.
+func functionArn(stack awscdk.Stack, name string) string {
+	return *stack.FormatArn(&awscdk.ArnComponents{
+		Service:      jsii.String("lambda"),
+		Resource:     jsii.String("function"),
+		ResourceName: jsii.String(name),
+		ArnFormat:    awscdk.ArnFormat_COLON_RESOURCE_NAME,
+	})
+}
+
+// secretArn accepts either a secret ARN or name; names are matched with the
+// random suffix Secrets Manager appends to the ARN.
+func secretArn(stack awscdk.Stack, secretId string) string {
+	if strings.HasPrefix(secretId, "arn:") {
+		return secretId
+	}
+	return *stack.FormatArn(&awscdk.ArnComponents{
+		Service:      jsii.String("secretsmanager"),
+		Resource:     jsii.String("secret"),
+		ResourceName: jsii.String(secretId + "-*"),
+		ArnFormat:    awscdk.ArnFormat_COLON_RESOURCE_NAME,
+	})
+}
+
 func env() *awscdk.Environment {
 	return &awscdk.Environment{
 		Account: jsii.String(os.Getenv("CDK_DEFAULT_ACCOUNT")),
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/aws/aws-cdk-go/awscdk/v2"
@@ -77,6 +78,21 @@ func TestKarpenterAwsShutdownScheduleStack(t *testing.T) {
 		},
 	})
 
+	// Assert the Lambda may invoke itself to continue long runs
+	template.HasResourceProperties(jsii.String("AWS::IAM::Role"), map[string]interface{}{
+		"Policies": assertions.Match_ArrayWith(&[]interface{}{
+			assertions.Match_ObjectLike(&map[string]interface{}{
+				"PolicyDocument": map[string]interface{}{
+					"Statement": assertions.Match_ArrayWith(&[]interface{}{
+						assertions.Match_ObjectLike(&map[string]interface{}{
+							"Action": jsii.String("lambda:InvokeFunction"),
+						}),
+					}),
+				},
+			}),
+		}),
+	})
+
 	// Assert Shutdown Schedule is created
 	template.HasResourceProperties(jsii.String("AWS::Scheduler::Schedule"), map[string]interface{}{
 		"ScheduleExpression":         jsii.String("cron(0 22 * * ? *)"),
@@ -532,3 +548,356 @@ func restoreEnvVar(key, originalValue string) {
 		os.Unsetenv(key)
 	}
 }
+
+func TestKarpenterAwsShutdownScheduleStackWithKubeconfigSecret(t *testing.T) {
+	// GIVEN
+	app := awscdk.NewApp(nil)
+
+	envVars := map[string]string{
+		"KARPENTER_NODEPOOLS":  "test-nodepool",
+		"KUBERNETES_AUTH_MODE": "kubeconfig",
+		"KUBECONFIG_SECRET_ID": "karpenter/kubeconfig",
+		"KARPENTER_VPC_ID":     "",
+		"KARPENTER_SUBNET":     "",
+		"LAMBDA_ROLE_ARN":      "",
+	}
+	originalValues := make(map[string]string)
+	for key, value := range envVars {
+		originalValues[key] = os.Getenv(key)
+		setEnvVar(key, value)
+	}
+	defer func() {
+		for key, originalValue := range originalValues {
+			restoreEnvVar(key, originalValue)
+		}
+	}()
+
+	// WHEN
+	stack := NewKarpenterAwsShutdownScheduleStack(app, "MyKubeconfigStack", nil)
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+
+	template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Environment": map[string]interface{}{
+			"Variables": assertions.Match_ObjectLike(&map[string]interface{}{
+				"KUBERNETES_AUTH_MODE": jsii.String("kubeconfig"),
+				"KUBECONFIG_SECRET_ID": jsii.String("karpenter/kubeconfig"),
+			}),
+		},
+	})
+
+	template.HasResourceProperties(jsii.String("AWS::IAM::Role"), map[string]interface{}{
+		"Policies": assertions.Match_ArrayWith(&[]interface{}{
+			assertions.Match_ObjectLike(&map[string]interface{}{
+				"PolicyDocument": map[string]interface{}{
+					"Statement": assertions.Match_ArrayWith(&[]interface{}{
+						assertions.Match_ObjectLike(&map[string]interface{}{
+							"Action": jsii.String("secretsmanager:GetSecretValue"),
+						}),
+					}),
+				},
+			}),
+		}),
+	})
+}
+
+func TestKarpenterAwsShutdownScheduleStackWithClustersFile(t *testing.T) {
+	// GIVEN
+	app := awscdk.NewApp(nil)
+
+	clustersFile := filepath.Join(t.TempDir(), "clusters.json")
+	err := os.WriteFile(clustersFile, []byte(`{
+		"clusters": [
+			{"name": "dev", "nodePools": ["default"]},
+			{"name": "staging", "roleArn": "arn:aws:iam::111111111111:role/shutdown-schedule", "nodePools": ["default"]},
+			{"name": "on-prem", "kubeconfigSecretId": "arn:aws:secretsmanager:ap-southeast-2:123456789012:secret:on-prem-kubeconfig-AbCdEf", "nodePools": ["default"]}
+		]
+	}`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	envVars := map[string]string{
+		"KARPENTER_NODEPOOLS":     "test-nodepool",
+		"KARPENTER_FUNCTION_NAME": "karpenter-shutdown-all-clusters",
+		"KARPENTER_CLUSTERS_FILE": clustersFile,
+		"KARPENTER_VPC_ID":        "",
+		"KARPENTER_SUBNET":        "",
+		"LAMBDA_ROLE_ARN":         "",
+	}
+	originalValues := make(map[string]string)
+	for key, value := range envVars {
+		originalValues[key] = os.Getenv(key)
+		setEnvVar(key, value)
+	}
+	defer func() {
+		for key, originalValue := range originalValues {
+			restoreEnvVar(key, originalValue)
+		}
+	}()
+
+	// WHEN
+	stack := NewKarpenterAwsShutdownScheduleStack(app, "MyClustersStack", nil)
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+
+	template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"FunctionName": jsii.String("karpenter-shutdown-all-clusters"),
+		"Environment": map[string]interface{}{
+			"Variables": assertions.Match_ObjectLike(&map[string]interface{}{
+				"KARPENTER_CLUSTERS": assertions.Match_StringLikeRegexp(jsii.String(`"name":"staging"`)),
+			}),
+		},
+	})
+
+	template.HasResourceProperties(jsii.String("AWS::IAM::Role"), map[string]interface{}{
+		"Policies": assertions.Match_ArrayWith(&[]interface{}{
+			assertions.Match_ObjectLike(&map[string]interface{}{
+				"PolicyDocument": map[string]interface{}{
+					"Statement": assertions.Match_ArrayWith(&[]interface{}{
+						assertions.Match_ObjectLike(&map[string]interface{}{
+							"Action":   jsii.String("secretsmanager:GetSecretValue"),
+							"Resource": jsii.String("arn:aws:secretsmanager:ap-southeast-2:123456789012:secret:on-prem-kubeconfig-AbCdEf"),
+						}),
+						assertions.Match_ObjectLike(&map[string]interface{}{
+							"Action":   jsii.String("sts:AssumeRole"),
+							"Resource": jsii.String("arn:aws:iam::111111111111:role/shutdown-schedule"),
+						}),
+					}),
+				},
+			}),
+		}),
+	})
+}
+
+func TestLoadClustersConfigYAML(t *testing.T) {
+	clustersFile := filepath.Join(t.TempDir(), "clusters.yaml")
+	err := os.WriteFile(clustersFile, []byte(`
+clusters:
+  - name: dev
+    nodePools: [default]
+  - name: staging
+    roleArn: arn:aws:iam::111111111111:role/shutdown-schedule
+    nodePools: [default]
+`), 0o600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	config, roleArns, secretIds := loadClustersConfig(clustersFile)
+
+	expected := `{"clusters":[{"name":"dev","nodePools":["default"]},{"name":"staging","nodePools":["default"],"roleArn":"arn:aws:iam::111111111111:role/shutdown-schedule"}]}`
+	if config != expected {
+		t.Errorf("expected config %s, got %s", expected, config)
+	}
+	if len(roleArns) != 1 || roleArns[0] != "arn:aws:iam::111111111111:role/shutdown-schedule" {
+		t.Errorf("expected the staging role, got %v", roleArns)
+	}
+	if len(secretIds) != 0 {
+		t.Errorf("expected no kubeconfig secrets, got %v", secretIds)
+	}
+}
+
+func TestKarpenterAwsShutdownScheduleStackWithRuntimeConfig(t *testing.T) {
+	// GIVEN
+	app := awscdk.NewApp(nil)
+
+	envVars := map[string]string{
+		"KARPENTER_NODEPOOLS":            "test-nodepool",
+		"KARPENTER_CONFIG_SSM_PARAMETER": "/karpenter/shutdown-schedule:4",
+		"KARPENTER_CONFIG_S3_URI":        "",
+		"KARPENTER_VPC_ID":               "",
+		"KARPENTER_SUBNET":               "",
+		"LAMBDA_ROLE_ARN":                "",
+	}
+	originalValues := make(map[string]string)
+	for key, value := range envVars {
+		originalValues[key] = os.Getenv(key)
+		setEnvVar(key, value)
+	}
+	defer func() {
+		for key, originalValue := range originalValues {
+			restoreEnvVar(key, originalValue)
+		}
+	}()
+
+	// WHEN
+	stack := NewKarpenterAwsShutdownScheduleStack(app, "MyRuntimeConfigStack", &KarpenterAwsShutdownScheduleStackProps{
+		awscdk.StackProps{
+			Env: &awscdk.Environment{
+				Account: jsii.String("123456789012"),
+				Region:  jsii.String("ap-southeast-2"),
+			},
+		},
+	})
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+
+	template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Environment": map[string]interface{}{
+			"Variables": assertions.Match_ObjectLike(&map[string]interface{}{
+				"KARPENTER_CONFIG_SSM_PARAMETER": jsii.String("/karpenter/shutdown-schedule:4"),
+			}),
+		},
+	})
+
+	template.HasResourceProperties(jsii.String("AWS::IAM::Role"), map[string]interface{}{
+		"Policies": assertions.Match_ArrayWith(&[]interface{}{
+			assertions.Match_ObjectLike(&map[string]interface{}{
+				"PolicyDocument": map[string]interface{}{
+					"Statement": assertions.Match_ArrayWith(&[]interface{}{
+						assertions.Match_ObjectLike(&map[string]interface{}{
+							"Action": jsii.String("ssm:GetParameter"),
+						}),
+					}),
+				},
+			}),
+		}),
+	})
+}
+
+func TestKarpenterAwsShutdownScheduleStackWithStateTable(t *testing.T) {
+	// GIVEN
+	app := awscdk.NewApp(nil)
+
+	envVars := map[string]string{
+		"KARPENTER_NODEPOOLS":   "test-nodepool",
+		"KARPENTER_STATE_STORE": "dynamodb",
+		"KARPENTER_VPC_ID":      "",
+		"KARPENTER_SUBNET":      "",
+		"LAMBDA_ROLE_ARN":       "",
+	}
+	originalValues := make(map[string]string)
+	for key, value := range envVars {
+		originalValues[key] = os.Getenv(key)
+		setEnvVar(key, value)
+	}
+	defer func() {
+		for key, originalValue := range originalValues {
+			restoreEnvVar(key, originalValue)
+		}
+	}()
+
+	// WHEN
+	stack := NewKarpenterAwsShutdownScheduleStack(app, "MyStateTableStack", nil)
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+
+	template.HasResourceProperties(jsii.String("AWS::DynamoDB::Table"), map[string]interface{}{
+		"TableName":   jsii.String("karpenter-ec2-instance-stop-start-state"),
+		"BillingMode": jsii.String("PAY_PER_REQUEST"),
+		"TimeToLiveSpecification": map[string]interface{}{
+			"AttributeName": jsii.String("expiresAt"),
+			"Enabled":       jsii.Bool(true),
+		},
+	})
+
+	template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Environment": map[string]interface{}{
+			"Variables": assertions.Match_ObjectLike(&map[string]interface{}{
+				"KARPENTER_STATE_TABLE": assertions.Match_AnyValue(),
+			}),
+		},
+	})
+
+	template.HasResourceProperties(jsii.String("AWS::IAM::Role"), map[string]interface{}{
+		"Policies": assertions.Match_ArrayWith(&[]interface{}{
+			assertions.Match_ObjectLike(&map[string]interface{}{
+				"PolicyDocument": map[string]interface{}{
+					"Statement": assertions.Match_ArrayWith(&[]interface{}{
+						assertions.Match_ObjectLike(&map[string]interface{}{
+							"Action": []interface{}{jsii.String("dynamodb:PutItem"), jsii.String("dynamodb:Query")},
+						}),
+					}),
+				},
+			}),
+		}),
+	})
+}
+
+func TestKarpenterAwsShutdownScheduleStackWithScaleAction(t *testing.T) {
+	// GIVEN
+	app := awscdk.NewApp(nil)
+
+	envVars := map[string]string{
+		"KARPENTER_NODEPOOLS":       "test-nodepool",
+		"KARPENTER_SHUTDOWN_ACTION": "scale",
+		"KARPENTER_NODEPOOL_SCALE":  "10%",
+		"KARPENTER_VPC_ID":          "",
+		"KARPENTER_SUBNET":          "",
+		"LAMBDA_ROLE_ARN":           "",
+	}
+	originalValues := make(map[string]string)
+	for key, value := range envVars {
+		originalValues[key] = os.Getenv(key)
+		setEnvVar(key, value)
+	}
+	defer func() {
+		for key, originalValue := range originalValues {
+			restoreEnvVar(key, originalValue)
+		}
+	}()
+
+	// WHEN
+	stack := NewKarpenterAwsShutdownScheduleStack(app, "MyScaleStack", nil)
+
+	// THEN
+	template := assertions.Template_FromStack(stack, nil)
+
+	template.HasResourceProperties(jsii.String("AWS::Scheduler::Schedule"), map[string]interface{}{
+		"Target": map[string]interface{}{
+			"Input": jsii.String(`{"Action": "scale"}`),
+		},
+	})
+
+	template.HasResourceProperties(jsii.String("AWS::Lambda::Function"), map[string]interface{}{
+		"Environment": map[string]interface{}{
+			"Variables": assertions.Match_ObjectLike(&map[string]interface{}{
+				"KARPENTER_NODEPOOL_SCALE": jsii.String("10%"),
+			}),
+		},
+	})
+}
+
+func TestValidateShutdownAction(t *testing.T) {
+	for _, action := range []string{"shutdown", "scale", "spot", "offpeak"} {
+		if err := validateShutdownAction(action); err != nil {
+			t.Errorf("validateShutdownAction(%q) = %v, want nil", action, err)
+		}
+	}
+	for _, action := range []string{"", "startup", "Scale", "sleep"} {
+		if err := validateShutdownAction(action); err == nil {
+			t.Errorf("validateShutdownAction(%q) = nil, want an error", action)
+		}
+	}
+}
+
+func TestParameterArn(t *testing.T) {
+	stack := awscdk.NewStack(awscdk.NewApp(nil), jsii.String("ParameterArnStack"), nil)
+	arn := func(resourceName string) string {
+		return *stack.FormatArn(&awscdk.ArnComponents{
+			Service:      jsii.String("ssm"),
+			Resource:     jsii.String("parameter"),
+			ResourceName: jsii.String(resourceName),
+		})
+	}
+
+	for _, tt := range []struct {
+		name     string
+		expected string
+	}{
+		{"/karpenter/shutdown-schedule", arn("karpenter/shutdown-schedule")},
+		{"/karpenter/shutdown-schedule:4", arn("karpenter/shutdown-schedule")},
+		{"shutdown-schedule:4", arn("shutdown-schedule")},
+		{"arn:aws:ssm:ap-southeast-2:123456789012:parameter/karpenter/shutdown-schedule", "arn:aws:ssm:ap-southeast-2:123456789012:parameter/karpenter/shutdown-schedule"},
+		{"arn:aws:ssm:ap-southeast-2:123456789012:parameter/karpenter/shutdown-schedule:4", "arn:aws:ssm:ap-southeast-2:123456789012:parameter/karpenter/shutdown-schedule"},
+	} {
+		if got := parameterArn(stack, tt.name); got != tt.expected {
+			t.Errorf("parameterArn(%q) = %q, want %q", tt.name, got, tt.expected)
+		}
+	}
+}